@@ -0,0 +1,124 @@
+//Command migrate applies and reverts the schema migrations of a cassandra keyspace
+//
+//Usage:
+//
+//	migrate [-config file] [-keyspace name] [-hosts host1,host2] [-to version] [-dry-run] up|down|status
+//
+//The cluster is configured by the JSON config file and CASSANDRA_* environment variables (see storage.Load),
+//-keyspace and -hosts override the configured keyspace and hosts.
+//
+//up applies all pending migrations (up to version with -to), down reverts the last applied migration (all migrations above version
+//with -to) and status lists the migrations with their status. With -dry-run, up and down only list the migrations they would apply/revert.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"testtrx/migration"
+	"testtrx/storage"
+
+	"github.com/go-errors/errors"
+)
+
+func main() {
+	configPath := flag.String("config", "", "JSON cluster config file (see storage.Config)")
+	hosts := flag.String("hosts", "", "comma separated list of cluster hosts (overrides config)")
+	keyspace := flag.String("keyspace", "", "keyspace to migrate (overrides config)")
+	to := flag.Int("to", -1, "target version (default latest for up, previous for down)")
+	dryRun := flag.Bool("dry-run", false, "only list the migrations that would be applied/reverted")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] up|down|status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	//Note: the config is validated once flags are applied (by storage.NewSession)
+	config := &storage.Config{}
+	var err *errors.Error
+	if *configPath != "" {
+		if config, err = storage.LoadFile(*configPath); err != nil {
+			fail(err)
+		}
+	}
+	if err := config.LoadEnv("CASSANDRA_"); err != nil {
+		fail(err)
+	}
+	if *hosts != "" {
+		config.Hosts = strings.Split(*hosts, ",")
+	}
+	if *keyspace != "" {
+		config.Keyspace = *keyspace
+	}
+	if config.Keyspace == "" {
+		fail(errors.New("no keyspace to migrate, set it with -keyspace or in config"))
+	}
+	session, err := storage.NewSession(config)
+	if err != nil {
+		fail(err)
+	}
+	defer session.Close()
+
+	migrator, err := migration.NewMigrator(session, migration.Migrations)
+	if err != nil {
+		fail(err)
+	}
+	migrator.SetDryRun(*dryRun)
+
+	var migrations []migration.Migration
+	var migrateErr *errors.Error
+	switch action := flag.Arg(0); {
+	case action == "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			fail(err)
+		}
+		for _, status := range statuses {
+			switch {
+			case !status.Known:
+				fmt.Printf("%4d applied %v (unknown to this release)\n", status.Version, status.AppliedAt.Format("2006-01-02 15:04:05"))
+			case status.Applied:
+				fmt.Printf("%4d applied %v %v\n", status.Version, status.AppliedAt.Format("2006-01-02 15:04:05"), status.Description)
+			default:
+				fmt.Printf("%4d pending %19v %v\n", status.Version, "", status.Description)
+			}
+		}
+		return
+	case action == "up" && *to < 0:
+		migrations, migrateErr = migrator.Up()
+	case action == "up":
+		migrations, migrateErr = migrator.UpTo(*to)
+	case action == "down" && *to < 0:
+		migrations, migrateErr = migrator.Down()
+	case action == "down":
+		migrations, migrateErr = migrator.DownTo(*to)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	verb := map[bool]string{true: "would apply", false: "applied"}
+	if flag.Arg(0) == "down" {
+		verb = map[bool]string{true: "would revert", false: "reverted"}
+	}
+	for _, migration := range migrations {
+		fmt.Printf("%v %d %v\n", verb[*dryRun], migration.Version, migration.Description)
+	}
+	if migrateErr != nil {
+		fail(migrateErr)
+	}
+	if len(migrations) == 0 {
+		fmt.Println("nothing to do")
+	}
+}
+
+//fail is a function for printing err and exiting with failure status
+func fail(err *errors.Error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
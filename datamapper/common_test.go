@@ -2,14 +2,16 @@ package datamapper_test
 
 import (
 	"fmt"
-	"strings"
 	"sync"
+	"testtrx/storage"
 
 	"github.com/gocql/gocql"
 )
 
 //Adjust cluster info and keyspace name prior to running test
-var clusterPool = []string{"127.0.0.1"}
+//The cluster can also be configured with TEST_CASSANDRA_* environment variables (see storage.Config.LoadEnv), e.g. TEST_CASSANDRA_HOSTS
+var clusterConfig = storage.Config{Hosts: []string{"127.0.0.1"}}
+var clusterEnvPrefix = "TEST_CASSANDRA_"
 var keyspaceName string = "user_test"
 var databaseSession *gocql.Session
 var initOnce sync.Once
@@ -40,21 +42,22 @@ func initTest() *gocql.Session {
 
 func createSession(keyspaceName string) *gocql.Session {
 	// connect to the cluster
-	cluster := gocql.NewCluster(strings.Join(clusterPool, ","))
-	cluster.Consistency = gocql.One
-	cluster.Keyspace = keyspaceName
-	session, err := cluster.CreateSession()
-	if err != nil {
-		panic(fmt.Errorf("Could not connect to cluster: %v", err))
-	}
-	return session
+	return connect(keyspaceName, "ONE")
 }
 
 func createInitSession() *gocql.Session {
 	// connect to the cluster
-	cluster := gocql.NewCluster(strings.Join(clusterPool, ","))
-	cluster.Consistency = gocql.Quorum
-	session, err := cluster.CreateSession()
+	return connect("", "QUORUM")
+}
+
+func connect(keyspaceName string, consistency string) *gocql.Session {
+	config := clusterConfig
+	config.Consistency = consistency
+	if err := config.LoadEnv(clusterEnvPrefix); err != nil {
+		panic(err)
+	}
+	config.Keyspace = keyspaceName
+	session, err := storage.NewSession(&config)
 	if err != nil {
 		panic(fmt.Errorf("Could not connect to cluster: %v", err))
 	}
@@ -62,6 +65,10 @@ func createInitSession() *gocql.Session {
 }
 
 func teardownTest() {
+	//nothing to teardown if no test has connected to the cluster (e.g. only in-memory datamapper tests were run)
+	if databaseSession == nil {
+		return
+	}
 	initSession := createInitSession()
 
 	err := initSession.Query(`DROP KEYSPACE IF EXISTS ` + keyspaceName).Exec()
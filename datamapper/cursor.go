@@ -0,0 +1,163 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	stderrors "errors"
+	"strings"
+	"testtrx/model"
+
+	"github.com/go-errors/errors"
+)
+
+//ErrInvalidCursor is the cause of the ErrInvalidInput error returned when a page cursor can't be decoded or its signature doesn't match
+var ErrInvalidCursor = stderrors.New("invalid page cursor")
+
+//cursorSignatureSeparator separates the encoded page state from its encoded signature in a signed cursor
+const cursorSignatureSeparator = "."
+
+//MaxCursorHistory is the maximum number of page states carried by a cursor, so that cursors of deep pages stay small enough
+//for urls and headers: paging backward is only possible up to MaxCursorHistory-1 pages before the last page reached by paging forward,
+//PreviousCursor being empty beyond
+const MaxCursorHistory = 16
+
+//Page is a struct of a page of query results
+type Page[T model.Model] struct {
+	Items          []T    //records of the page
+	NextCursor     string //opaque cursor for fetching the next page, empty if this is the last page
+	PreviousCursor string //opaque cursor for fetching the previous page, empty if this is the first page (or is too far back, see MaxCursorHistory)
+}
+
+//HasNext is a function for checking whether there is a page after this page
+func (p *Page[T]) HasNext() bool {
+	return p.NextCursor != ""
+}
+
+//HasPrevious is a function for checking whether there is a page before this page
+func (p *Page[T]) HasPrevious() bool {
+	return p.PreviousCursor != ""
+}
+
+//newPage is a function for initializing a page of query results of query (see encodeHistory),
+//history is the page states of the visited pages up to (and including) this page and nextPageState is the page state of the next page
+func newPage[T model.Model](codec CursorCodec, query string, items []T, history [][]byte, nextPageState []byte) *Page[T] {
+	page := &Page[T]{Items: items}
+	if len(nextPageState) != 0 {
+		nextHistory := append(history[:len(history):len(history)], nextPageState)
+		//the states of the oldest pages are dropped
+		if len(nextHistory) > MaxCursorHistory {
+			nextHistory = nextHistory[len(nextHistory)-MaxCursorHistory:]
+		}
+		page.NextCursor = codec.encodeHistory(query, nextHistory)
+	}
+	if len(history) > 1 {
+		page.PreviousCursor = codec.encodeHistory(query, history[:len(history)-1])
+	}
+	return page
+}
+
+//cursorQueryAll is the query of the cursors of FindPage
+const cursorQueryAll = "all"
+
+//CursorCodec is a struct for encoding page states of query result paging into opaque cursors (and decoding them back)
+//A cursor is the url safe base64 encoding of the page states visited so far, when a secret is set the cursor is also signed
+//with HMAC-SHA256 so that clients can't forge page states
+type CursorCodec struct {
+	secret []byte //secret key for signing cursors, cursors are not signed when empty
+}
+
+//NewCursorCodec is a function for initializing a new cursor codec, secret may be nil for unsigned cursors
+func NewCursorCodec(secret []byte) CursorCodec {
+	return CursorCodec{secret}
+}
+
+//Encode is a function for encoding a page state into a cursor, an empty page state (no more pages) is encoded as empty cursor
+func (c CursorCodec) Encode(pageState []byte) string {
+	if len(pageState) == 0 {
+		return ""
+	}
+	cursor := base64.RawURLEncoding.EncodeToString(pageState)
+	if len(c.secret) == 0 {
+		return cursor
+	}
+	return cursor + cursorSignatureSeparator + base64.RawURLEncoding.EncodeToString(c.sign(pageState))
+}
+
+//Decode is a function for decoding a cursor into a page state, an empty cursor is decoded as empty page state (first page)
+func (c CursorCodec) Decode(cursor string) ([]byte, *errors.Error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	encodedState, encodedSignature, signed := strings.Cut(cursor, cursorSignatureSeparator)
+	if signed != (len(c.secret) != 0) {
+		return nil, newError(ErrInvalidInput, ErrInvalidCursor)
+	}
+	pageState, err := base64.RawURLEncoding.DecodeString(encodedState)
+	if err != nil || len(pageState) == 0 {
+		return nil, newError(ErrInvalidInput, ErrInvalidCursor)
+	}
+	if signed {
+		signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+		if err != nil || !hmac.Equal(signature, c.sign(pageState)) {
+			return nil, newError(ErrInvalidInput, ErrInvalidCursor)
+		}
+	}
+	return pageState, nil
+}
+
+//encodeHistory is a function for encoding page history (page states of the visited pages, the last one being the state of the page
+//the cursor points to) of query into a cursor
+//query identifies the query the page states belong to (e.g. cursorQueryAll), it is encoded (and signed) along with the history
+//so that a cursor of a query is rejected by another one rather than being used as a page state of a different query
+//Note: cassandra page states can only move forward, so a cursor carries the states of the pages before it (up to MaxCursorHistory)
+//to be able to page backward
+func (c CursorCodec) encodeHistory(query string, history [][]byte) string {
+	payload := binary.AppendUvarint(nil, uint64(len(query)))
+	payload = append(payload, query...)
+	for _, pageState := range history {
+		payload = binary.AppendUvarint(payload, uint64(len(pageState)))
+		payload = append(payload, pageState...)
+	}
+	return c.Encode(payload)
+}
+
+//decodeHistory is a function for decoding a cursor of query into page history, an empty cursor is decoded as history of the first page
+//The first page state of a history is empty (the first page of a query) unless the states of the oldest pages have been dropped
+func (c CursorCodec) decodeHistory(query, cursor string) ([][]byte, *errors.Error) {
+	payload, err := c.Decode(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if payload == nil {
+		return [][]byte{nil}, nil
+	}
+	var history [][]byte
+	for len(payload) > 0 {
+		size, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < size {
+			return nil, newError(ErrInvalidInput, ErrInvalidCursor)
+		}
+		payload = payload[n:]
+		var pageState []byte
+		if size > 0 {
+			pageState = payload[:size]
+		}
+		history = append(history, pageState)
+		payload = payload[size:]
+	}
+	//the first element is the query
+	if len(history) < 2 || len(history) > MaxCursorHistory+1 || string(history[0]) != query {
+		return nil, newError(ErrInvalidInput, ErrInvalidCursor)
+	}
+	return history[1:], nil
+}
+
+//sign is a function for computing the HMAC-SHA256 signature of a page state
+func (c CursorCodec) sign(pageState []byte) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(pageState)
+	return mac.Sum(nil)
+}
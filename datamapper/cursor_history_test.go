@@ -0,0 +1,83 @@
+//cursor_history_test provides unit tests for page history cursors
+package datamapper
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+	"testtrx/model"
+)
+
+func TestCursorHistory(t *testing.T) {
+	history := [][]byte{nil, []byte("page2"), {0x00, 0xff}}
+	for _, secret := range [][]byte{nil, []byte("secret")} {
+		codec := NewCursorCodec(secret)
+		decoded, err := codec.decodeHistory(cursorQueryAll, codec.encodeHistory(cursorQueryAll, history))
+		if err != nil {
+			t.Fatalf("secret %q: failed to decode history: %v", secret, err)
+		}
+		if len(history) != len(decoded) {
+			t.Fatalf("secret %q: want %v page states, got %v", secret, len(history), len(decoded))
+		}
+		for i := range history {
+			if !bytes.Equal(history[i], decoded[i]) {
+				t.Errorf("secret %q: want %v for page state %v, got %v", secret, history[i], i, decoded[i])
+			}
+		}
+
+		//a cursor is only accepted by the query it was made for
+		for _, query := range []string{statusCursorQuery(model.UserStatusActive), ""} {
+			if _, err := codec.decodeHistory(query, codec.encodeHistory(cursorQueryAll, history)); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("secret %q: want invalid cursor error for query %q, got %v", secret, query, err)
+			}
+		}
+		if _, err := codec.decodeHistory(statusCursorQuery(model.UserStatusActive),
+			codec.encodeHistory(statusCursorQuery(model.UserStatusInactive), history)); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("secret %q: want invalid cursor error for the cursor of another status, got %v", secret, err)
+		}
+	}
+}
+
+func TestPageCursorHistoryCapped(t *testing.T) {
+	codec := NewCursorCodec([]byte("secret"))
+	history := [][]byte{nil}
+	var page *Page[*model.User]
+	var cappedLength int
+	for i := 1; i <= 3*MaxCursorHistory; i++ {
+		page = newPage[*model.User](codec, cursorQueryAll, nil, history, []byte("pageState"+strconv.Itoa(i%10)))
+		next, err := codec.decodeHistory(cursorQueryAll, page.NextCursor)
+		if err != nil {
+			t.Fatalf("Failed to decode next cursor of page %v: %v", i, err)
+		}
+		history = next
+		//the cursors stop growing once the history is capped
+		if len(history) > MaxCursorHistory {
+			t.Fatalf("want at most %v page states, got %v", MaxCursorHistory, len(history))
+		}
+		if i == MaxCursorHistory {
+			cappedLength = len(page.NextCursor)
+		} else if i > MaxCursorHistory && len(page.NextCursor) != cappedLength {
+			t.Fatalf("want cursor of page %v as long as the capped cursor (%v), got %v", i, cappedLength, len(page.NextCursor))
+		}
+	}
+
+	//paging backward stops once the dropped pages are reached
+	backward := 0
+	for page = newPage[*model.User](codec, cursorQueryAll, nil, history, nil); page.HasPrevious(); backward++ {
+		previous, err := codec.decodeHistory(cursorQueryAll, page.PreviousCursor)
+		if err != nil {
+			t.Fatalf("Failed to decode previous cursor: %v", err)
+		}
+		page = newPage[*model.User](codec, cursorQueryAll, nil, previous, []byte("next"))
+	}
+	if MaxCursorHistory-1 != backward {
+		t.Errorf("want %v pages backward, got %v", MaxCursorHistory-1, backward)
+	}
+
+	//a cursor carrying more page states than the cap is not accepted
+	tooLong := make([][]byte, MaxCursorHistory+1)
+	if _, err := codec.decodeHistory(cursorQueryAll, codec.encodeHistory(cursorQueryAll, tooLong)); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("want invalid cursor error for too long history, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+//cursor_test provides unit tests for page cursor codec
+package datamapper_test
+
+import (
+	"testtrx/datamapper"
+	"testtrx/model"
+
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCursorCodec(t *testing.T) {
+	pageState := []byte{0x00, 0x01, 0xfe, 0xff, 'p', 'a', 'g', 'e'}
+
+	for _, secret := range [][]byte{nil, []byte("secret")} {
+		codec := datamapper.NewCursorCodec(secret)
+
+		cursor := codec.Encode(pageState)
+		if cursor == "" {
+			t.Fatalf("secret %q: want non empty cursor, got empty", secret)
+		}
+		decoded, err := codec.Decode(cursor)
+		if err != nil {
+			t.Fatalf("secret %q: failed to decode cursor: %v", secret, err)
+		}
+		if !bytes.Equal(pageState, decoded) {
+			t.Errorf("secret %q: want %v for decoded page state, got %v", secret, pageState, decoded)
+		}
+
+		//no page state means no more pages, and an empty cursor means the first page
+		if cursor := codec.Encode(nil); cursor != "" {
+			t.Errorf("secret %q: want empty cursor for empty page state, got %v", secret, cursor)
+		}
+		if decoded, err := codec.Decode(""); err != nil || decoded != nil {
+			t.Errorf("secret %q: want nil page state for empty cursor, got %v, %v", secret, decoded, err)
+		}
+	}
+}
+
+func TestCursorCodecRejectsInvalidCursor(t *testing.T) {
+	pageState := []byte("page")
+	unsigned := datamapper.NewCursorCodec(nil)
+	signed := datamapper.NewCursorCodec([]byte("secret"))
+	otherSigned := datamapper.NewCursorCodec([]byte("other secret"))
+
+	for _, tc := range []struct {
+		name   string
+		codec  datamapper.CursorCodec
+		cursor string
+	}{
+		{"malformed", unsigned, "not base64!"},
+		{"unsigned cursor for signed codec", signed, unsigned.Encode(pageState)},
+		{"signed cursor for unsigned codec", unsigned, signed.Encode(pageState)},
+		{"other secret", otherSigned, signed.Encode(pageState)},
+		{"tampered page state", signed, "A" + signed.Encode(pageState)},
+		{"tampered signature", signed, signed.Encode(pageState) + "A"},
+	} {
+		if _, err := tc.codec.Decode(tc.cursor); !errors.Is(err, datamapper.ErrInvalidCursor) {
+			t.Errorf("%v: want invalid cursor error, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestPageHasNextAndPrevious(t *testing.T) {
+	page := datamapper.Page[*model.User]{}
+	if page.HasNext() || page.HasPrevious() {
+		t.Errorf("want no next and previous page for a single page, got %v and %v", page.HasNext(), page.HasPrevious())
+	}
+	page = datamapper.Page[*model.User]{NextCursor: "next", PreviousCursor: "previous"}
+	if !page.HasNext() || !page.HasPrevious() {
+		t.Errorf("want next and previous page, got %v and %v", page.HasNext(), page.HasPrevious())
+	}
+}
@@ -0,0 +1,234 @@
+//Package datamappertest provides conformance test suites that every datamapper implementation should pass
+package datamappertest
+
+import (
+	"testtrx/datamapper"
+	"testtrx/model"
+
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//SessionMapperFactory is a function type for creating a user session datamapper backed by an empty storage
+//It is called once per test case of the suite, implementations should register their cleanup with t.Cleanup
+type SessionMapperFactory func(t *testing.T) datamapper.SessionMapper
+
+//RunSessionMapperSuite is a function for running the user session datamapper conformance tests against mappers created by newMapper
+func RunSessionMapperSuite(t *testing.T, newMapper SessionMapperFactory) {
+	t.Run("AddAndFind", func(t *testing.T) { testAddAndFindSession(t, newMapper(t)) })
+	t.Run("InvalidSession", func(t *testing.T) { testInvalidSession(t, newMapper(t)) })
+	t.Run("DeleteSession", func(t *testing.T) { testDeleteSession(t, newMapper(t)) })
+	t.Run("DeleteByUser", func(t *testing.T) { testDeleteSessionsByUser(t, newMapper(t)) })
+	t.Run("SessionExpiry", func(t *testing.T) { testSessionExpiry(t, newMapper(t)) })
+	t.Run("SessionContextDone", func(t *testing.T) { testSessionContextDone(t, newMapper(t)) })
+}
+
+//NewTestSession is a function for creating the session identified by number of the test user identified by counter for testing,
+//expiring after ttl
+func NewTestSession(counter, number int, ttl time.Duration) *model.Session {
+	now := time.Now()
+	return &model.Session{
+		ID:            "dummySessionID" + strconv.Itoa(counter) + "-" + strconv.Itoa(number),
+		Email:         NewTestUser(counter).Email,
+		UserCreatedAt: now.Add(-24 * time.Hour),
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl),
+	}
+}
+
+//AssertSession is a function for asserting that got session has the same field values as want session
+func AssertSession(tb testing.TB, want, got *model.Session) {
+	tb.Helper()
+	if got == nil {
+		tb.Fatalf("want session %v, got nil", want.ID)
+	}
+	if want.ID != got.ID || want.Email != got.Email {
+		tb.Errorf("want session %v of %v, got %v of %v", want.ID, want.Email, got.ID, got.Email)
+	}
+	//Note: cassandra stores timestamp with millisecond precision, therefore compare up to milliseconds
+	if !want.UserCreatedAt.Truncate(time.Millisecond).Equal(got.UserCreatedAt) {
+		tb.Errorf("want %v for userCreatedAt, got %v", want.UserCreatedAt, got.UserCreatedAt)
+	}
+	if !want.CreatedAt.Truncate(time.Millisecond).Equal(got.CreatedAt) {
+		tb.Errorf("want %v for createdAt, got %v", want.CreatedAt, got.CreatedAt)
+	}
+	if !want.ExpiresAt.Truncate(time.Millisecond).Equal(got.ExpiresAt) {
+		tb.Errorf("want %v for expiresAt, got %v", want.ExpiresAt, got.ExpiresAt)
+	}
+}
+
+//addTestSessions is a function for adding sessions, failing the test if any can't be added
+func addTestSessions(tb testing.TB, sessionMapper datamapper.SessionMapper, sessions ...*model.Session) {
+	tb.Helper()
+	for _, session := range sessions {
+		if ok, err := sessionMapper.Add(session); err != nil || !ok {
+			tb.Fatalf("Failed to add session: %v, %v", ok, err)
+		}
+	}
+}
+
+//assertSessionNotFound is a function for asserting that no session with id is found
+func assertSessionNotFound(tb testing.TB, sessionMapper datamapper.SessionMapper, id string) {
+	tb.Helper()
+	if session, err := sessionMapper.FindByID(id); !errors.Is(err, datamapper.ErrNotFound) {
+		tb.Errorf("want %v error for session %v, got %v and %v", datamapper.ErrNotFound, id, session, err)
+	}
+}
+
+func testAddAndFindSession(t *testing.T, sessionMapper datamapper.SessionMapper) {
+	want := []*model.Session{NewTestSession(1, 1, time.Hour), NewTestSession(1, 2, time.Minute)}
+	otherSession := NewTestSession(2, 1, time.Hour)
+	addTestSessions(t, sessionMapper, want[1], otherSession, want[0])
+
+	for _, session := range append(want, otherSession) {
+		found, err := sessionMapper.FindByID(session.ID)
+		if err != nil {
+			t.Fatalf("Failed to find session: %v", err)
+		}
+		AssertSession(t, session, found)
+	}
+	assertSessionNotFound(t, sessionMapper, "unknownSessionID")
+	if _, err := sessionMapper.FindByID(""); !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want %v error for empty id, got %v", datamapper.ErrInvalidInput, err)
+	}
+
+	//sessions of a user are returned ordered by id
+	got, err := sessionMapper.FindByUser(want[0].Email)
+	if err != nil {
+		t.Fatalf("Failed to find sessions: %v", err)
+	}
+	if len(want) != len(got) {
+		t.Fatalf("want %v sessions, got %v", len(want), len(got))
+	}
+	for i := range want {
+		AssertSession(t, want[i], got[i])
+	}
+	if got, err := sessionMapper.FindByUser("unknown@testemail.com"); err != nil || len(got) != 0 {
+		t.Errorf("want no session for another user, got %v and %v", got, err)
+	}
+}
+
+func testInvalidSession(t *testing.T, sessionMapper datamapper.SessionMapper) {
+	noID := NewTestSession(1, 1, time.Hour)
+	noID.ID = ""
+	noEmail := NewTestSession(1, 2, time.Hour)
+	noEmail.Email = ""
+	expired := NewTestSession(1, 3, -time.Second)
+	for _, session := range []*model.Session{noID, noEmail, expired} {
+		if ok, err := sessionMapper.Add(session); ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+			t.Errorf("want %v error for %+v, got %v and %v", datamapper.ErrInvalidInput, session, ok, err)
+		}
+	}
+	assertSessionNotFound(t, sessionMapper, expired.ID)
+}
+
+func testDeleteSession(t *testing.T, sessionMapper datamapper.SessionMapper) {
+	session := NewTestSession(1, 1, time.Hour)
+	otherSession := NewTestSession(1, 2, time.Hour)
+	addTestSessions(t, sessionMapper, session, otherSession)
+
+	if ok, err := sessionMapper.Delete(session); err != nil || !ok {
+		t.Fatalf("Failed to delete session: %v, %v", ok, err)
+	}
+	assertSessionNotFound(t, sessionMapper, session.ID)
+	got, err := sessionMapper.FindByUser(session.Email)
+	if err != nil {
+		t.Fatalf("Failed to find sessions: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("want 1 session left, got %v", len(got))
+	}
+	AssertSession(t, otherSession, got[0])
+
+	//deleting again is not an error
+	if ok, err := sessionMapper.Delete(session); err != nil || !ok {
+		t.Errorf("want deleted session deleted again, got %v and %v", ok, err)
+	}
+}
+
+func testDeleteSessionsByUser(t *testing.T, sessionMapper datamapper.SessionMapper) {
+	sessions := []*model.Session{NewTestSession(1, 1, time.Hour), NewTestSession(1, 2, time.Hour)}
+	otherSession := NewTestSession(2, 1, time.Hour)
+	addTestSessions(t, sessionMapper, sessions[0], sessions[1], otherSession)
+
+	count, err := sessionMapper.DeleteByUser(sessions[0].Email)
+	if err != nil {
+		t.Fatalf("Failed to delete sessions: %v", err)
+	}
+	if len(sessions) != count {
+		t.Errorf("want %v sessions deleted, got %v", len(sessions), count)
+	}
+	for _, session := range sessions {
+		assertSessionNotFound(t, sessionMapper, session.ID)
+	}
+	if got, err := sessionMapper.FindByUser(sessions[0].Email); err != nil || len(got) != 0 {
+		t.Errorf("want no session left, got %v and %v", got, err)
+	}
+
+	//sessions of other users are kept
+	found, err := sessionMapper.FindByID(otherSession.ID)
+	if err != nil {
+		t.Fatalf("Failed to find session: %v", err)
+	}
+	AssertSession(t, otherSession, found)
+	if count, err := sessionMapper.DeleteByUser("unknown@testemail.com"); err != nil || count != 0 {
+		t.Errorf("want no session deleted for another user, got %v and %v", count, err)
+	}
+}
+
+func testSessionExpiry(t *testing.T, sessionMapper datamapper.SessionMapper) {
+	session := NewTestSession(1, 1, time.Second)
+	otherSession := NewTestSession(1, 2, time.Hour)
+	addTestSessions(t, sessionMapper, session, otherSession)
+	if _, err := sessionMapper.FindByID(session.ID); err != nil {
+		t.Fatalf("Failed to find session: %v", err)
+	}
+
+	//Note: cassandra TTLs have a precision of seconds, the session is removed up to a second after expiring
+	time.Sleep(time.Until(session.ExpiresAt.Add(time.Second)))
+	assertSessionNotFound(t, sessionMapper, session.ID)
+	got, err := sessionMapper.FindByUser(session.Email)
+	if err != nil {
+		t.Fatalf("Failed to find sessions: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("want 1 unexpired session, got %v", len(got))
+	}
+	AssertSession(t, otherSession, got[0])
+	if count, err := sessionMapper.DeleteByUser(session.Email); err != nil || count != 1 {
+		t.Errorf("want 1 unexpired session deleted, got %v and %v", count, err)
+	}
+}
+
+func testSessionContextDone(t *testing.T, sessionMapper datamapper.SessionMapper) {
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	session := NewTestSession(1, 1, time.Hour)
+	if _, err := sessionMapper.AddContext(canceledCtx, session); !errors.Is(err, context.Canceled) {
+		t.Errorf("Add: want %v error, got %v", context.Canceled, err)
+	}
+	assertSessionNotFound(t, sessionMapper, session.ID)
+
+	addTestSessions(t, sessionMapper, session)
+	if _, err := sessionMapper.FindByIDContext(canceledCtx, session.ID); !errors.Is(err, context.Canceled) {
+		t.Errorf("FindByID: want %v error, got %v", context.Canceled, err)
+	}
+	if _, err := sessionMapper.FindByUserContext(canceledCtx, session.Email); !errors.Is(err, context.Canceled) {
+		t.Errorf("FindByUser: want %v error, got %v", context.Canceled, err)
+	}
+	if _, err := sessionMapper.DeleteContext(canceledCtx, session); !errors.Is(err, context.Canceled) {
+		t.Errorf("Delete: want %v error, got %v", context.Canceled, err)
+	}
+	if _, err := sessionMapper.DeleteByUserContext(canceledCtx, session.Email); !errors.Is(err, context.Canceled) {
+		t.Errorf("DeleteByUser: want %v error, got %v", context.Canceled, err)
+	}
+
+	//nothing has been deleted
+	if _, err := sessionMapper.FindByID(session.ID); err != nil {
+		t.Errorf("want session kept with done context, got %v", err)
+	}
+}
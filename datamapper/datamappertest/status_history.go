@@ -0,0 +1,180 @@
+//Package datamappertest provides conformance test suites that every datamapper implementation should pass
+package datamappertest
+
+import (
+	"testtrx/datamapper"
+	"testtrx/model"
+
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+//StatusHistoryMapperFactory is a function type for creating a status history datamapper backed by an empty storage
+//It is called once per test case of the suite, implementations should register their cleanup with t.Cleanup
+type StatusHistoryMapperFactory func(t *testing.T) datamapper.StatusHistoryMapper
+
+//RunStatusHistoryMapperSuite is a function for running the status history datamapper conformance tests against mappers created by newMapper
+func RunStatusHistoryMapperSuite(t *testing.T, newMapper StatusHistoryMapperFactory) {
+	t.Run("AddAndFindByUser", func(t *testing.T) { testAddAndFindByUser(t, newMapper(t)) })
+	t.Run("HistoryContextDone", func(t *testing.T) { testHistoryContextDone(t, newMapper(t)) })
+}
+
+//UserStatusHistoryMapperFactory is a function type for creating a user datamapper and a status history datamapper sharing an empty storage
+//It is called once per test case of the suite, implementations should register their cleanup with t.Cleanup
+type UserStatusHistoryMapperFactory func(t *testing.T) (datamapper.UserMapper, datamapper.StatusHistoryMapper)
+
+//RunUserStatusHistorySuite is a function for running the conformance tests of the status history kept along with the users
+//against mappers created by newMappers
+func RunUserStatusHistorySuite(t *testing.T, newMappers UserStatusHistoryMapperFactory) {
+	t.Run("HistoryFollowsUser", func(t *testing.T) {
+		userMapper, historyMapper := newMappers(t)
+		testHistoryFollowsUser(t, userMapper, historyMapper)
+	})
+}
+
+//NewTestTransition is a function for creating a status transition of the test user identified by counter for testing, made at
+func NewTestTransition(counter int, from, to string, at time.Time) *model.StatusTransition {
+	userModel := NewTestUser(counter)
+	return &model.StatusTransition{
+		Email:  userModel.Email,
+		Name:   userModel.Name,
+		From:   from,
+		To:     to,
+		Reason: "dummyReason" + from + to,
+		Actor:  "dummyActor",
+		At:     at,
+	}
+}
+
+//AssertTransition is a function for asserting that got is the same status transition as want, at the stored time precision
+func AssertTransition(tb testing.TB, want, got *model.StatusTransition) {
+	tb.Helper()
+	if want.Email != got.Email || want.Name != got.Name {
+		tb.Errorf("want transition of %v %v, got %v %v", want.Email, want.Name, got.Email, got.Name)
+	}
+	if want.From != got.From || want.To != got.To {
+		tb.Errorf("want transition from %v to %v, got from %v to %v", want.From, want.To, got.From, got.To)
+	}
+	if want.Reason != got.Reason || want.Actor != got.Actor {
+		tb.Errorf("want %v reason and %v actor, got %v and %v", want.Reason, want.Actor, got.Reason, got.Actor)
+	}
+	if !want.At.Truncate(100 * time.Nanosecond).Equal(got.At) {
+		tb.Errorf("want %v for time, got %v", want.At, got.At)
+	}
+	if got.At.Location() != time.UTC {
+		tb.Errorf("want time in UTC, got %v", got.At.Location())
+	}
+}
+
+func testAddAndFindByUser(t *testing.T, historyMapper datamapper.StatusHistoryMapper) {
+	now := time.Now()
+	want := []*model.StatusTransition{
+		NewTestTransition(1, model.UserStatusDeleted, model.UserStatusInactive, now),
+		NewTestTransition(1, model.UserStatusInactive, model.UserStatusDeleted, now.Add(-time.Minute)),
+		NewTestTransition(1, model.UserStatusActive, model.UserStatusInactive, now.Add(-time.Hour)),
+	}
+	//transitions are returned latest first whatever the order they are added in
+	for _, i := range []int{1, 2, 0} {
+		if ok, err := historyMapper.Add(want[i]); err != nil || !ok {
+			t.Fatalf("Failed to add transition: %v, %v", ok, err)
+		}
+	}
+	otherModel := NewTestTransition(2, model.UserStatusActive, model.UserStatusDeleted, now)
+	if ok, err := historyMapper.Add(otherModel); err != nil || !ok {
+		t.Fatalf("Failed to add transition: %v, %v", ok, err)
+	}
+
+	got, err := historyMapper.FindByUser(want[0].Email, want[0].Name)
+	if err != nil {
+		t.Fatalf("Failed to find history: %v", err)
+	}
+	if len(want) != len(got) {
+		t.Fatalf("want %v transitions, got %v", len(want), len(got))
+	}
+	for i := range want {
+		AssertTransition(t, want[i], got[i])
+	}
+
+	if got, err := historyMapper.FindByUser(want[0].Email, "otherName"); err != nil || len(got) != 0 {
+		t.Errorf("want no transition for another user, got %v and %v", got, err)
+	}
+}
+
+func testHistoryContextDone(t *testing.T, historyMapper datamapper.StatusHistoryMapper) {
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	transition := NewTestTransition(1, model.UserStatusActive, model.UserStatusInactive, time.Now())
+	if _, err := historyMapper.AddContext(canceledCtx, transition); !errors.Is(err, context.Canceled) {
+		t.Errorf("Add: want %v error, got %v", context.Canceled, err)
+	}
+	if _, err := historyMapper.FindByUserContext(canceledCtx, transition.Email, transition.Name); !errors.Is(err, context.Canceled) {
+		t.Errorf("FindByUser: want %v error, got %v", context.Canceled, err)
+	}
+
+	//nothing has been written
+	if got, err := historyMapper.FindByUser(transition.Email, transition.Name); err != nil || len(got) != 0 {
+		t.Errorf("want no transition added with done context, got %v and %v", got, err)
+	}
+}
+
+func testHistoryFollowsUser(t *testing.T, userMapper datamapper.UserMapper, historyMapper datamapper.StatusHistoryMapper) {
+	userModel := NewTestUser(1)
+	if ok, err := userMapper.Insert(userModel); err != nil || !ok {
+		t.Fatalf("Failed to insert user: %v, %v", ok, err)
+	}
+	now := time.Now()
+	want := []*model.StatusTransition{
+		NewTestTransition(1, model.UserStatusInactive, model.UserStatusActive, now),
+		NewTestTransition(1, model.UserStatusActive, model.UserStatusInactive, now.Add(-time.Hour)),
+	}
+	for _, transition := range want {
+		if ok, err := historyMapper.Add(transition); err != nil || !ok {
+			t.Fatalf("Failed to add transition: %v, %v", ok, err)
+		}
+	}
+	assertHistory := func(step string, email, name string) {
+		t.Helper()
+		got, err := historyMapper.FindByUser(email, name)
+		if err != nil {
+			t.Fatalf("%v: failed to find history: %v", step, err)
+		}
+		if len(want) != len(got) {
+			t.Fatalf("%v: want %v transitions, got %v", step, len(want), len(got))
+		}
+		for i := range want {
+			moved := *want[i]
+			moved.Email, moved.Name = email, name
+			AssertTransition(t, &moved, got[i])
+		}
+	}
+	assertNoHistory := func(step string, email, name string) {
+		t.Helper()
+		if got, err := historyMapper.FindByUser(email, name); err != nil || len(got) != 0 {
+			t.Errorf("%v: want no transition left for %v %v, got %v and %v", step, email, name, got, err)
+		}
+	}
+
+	oldEmail, oldName := userModel.Email, userModel.Name
+	if ok, err := userMapper.Rename(userModel, "renamedName"); err != nil || !ok {
+		t.Fatalf("Failed to rename user: %v, %v", ok, err)
+	}
+	assertHistory("Rename", userModel.Email, "renamedName")
+	assertNoHistory("Rename", oldEmail, oldName)
+
+	if ok, err := userMapper.ChangeEmail(userModel, "changed@testemail.com"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	assertHistory("ChangeEmail", "changed@testemail.com", "renamedName")
+	assertNoHistory("ChangeEmail", oldEmail, "renamedName")
+
+	//a later user with the former email and name doesn't inherit the history
+	otherModel := NewTestUser(2)
+	otherModel.Email, otherModel.Name = oldEmail, oldName
+	if ok, err := userMapper.Insert(otherModel); err != nil || !ok {
+		t.Fatalf("Failed to insert user: %v, %v", ok, err)
+	}
+	assertNoHistory("Insert", oldEmail, oldName)
+}
@@ -0,0 +1,1748 @@
+//Package datamappertest provides conformance test suites that every datamapper implementation should pass
+package datamappertest
+
+import (
+	"testtrx/datamapper"
+	"testtrx/model"
+
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	goerrors "github.com/go-errors/errors"
+)
+
+//UserMapperFactory is a function type for creating a user datamapper backed by an empty storage
+//It is called once per test case of the suite, implementations should register their cleanup with t.Cleanup
+type UserMapperFactory func(t *testing.T) datamapper.UserMapper
+
+//RunUserMapperSuite is a function for running the user datamapper conformance tests against mappers created by newMapper
+func RunUserMapperSuite(t *testing.T, newMapper UserMapperFactory) {
+	t.Run("InsertAndFindByID", func(t *testing.T) { testInsertAndFindByID(t, newMapper(t)) })
+	t.Run("FindByIDNotFound", func(t *testing.T) { testFindByIDNotFound(t, newMapper(t)) })
+	t.Run("TimezoneRoundTrip", func(t *testing.T) { testTimezoneRoundTrip(t, newMapper(t)) })
+	t.Run("InsertAlreadyExists", func(t *testing.T) { testInsertAlreadyExists(t, newMapper(t)) })
+	t.Run("Upsert", func(t *testing.T) { testUpsert(t, newMapper(t)) })
+	t.Run("Update", func(t *testing.T) { testUpdate(t, newMapper(t)) })
+	t.Run("UpdateConflict", func(t *testing.T) { testUpdateConflict(t, newMapper(t)) })
+	t.Run("UpdateNotExisting", func(t *testing.T) { testUpdateNotExisting(t, newMapper(t)) })
+	t.Run("InvalidStatus", func(t *testing.T) { testInvalidStatus(t, newMapper(t)) })
+	t.Run("InvalidUser", func(t *testing.T) { testInvalidUser(t, newMapper(t)) })
+	t.Run("NormalizedEmail", func(t *testing.T) { testNormalizedEmail(t, newMapper(t)) })
+	t.Run("Rename", func(t *testing.T) { testRename(t, newMapper(t)) })
+	t.Run("RenameRejected", func(t *testing.T) { testRenameRejected(t, newMapper(t)) })
+	t.Run("ChangeEmail", func(t *testing.T) { testChangeEmail(t, newMapper(t)) })
+	t.Run("ChangeEmailRejected", func(t *testing.T) { testChangeEmailRejected(t, newMapper(t)) })
+	t.Run("FindFormerEmails", func(t *testing.T) { testFindFormerEmails(t, newMapper(t)) })
+	t.Run("CreatedAt", func(t *testing.T) { testCreatedAt(t, newMapper(t)) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, newMapper(t)) })
+	t.Run("DeleteNotExisting", func(t *testing.T) { testDeleteNotExisting(t, newMapper(t)) })
+	t.Run("SoftDelete", func(t *testing.T) { testSoftDelete(t, newMapper(t)) })
+	t.Run("Restore", func(t *testing.T) { testRestore(t, newMapper(t)) })
+	t.Run("Purge", func(t *testing.T) { testPurge(t, newMapper(t)) })
+	t.Run("FindByAuthToken", func(t *testing.T) { testFindByAuthToken(t, newMapper(t)) })
+	t.Run("FindByProvider", func(t *testing.T) { testFindByProvider(t, newMapper(t)) })
+	t.Run("FindByStatus", func(t *testing.T) { testFindByStatus(t, newMapper(t)) })
+	t.Run("LinkAndUnlink", func(t *testing.T) { testLinkAndUnlink(t, newMapper(t)) })
+	t.Run("LinkRejected", func(t *testing.T) { testLinkRejected(t, newMapper(t)) })
+	t.Run("IdentityTaken", func(t *testing.T) { testIdentityTaken(t, newMapper(t)) })
+	t.Run("ContextDone", func(t *testing.T) { testContextDone(t, newMapper(t)) })
+	t.Run("WithOptions", func(t *testing.T) { testWithOptions(t, newMapper(t)) })
+	for _, tc := range []struct{ records, pageSize int }{
+		{0, 2},
+		{1, 2},
+		{2, 2},
+		{3, 2},
+		{4, 2},
+		{5, 2},
+		{5, 1},
+		{5, 10},
+	} {
+		t.Run("FindAllAndPage/"+strconv.Itoa(tc.records)+"records/pageSize"+strconv.Itoa(tc.pageSize), func(t *testing.T) {
+			testFindAllAndPage(t, newMapper(t), tc.records, tc.pageSize)
+		})
+	}
+	t.Run("InterleavedPaging", func(t *testing.T) { testInterleavedPaging(t, newMapper(t)) })
+	t.Run("BidirectionalPaging", func(t *testing.T) { testBidirectionalPaging(t, newMapper(t)) })
+	t.Run("DeepPaging", func(t *testing.T) { testDeepPaging(t, newMapper(t)) })
+	t.Run("InvalidCursor", func(t *testing.T) { testInvalidCursor(t, newMapper(t)) })
+}
+
+//NewTestUser is a function for creating a user model for testing, identified by counter
+func NewTestUser(counter int) *model.User {
+	return &model.User{
+		Email:        "user" + strconv.Itoa(counter) + "@testemail.com",
+		Password:     "dummyPasswordHash",
+		Name:         strconv.Itoa(counter),
+		Status:       model.UserStatusActive,
+		LastActivity: time.Now(),
+		AuthToken:    "dummyAuthToken" + strconv.Itoa(counter),
+		Identities: map[string]model.Identity{
+			model.ProviderGoogle:   NewTestIdentity(model.ProviderGoogle, counter),
+			model.ProviderFacebook: NewTestIdentity(model.ProviderFacebook, counter),
+		}}
+}
+
+//NewTestIdentity is a function for creating an identity at provider for testing, identified by counter
+func NewTestIdentity(provider string, counter int) model.Identity {
+	return model.Identity{
+		Provider:     provider,
+		Subject:      "dummy" + provider + "Subject" + strconv.Itoa(counter),
+		AccessToken:  "dummy" + provider + "AccessToken" + strconv.Itoa(counter),
+		RefreshToken: "dummy" + provider + "RefreshToken" + strconv.Itoa(counter),
+		ExpiresAt:    time.Now().Add(time.Hour),
+		LinkedAt:     time.Now()}
+}
+
+//AssertUser is a function for asserting that got user has the same field values as want user
+func AssertUser(tb testing.TB, want, got *model.User) {
+	tb.Helper()
+	if got == nil {
+		tb.Fatalf("want user %v, got nil", want.Email)
+	}
+	if want.Email != got.Email {
+		tb.Errorf("want %v for userEmail, got %v", want.Email, got.Email)
+	}
+	if want.Password != got.Password {
+		tb.Errorf("want %v for password, got %v", want.Password, got.Password)
+	}
+	if want.Name != got.Name {
+		tb.Errorf("want %v for name, got %v", want.Name, got.Name)
+	}
+	if want.Status != got.Status {
+		tb.Errorf("want %v for status, got %v", want.Status, got.Status)
+	}
+	//Note: cassandra stores timestamp with millisecond precision, therefore compare up to milliseconds
+	if !want.LastActivity.Truncate(time.Millisecond).Equal(got.LastActivity) {
+		tb.Errorf("want %v for lastActivity, got %v", want.LastActivity, got.LastActivity)
+	}
+	if want.AuthToken != got.AuthToken {
+		tb.Errorf("want %v for authToken, got %v", want.AuthToken, got.AuthToken)
+	}
+	if len(want.Identities) != len(got.Identities) {
+		tb.Errorf("want %v identities, got %v", len(want.Identities), len(got.Identities))
+	}
+	for provider, identity := range want.Identities {
+		AssertIdentity(tb, identity, got.Identities[provider])
+	}
+	if !want.DeletedAt.Truncate(time.Millisecond).Equal(got.DeletedAt) {
+		tb.Errorf("want %v for deletedAt, got %v", want.DeletedAt, got.DeletedAt)
+	}
+	if want.Version != got.Version {
+		tb.Errorf("want %v for version, got %v", want.Version, got.Version)
+	}
+}
+
+//AssertIdentity is a function for asserting that got identity has the same field values as want identity
+func AssertIdentity(tb testing.TB, want, got model.Identity) {
+	tb.Helper()
+	if want.Provider != got.Provider {
+		tb.Errorf("want %v for provider, got %v", want.Provider, got.Provider)
+	}
+	if want.Subject != got.Subject {
+		tb.Errorf("want %v for %v subject, got %v", want.Subject, want.Provider, got.Subject)
+	}
+	if want.AccessToken != got.AccessToken {
+		tb.Errorf("want %v for %v accessToken, got %v", want.AccessToken, want.Provider, got.AccessToken)
+	}
+	if want.RefreshToken != got.RefreshToken {
+		tb.Errorf("want %v for %v refreshToken, got %v", want.RefreshToken, want.Provider, got.RefreshToken)
+	}
+	//Note: cassandra stores timestamp with millisecond precision, therefore compare up to milliseconds
+	if !want.ExpiresAt.Truncate(time.Millisecond).Equal(got.ExpiresAt) {
+		tb.Errorf("want %v for %v expiresAt, got %v", want.ExpiresAt, want.Provider, got.ExpiresAt)
+	}
+	if !want.LinkedAt.Truncate(time.Millisecond).Equal(got.LinkedAt) {
+		tb.Errorf("want %v for %v linkedAt, got %v", want.LinkedAt, want.Provider, got.LinkedAt)
+	}
+}
+
+//mustInsert is a function for inserting user, failing the test if the insert fails
+func mustInsert(tb testing.TB, userMapper datamapper.UserMapper, user *model.User) {
+	tb.Helper()
+	if _, err := userMapper.Insert(user); err != nil {
+		tb.Fatalf("Failed to insert user: %v", err)
+	}
+}
+
+func testInsertAndFindByID(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+}
+
+func testFindByIDNotFound(t *testing.T, userMapper datamapper.UserMapper) {
+	mustInsert(t, userMapper, NewTestUser(1))
+
+	foundModel, err := userMapper.FindByID("unknown@testemail.com")
+	if err == nil {
+		t.Fatal("Error expected but got none")
+	}
+	if !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error, got %v", err)
+	}
+	var mapperErr *datamapper.Error
+	if !errors.As(err, &mapperErr) || mapperErr.Kind != datamapper.ErrNotFound {
+		t.Errorf("want datamapper error of not found kind, got %v", err)
+	}
+	if foundModel != nil {
+		t.Errorf("want nil model, got %v", foundModel)
+	}
+}
+
+func testTimezoneRoundTrip(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	userModel.LastActivity = time.Date(2018, time.March, 4, 23, 30, 15, 123456789, time.FixedZone("UTC+7", 7*60*60))
+	mustInsert(t, userMapper, userModel)
+
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	//time is always loaded as UTC regardless of the timezone it was saved with
+	if time.UTC != foundModel.LastActivity.Location() {
+		t.Errorf("want %v for lastActivity location, got %v", time.UTC, foundModel.LastActivity.Location())
+	}
+	want := time.Date(2018, time.March, 4, 16, 30, 15, 123000000, time.UTC)
+	if !want.Equal(foundModel.LastActivity) {
+		t.Errorf("want %v for lastActivity, got %v", want, foundModel.LastActivity)
+	}
+}
+
+func testInsertAlreadyExists(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+
+	//inserting a user with an existing primary key must not overwrite the existing user
+	otherModel := *userModel
+	otherModel.Password = "otherPasswordHash"
+	otherModel.AuthToken = "otherAuthToken"
+	ok, err := userMapper.Insert(&otherModel)
+	if ok || !errors.Is(err, datamapper.ErrAlreadyExists) {
+		t.Fatalf("want false and already exists error, got %v and %v", ok, err)
+	}
+	var mapperErr *datamapper.Error
+	if !errors.As(err, &mapperErr) {
+		t.Fatalf("want datamapper error, got %v", err)
+	}
+	currentModel, isUser := mapperErr.Current.(*model.User)
+	if !isUser {
+		t.Fatalf("want existing user as current record, got %v", mapperErr.Current)
+	}
+	AssertUser(t, userModel, currentModel)
+
+	//nor store a second user with the same email and another name
+	otherNameModel := NewTestUser(2)
+	otherNameModel.Email = userModel.Email
+	if ok, err := userMapper.Insert(otherNameModel); ok || !errors.Is(err, datamapper.ErrAlreadyExists) {
+		t.Errorf("want false and already exists error for another name, got %v and %v", ok, err)
+	} else if errors.As(err, &mapperErr) {
+		if currentModel, isUser := mapperErr.Current.(*model.User); isUser {
+			AssertUser(t, userModel, currentModel)
+		} else {
+			t.Errorf("want existing user as current record, got %v", mapperErr.Current)
+		}
+	}
+
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+
+	//the email is free again once the user is deleted or moved
+	if ok, err := userMapper.Delete(userModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	mustInsert(t, userMapper, otherNameModel)
+	if ok, err := userMapper.ChangeEmail(otherNameModel, "changed@testemail.com"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	mustInsert(t, userMapper, NewTestUser(1))
+}
+
+func testUpsert(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	if ok, err := userMapper.Upsert(userModel); err != nil || !ok {
+		t.Fatalf("Failed to upsert user: %v, %v", ok, err)
+	}
+
+	if 1 != userModel.Version {
+		t.Errorf("want %v for version, got %v", 1, userModel.Version)
+	}
+
+	//upserting a user with an existing primary key overwrites the existing user
+	userModel.Password = "otherPasswordHash"
+	if ok, err := userMapper.Upsert(userModel); err != nil || !ok {
+		t.Fatalf("Failed to upsert user: %v, %v", ok, err)
+	}
+	userModel.Status = model.UserStatusInactive
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+
+	//the version follows the stored one whatever the version of the upserted user, so that it never goes back
+	freshModel := NewTestUser(1)
+	freshModel.Status = model.UserStatusInactive
+	if ok, err := userMapper.Upsert(freshModel); err != nil || !ok {
+		t.Fatalf("Failed to upsert user: %v, %v", ok, err)
+	}
+	if 4 != freshModel.Version {
+		t.Errorf("want %v for version, got %v", 4, freshModel.Version)
+	}
+	staleModel := *userModel
+	if ok, err := userMapper.Update(&staleModel); ok || !errors.Is(err, datamapper.ErrConflict) {
+		t.Errorf("want false and conflict error for stale version, got %v and %v", ok, err)
+	}
+	userModel = freshModel
+
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+
+	//a user with the same email and another name is not stored
+	otherNameModel := NewTestUser(2)
+	otherNameModel.Email = userModel.Email
+	if ok, err := userMapper.Upsert(otherNameModel); ok || !errors.Is(err, datamapper.ErrAlreadyExists) {
+		t.Errorf("want false and already exists error for another name, got %v and %v", ok, err)
+	}
+	if _, err := userMapper.FindByProvider(model.ProviderGoogle, otherNameModel.Identities[model.ProviderGoogle].Subject); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for the identity of the rejected user, got %v", err)
+	}
+}
+
+func testUpdate(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+
+	userModel.Status = model.UserStatusInactive
+	userModel.AuthToken = "updatedDummyAuthToken"
+	userModel.LastActivity = userModel.LastActivity.Add(time.Hour)
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	if 2 != userModel.Version {
+		t.Errorf("want %v for version after update, got %v", 2, userModel.Version)
+	}
+
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+}
+
+func testUpdateConflict(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	if 1 != userModel.Version {
+		t.Errorf("want %v for version after insert, got %v", 1, userModel.Version)
+	}
+
+	//two concurrent editors load the same version of the user
+	firstModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	secondModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+
+	firstModel.Status = model.UserStatusInactive
+	if ok, err := userMapper.Update(firstModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+
+	//the second editor's update is based on a stale version and must not clobber the first one
+	secondModel.AuthToken = "secondAuthToken"
+	ok, err := userMapper.Update(secondModel)
+	if ok || !errors.Is(err, datamapper.ErrConflict) {
+		t.Fatalf("want false and conflict error, got %v and %v", ok, err)
+	}
+	if 1 != secondModel.Version {
+		t.Errorf("want version %v to be left untouched after conflict, got %v", 1, secondModel.Version)
+	}
+	var mapperErr *datamapper.Error
+	if !errors.As(err, &mapperErr) {
+		t.Fatalf("want datamapper error, got %v", err)
+	}
+	currentModel, isUser := mapperErr.Current.(*model.User)
+	if !isUser {
+		t.Fatalf("want latest user as current record, got %v", mapperErr.Current)
+	}
+	AssertUser(t, firstModel, currentModel)
+
+	//the second editor can retry on top of the latest user
+	currentModel.AuthToken = "secondAuthToken"
+	if ok, err := userMapper.Update(currentModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, currentModel, foundModel)
+	if model.UserStatusInactive != foundModel.Status || 3 != foundModel.Version {
+		t.Errorf("want %v for status and %v for version, got %v and %v", model.UserStatusInactive, 3, foundModel.Status, foundModel.Version)
+	}
+}
+
+func testUpdateNotExisting(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	ok, err := userMapper.Update(userModel)
+	if ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error, got %v and %v", ok, err)
+	}
+
+	//updating a non existing user must not create it
+	if _, err := userMapper.FindByID(userModel.Email); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error, got %v", err)
+	}
+}
+
+func testInvalidStatus(t *testing.T, userMapper datamapper.UserMapper) {
+	//unknown statuses are not stored
+	unknownModel := NewTestUser(2)
+	unknownModel.Status = "X"
+	if ok, err := userMapper.Insert(unknownModel); ok || !errors.Is(err, datamapper.ErrInvalidInput) || !errors.Is(err, model.ErrValidation) {
+		t.Errorf("want false and invalid input error for unknown status, got %v and %v", ok, err)
+	}
+	if ok, err := userMapper.Upsert(unknownModel); ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want false and invalid input error for unknown status, got %v and %v", ok, err)
+	}
+	if _, err := userMapper.FindByID(unknownModel.Email); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error, got %v", err)
+	}
+
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	userModel.Status = "X"
+	if ok, err := userMapper.Update(userModel); ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want false and invalid input error for unknown status, got %v and %v", ok, err)
+	}
+	userModel.Status = model.UserStatusDeleted
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+
+	//a deleted user can't be made active again in one step
+	userModel.Status = model.UserStatusActive
+	if ok, err := userMapper.Update(userModel); ok || !errors.Is(err, datamapper.ErrInvalidInput) || !errors.Is(err, model.ErrInvalidTransition) {
+		t.Errorf("want false and invalid input error for illegal transition, got %v and %v", ok, err)
+	}
+	if 2 != userModel.Version {
+		t.Errorf("want version %v to be left untouched after illegal transition, got %v", 2, userModel.Version)
+	}
+	if ok, err := userMapper.Upsert(userModel); ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want false and invalid input error for illegal transition, got %v and %v", ok, err)
+	}
+	includingMapper := userMapper.With(datamapper.WithIncludeDeleted(true))
+	if foundModel := mustFind(t, includingMapper, userModel.Email); model.UserStatusDeleted != foundModel.Status {
+		t.Errorf("want %v for status, got %v", model.UserStatusDeleted, foundModel.Status)
+	}
+	userModel.Status = model.UserStatusInactive
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	AssertUser(t, userModel, mustFind(t, userMapper, userModel.Email))
+}
+
+func testInvalidUser(t *testing.T, userMapper datamapper.UserMapper) {
+	invalidModel := NewTestUser(1)
+	invalidModel.Email = "not an email"
+	invalidModel.Name = ""
+	invalidModel.LastActivity = time.Time{}
+	ok, err := userMapper.Insert(invalidModel)
+	if ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Fatalf("want false and invalid input error for invalid user, got %v and %v", ok, err)
+	}
+	var fieldErrs model.FieldErrors
+	if !errors.As(err, &fieldErrs) {
+		t.Fatalf("want field errors, got %v", err)
+	}
+	want := []struct{ field, code string }{
+		{"Email", model.FieldMalformed},
+		{"Name", model.FieldRequired},
+		{"LastActivity", model.FieldRequired},
+	}
+	if len(want) != len(fieldErrs) {
+		t.Fatalf("want %v field errors, got %v", len(want), fieldErrs)
+	}
+	for i := range want {
+		if want[i].field != fieldErrs[i].Field || want[i].code != fieldErrs[i].Code {
+			t.Errorf("want %v error for %v, got %v for %v", want[i].code, want[i].field, fieldErrs[i].Code, fieldErrs[i].Field)
+		}
+	}
+
+	//invalid changes of a valid user are not written either
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	changedModel := *userModel
+	changedModel.Identities = map[string]model.Identity{"github": {Provider: "github"}}
+	if ok, err := userMapper.Update(&changedModel); ok || !errors.Is(err, model.ErrValidation) {
+		t.Errorf("want false and validation error for identity without subject, got %v and %v", ok, err)
+	}
+	if ok, err := userMapper.Upsert(&changedModel); ok || !errors.Is(err, model.ErrValidation) {
+		t.Errorf("want false and validation error for identity without subject, got %v and %v", ok, err)
+	}
+	if ok, err := userMapper.ChangeEmail(userModel, "changed@"); ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want false and invalid input error for malformed email, got %v and %v", ok, err)
+	}
+	AssertUser(t, userModel, mustFind(t, userMapper, userModel.Email))
+}
+
+func testNormalizedEmail(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	userModel.Email = " User1@Bücher.Example "
+	mustInsert(t, userMapper, userModel)
+	//the local part is kept, the domain is converted to lower case ASCII
+	if "User1@xn--bcher-kva.example" != userModel.Email {
+		t.Errorf("want %v for email, got %v", "User1@xn--bcher-kva.example", userModel.Email)
+	}
+	for _, email := range []string{"User1@xn--bcher-kva.example", "User1@BÜCHER.example", " User1@bücher.example"} {
+		foundModel, err := userMapper.FindByID(email)
+		if err != nil {
+			t.Errorf("Failed to find by id %q: %v", email, err)
+			continue
+		}
+		AssertUser(t, userModel, foundModel)
+	}
+	if _, err := userMapper.FindByID("user1@xn--bcher-kva.example"); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for another local part, got %v", err)
+	}
+
+	//the same user with another form of its email is the same user
+	if ok, err := userMapper.Insert(&model.User{Email: "User1@BüCHER.example", Name: userModel.Name, Status: model.UserStatusActive,
+		LastActivity: userModel.LastActivity}); ok || !errors.Is(err, datamapper.ErrAlreadyExists) {
+		t.Errorf("want false and already exists error, got %v and %v", ok, err)
+	}
+	if ok, err := userMapper.ChangeEmail(userModel, "Changed@TestEmail.COM"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	if "Changed@testemail.com" != userModel.Email {
+		t.Errorf("want %v for email, got %v", "Changed@testemail.com", userModel.Email)
+	}
+	AssertUser(t, userModel, mustFind(t, userMapper, "Changed@TESTEMAIL.com"))
+}
+
+func testDelete(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	otherModel := NewTestUser(2)
+	mustInsert(t, userMapper, userModel)
+	mustInsert(t, userMapper, otherModel)
+
+	if ok, err := userMapper.Delete(userModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+
+	if _, err := userMapper.FindByID(userModel.Email); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error, got %v", err)
+	}
+	//other users are left untouched
+	foundModel, err := userMapper.FindByID(otherModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, otherModel, foundModel)
+}
+
+//findAllPages is a function for finding all users by following page cursors from the first page until the last one
+func findAllPages(tb testing.TB, userMapper datamapper.UserMapper, pageSize int) []*model.User {
+	tb.Helper()
+	page, err := userMapper.FindAll()
+	if err != nil {
+		tb.Fatalf("findAll call failed: %v", err)
+	}
+	allModelSlice := page.Items
+	//Note: the last page may be empty, depending on whether the backend knows that there are no more records
+	for pages := 1; page.NextCursor != ""; pages++ {
+		if pages > len(allModelSlice)+1 {
+			tb.Fatalf("findPage did not reach the last page after %v calls", pages)
+		}
+		if len(page.Items) > pageSize {
+			tb.Fatalf("Returned slice length %v is more than page size %v", len(page.Items), pageSize)
+		}
+		page, err = userMapper.FindPage(page.NextCursor)
+		if err != nil {
+			tb.Fatalf("findPage call failed: %v", err)
+		}
+		allModelSlice = append(allModelSlice, page.Items...)
+	}
+	if len(page.Items) > pageSize {
+		tb.Fatalf("Returned slice length %v is more than page size %v", len(page.Items), pageSize)
+	}
+	return allModelSlice
+}
+
+//assertSameUsers is a function for asserting that got contains exactly the users of want (in any order)
+func assertSameUsers(tb testing.TB, want map[string]*model.User, got []*model.User) {
+	tb.Helper()
+	if len(got) != len(want) {
+		tb.Errorf("want %v users, got %v", len(want), len(got))
+	}
+	seen := map[string]bool{}
+	for _, foundModel := range got {
+		userModel, ok := want[foundModel.Email]
+		if !ok || seen[foundModel.Email] {
+			tb.Errorf("Got unexpected or duplicate user %v", foundModel.Email)
+			continue
+		}
+		seen[foundModel.Email] = true
+		AssertUser(tb, userModel, foundModel)
+	}
+}
+
+//insertTestUsers is a function for inserting n test users, returning them keyed by email
+func insertTestUsers(tb testing.TB, userMapper datamapper.UserMapper, n int) map[string]*model.User {
+	tb.Helper()
+	insertedModels := map[string]*model.User{}
+	for i := 1; i <= n; i++ {
+		userModel := NewTestUser(i)
+		mustInsert(tb, userMapper, userModel)
+		insertedModels[userModel.Email] = userModel
+	}
+	return insertedModels
+}
+
+func testRename(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+
+	if ok, err := userMapper.Rename(userModel, "renamed"); err != nil || !ok {
+		t.Fatalf("Failed to rename user: %v, %v", ok, err)
+	}
+	if "renamed" != userModel.Name || 2 != userModel.Version {
+		t.Errorf("want %v for name and %v for version after rename, got %v and %v", "renamed", 2, userModel.Name, userModel.Version)
+	}
+
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+
+	//the user can still be updated and deleted under its new name, and no row is left under the old name
+	foundModel.Status = model.UserStatusInactive
+	if ok, err := userMapper.Update(foundModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	oldNameModel := *foundModel
+	oldNameModel.Name = "1"
+	if ok, err := userMapper.Delete(&oldNameModel); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error for old name, got %v and %v", ok, err)
+	}
+	if ok, err := userMapper.Delete(foundModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	if _, err := userMapper.FindByID(userModel.Email); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error, got %v", err)
+	}
+}
+
+func testCreatedAt(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	createdAt := userModel.CreatedAt
+	if createdAt.IsZero() {
+		t.Fatalf("want creation time set on insert, got zero")
+	}
+	assertCreatedAt := func(step string) {
+		t.Helper()
+		foundModel, err := userMapper.FindByID(userModel.Email)
+		if err != nil {
+			t.Fatalf("%v: failed to find by id: %v", step, err)
+		}
+		if !createdAt.Equal(foundModel.CreatedAt) {
+			t.Errorf("%v: want %v for createdAt, got %v", step, createdAt, foundModel.CreatedAt)
+		}
+	}
+	assertCreatedAt("Insert")
+
+	//the creation time is kept whatever the one of the written user
+	userModel.CreatedAt = time.Time{}
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	assertCreatedAt("Update")
+	if ok, err := userMapper.Upsert(userModel); err != nil || !ok || !createdAt.Equal(userModel.CreatedAt) {
+		t.Fatalf("Failed to upsert user: %v, %v (createdAt %v)", ok, err, userModel.CreatedAt)
+	}
+	assertCreatedAt("Upsert")
+	userModel.CreatedAt = time.Time{}
+	if ok, err := userMapper.Rename(userModel, "renamed"); err != nil || !ok || !createdAt.Equal(userModel.CreatedAt) {
+		t.Fatalf("Failed to rename user: %v, %v (createdAt %v)", ok, err, userModel.CreatedAt)
+	}
+	assertCreatedAt("Rename")
+	userModel.CreatedAt = time.Time{}
+	if ok, err := userMapper.ChangeEmail(userModel, "changed@testemail.com"); err != nil || !ok || !createdAt.Equal(userModel.CreatedAt) {
+		t.Fatalf("Failed to change email: %v, %v (createdAt %v)", ok, err, userModel.CreatedAt)
+	}
+	assertCreatedAt("ChangeEmail")
+
+	//a user inserted again gets a new creation time, even if the inserted user has one
+	if ok, err := userMapper.Delete(userModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	mustInsert(t, userMapper, userModel)
+	if !userModel.CreatedAt.After(createdAt) {
+		t.Errorf("want creation time after %v for a user inserted again, got %v", createdAt, userModel.CreatedAt)
+	}
+}
+
+func testRenameRejected(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+
+	//renaming to the current name or to an empty name is invalid
+	if ok, err := userMapper.Rename(userModel, userModel.Name); ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want false and invalid input error, got %v and %v", ok, err)
+	}
+	if ok, err := userMapper.Rename(userModel, ""); ok || !errors.Is(err, datamapper.ErrInvalidInput) || !errors.Is(err, model.ErrValidation) {
+		t.Errorf("want false and invalid input error for empty name, got %v and %v", ok, err)
+	}
+	if "1" != userModel.Name || 1 != userModel.Version {
+		t.Errorf("want name %v and version %v to be left untouched, got %v and %v", "1", 1, userModel.Name, userModel.Version)
+	}
+
+	//renaming a stale version
+	staleModel := *userModel
+	userModel.Status = model.UserStatusInactive
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	if ok, err := userMapper.Rename(&staleModel, "renamed"); ok || !errors.Is(err, datamapper.ErrConflict) {
+		t.Errorf("want false and conflict error, got %v and %v", ok, err)
+	}
+	if "1" != staleModel.Name {
+		t.Errorf("want name %v to be left untouched, got %v", "1", staleModel.Name)
+	}
+
+	//renaming a non existing user
+	otherModel := NewTestUser(2)
+	if ok, err := userMapper.Rename(otherModel, "renamed"); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error, got %v and %v", ok, err)
+	}
+
+	//the rejected renames left the stored users untouched
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+}
+
+func testChangeEmail(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	oldEmail := userModel.Email
+
+	if ok, err := userMapper.ChangeEmail(userModel, "changed@testemail.com"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	if "changed@testemail.com" != userModel.Email || 2 != userModel.Version {
+		t.Errorf("want %v for email and %v for version after change, got %v and %v", "changed@testemail.com", 2, userModel.Email, userModel.Version)
+	}
+
+	foundModel, err := userMapper.FindByID("changed@testemail.com")
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+
+	//the old email resolves to the user under its new email
+	foundModel, err = userMapper.FindByID(oldEmail)
+	if err != nil {
+		t.Fatalf("Failed to find by old id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+
+	//no row is left under the old email
+	oldModel := *userModel
+	oldModel.Email = oldEmail
+	if ok, err := userMapper.Delete(&oldModel); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error for old email, got %v and %v", ok, err)
+	}
+
+	//redirects are followed across successive changes
+	if ok, err := userMapper.ChangeEmail(userModel, "changedAgain@testemail.com"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	for _, email := range []string{oldEmail, "changed@testemail.com", "changedAgain@testemail.com"} {
+		foundModel, err = userMapper.FindByID(email)
+		if err != nil {
+			t.Fatalf("Failed to find by id %v: %v", email, err)
+		}
+		AssertUser(t, userModel, foundModel)
+	}
+
+	//changing back to the original email, the original email is not redirected anymore
+	if ok, err := userMapper.ChangeEmail(userModel, oldEmail); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	for _, email := range []string{oldEmail, "changed@testemail.com", "changedAgain@testemail.com"} {
+		foundModel, err = userMapper.FindByID(email)
+		if err != nil {
+			t.Fatalf("Failed to find by id %v: %v", email, err)
+		}
+		AssertUser(t, userModel, foundModel)
+	}
+
+	//once the user is deleted, its redirects don't resolve anymore
+	if ok, err := userMapper.Delete(userModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	if _, err := userMapper.FindByID("changed@testemail.com"); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error, got %v", err)
+	}
+}
+
+func testChangeEmailRejected(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	takenModel := NewTestUser(2)
+	takenModel.Name = "otherName"
+	mustInsert(t, userMapper, takenModel)
+
+	//changing to the current email is invalid
+	if ok, err := userMapper.ChangeEmail(userModel, userModel.Email); ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want false and invalid input error, got %v and %v", ok, err)
+	}
+
+	//changing to an email used by another user (even with another name)
+	ok, err := userMapper.ChangeEmail(userModel, takenModel.Email)
+	if ok || !errors.Is(err, datamapper.ErrAlreadyExists) {
+		t.Errorf("want false and already exists error, got %v and %v", ok, err)
+	}
+	var mapperErr *datamapper.Error
+	if errors.As(err, &mapperErr) {
+		if currentModel, isUser := mapperErr.Current.(*model.User); isUser {
+			AssertUser(t, takenModel, currentModel)
+		} else {
+			t.Errorf("want existing user as current record, got %v", mapperErr.Current)
+		}
+	}
+
+	//changing a stale version
+	staleModel := *userModel
+	userModel.Status = model.UserStatusInactive
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	if ok, err := userMapper.ChangeEmail(&staleModel, "changed@testemail.com"); ok || !errors.Is(err, datamapper.ErrConflict) {
+		t.Errorf("want false and conflict error, got %v and %v", ok, err)
+	}
+	if userModel.Email != staleModel.Email {
+		t.Errorf("want email %v to be left untouched, got %v", userModel.Email, staleModel.Email)
+	}
+	//the rejected change was reverted: the new email is still free and the user still has its email
+	if _, err := userMapper.FindByID("changed@testemail.com"); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for rejected new email, got %v", err)
+	}
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+
+	//changing a non existing user
+	otherModel := NewTestUser(3)
+	if ok, err := userMapper.ChangeEmail(otherModel, "changed@testemail.com"); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error, got %v and %v", ok, err)
+	}
+	if _, err := userMapper.FindByID("changed@testemail.com"); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for rejected new email, got %v", err)
+	}
+}
+
+func testFindFormerEmails(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	mustInsert(t, userMapper, NewTestUser(2))
+	oldEmail := userModel.Email
+
+	assertFormerEmails := func(email string, want ...string) {
+		t.Helper()
+		formerEmails, err := userMapper.FindFormerEmails(email)
+		if err != nil {
+			t.Fatalf("Failed to find former emails of %v: %v", email, err)
+		}
+		if strings.Join(want, ",") != strings.Join(formerEmails, ",") {
+			t.Errorf("want %v for former emails of %v, got %v", want, email, formerEmails)
+		}
+	}
+	assertFormerEmails(oldEmail)
+
+	//former emails are found across successive changes, the most recent first
+	for _, email := range []string{"changed@testemail.com", "changedagain@testemail.com"} {
+		if ok, err := userMapper.ChangeEmail(userModel, email); err != nil || !ok {
+			t.Fatalf("Failed to change email: %v, %v", ok, err)
+		}
+	}
+	assertFormerEmails("changedagain@testemail.com", "changed@testemail.com", oldEmail)
+	assertFormerEmails("changed@testemail.com", oldEmail)
+	assertFormerEmails(NewTestUser(2).Email)
+
+	//an email another user has again is not a former email anymore
+	otherModel := NewTestUser(3)
+	otherModel.Email = oldEmail
+	mustInsert(t, userMapper, otherModel)
+	assertFormerEmails("changedagain@testemail.com", "changed@testemail.com")
+
+	//nor is an email the user got back
+	if ok, err := userMapper.ChangeEmail(userModel, "changed@testemail.com"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	assertFormerEmails("changed@testemail.com", "changedagain@testemail.com")
+	assertFormerEmails("changedagain@testemail.com")
+}
+
+func testDeleteNotExisting(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+
+	//the user is addressed by both its email and name
+	otherNameModel := *userModel
+	otherNameModel.Name = "otherName"
+	ok, err := userMapper.Delete(&otherNameModel)
+	if ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error, got %v and %v", ok, err)
+	}
+
+	if ok, err := userMapper.Delete(userModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	//deleting the user again reports it doesn't exist anymore
+	ok, err = userMapper.Delete(userModel)
+	if ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error, got %v and %v", ok, err)
+	}
+}
+
+func testFindByAuthToken(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	mustInsert(t, userMapper, NewTestUser(2))
+
+	assertFoundByAuthToken := func(token string, want *model.User) {
+		t.Helper()
+		foundModel, err := userMapper.FindByAuthToken(token)
+		if err != nil {
+			t.Fatalf("Failed to find by auth token %v: %v", token, err)
+		}
+		AssertUser(t, want, foundModel)
+	}
+	assertNotFoundByAuthToken := func(token string) {
+		t.Helper()
+		if foundModel, err := userMapper.FindByAuthToken(token); !errors.Is(err, datamapper.ErrNotFound) {
+			t.Errorf("want not found error for auth token %v, got %v and %v", token, foundModel, err)
+		}
+	}
+	assertFoundByAuthToken(userModel.AuthToken, userModel)
+	assertNotFoundByAuthToken("unknownAuthToken")
+	if _, err := userMapper.FindByAuthToken(""); !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want invalid input error for empty auth token, got %v", err)
+	}
+
+	//the lookup follows token changes
+	oldToken := userModel.AuthToken
+	userModel.AuthToken = "changedAuthToken"
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	assertFoundByAuthToken("changedAuthToken", userModel)
+	assertNotFoundByAuthToken(oldToken)
+
+	userModel.AuthToken = "upsertedAuthToken"
+	if ok, err := userMapper.Upsert(userModel); err != nil || !ok {
+		t.Fatalf("Failed to upsert user: %v, %v", ok, err)
+	}
+	assertFoundByAuthToken("upsertedAuthToken", userModel)
+	assertNotFoundByAuthToken("changedAuthToken")
+
+	//and primary key changes
+	if ok, err := userMapper.Rename(userModel, "renamed"); err != nil || !ok {
+		t.Fatalf("Failed to rename user: %v, %v", ok, err)
+	}
+	assertFoundByAuthToken(userModel.AuthToken, userModel)
+	if ok, err := userMapper.ChangeEmail(userModel, "changed@testemail.com"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	assertFoundByAuthToken(userModel.AuthToken, userModel)
+
+	//a user without token can't be found by token
+	userModel.AuthToken = ""
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	assertNotFoundByAuthToken("upsertedAuthToken")
+
+	otherModel := NewTestUser(2)
+	otherModel.Version = 1
+	if ok, err := userMapper.Delete(otherModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	assertNotFoundByAuthToken(otherModel.AuthToken)
+}
+
+func testFindByProvider(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	mustInsert(t, userMapper, NewTestUser(2))
+
+	assertFoundByProvider := func(provider, subject string, want *model.User) {
+		t.Helper()
+		foundModel, err := userMapper.FindByProvider(provider, subject)
+		if err != nil {
+			t.Fatalf("Failed to find by provider %v subject %v: %v", provider, subject, err)
+		}
+		AssertUser(t, want, foundModel)
+	}
+	assertNotFoundByProvider := func(provider, subject string) {
+		t.Helper()
+		if foundModel, err := userMapper.FindByProvider(provider, subject); !errors.Is(err, datamapper.ErrNotFound) {
+			t.Errorf("want not found error for provider %v subject %v, got %v and %v", provider, subject, foundModel, err)
+		}
+	}
+	googleSubject := userModel.Identities[model.ProviderGoogle].Subject
+	assertFoundByProvider(model.ProviderGoogle, googleSubject, userModel)
+	assertFoundByProvider(model.ProviderFacebook, userModel.Identities[model.ProviderFacebook].Subject, userModel)
+	//subjects are scoped by provider
+	assertNotFoundByProvider(model.ProviderFacebook, googleSubject)
+	assertNotFoundByProvider("unknownProvider", googleSubject)
+	if _, err := userMapper.FindByProvider(model.ProviderGoogle, ""); !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want invalid input error for empty subject, got %v", err)
+	}
+
+	//the lookup follows identity changes
+	changedIdentity := userModel.Identities[model.ProviderGoogle]
+	changedIdentity.Subject = "changedGoogleSubject"
+	userModel.Identities = map[string]model.Identity{model.ProviderGoogle: changedIdentity}
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	assertFoundByProvider(model.ProviderGoogle, "changedGoogleSubject", userModel)
+	assertNotFoundByProvider(model.ProviderGoogle, googleSubject)
+	assertNotFoundByProvider(model.ProviderFacebook, NewTestIdentity(model.ProviderFacebook, 1).Subject)
+
+	//and primary key changes
+	if ok, err := userMapper.Rename(userModel, "renamed"); err != nil || !ok {
+		t.Fatalf("Failed to rename user: %v, %v", ok, err)
+	}
+	assertFoundByProvider(model.ProviderGoogle, "changedGoogleSubject", userModel)
+	if ok, err := userMapper.ChangeEmail(userModel, "changed@testemail.com"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	assertFoundByProvider(model.ProviderGoogle, "changedGoogleSubject", userModel)
+
+	if ok, err := userMapper.Delete(userModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	assertNotFoundByProvider(model.ProviderGoogle, "changedGoogleSubject")
+	//other users are unaffected
+	assertFoundByProvider(model.ProviderGoogle, NewTestIdentity(model.ProviderGoogle, 2).Subject, mustFind(t, userMapper, NewTestUser(2).Email))
+}
+
+func testSoftDelete(t *testing.T, userMapper datamapper.UserMapper) {
+	insertedModels := insertTestUsers(t, userMapper, 3)
+	userModel := insertedModels[NewTestUser(1).Email]
+	softMapper := userMapper.With(datamapper.WithSoftDelete(true))
+	includingMapper := userMapper.With(datamapper.WithIncludeDeleted(true))
+
+	ok, err := softMapper.Delete(userModel)
+	if err != nil || !ok {
+		t.Fatalf("Failed to soft delete user: %v, %v", ok, err)
+	}
+	if model.UserStatusDeleted != userModel.Status || userModel.DeletedAt.IsZero() || 2 != userModel.Version {
+		t.Errorf("want %v status, deletedAt and version %v after soft delete, got %v, %v and %v",
+			model.UserStatusDeleted, 2, userModel.Status, userModel.DeletedAt, userModel.Version)
+	}
+
+	//deleted users are left out by default
+	if _, err := userMapper.FindByID(userModel.Email); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for deleted user, got %v", err)
+	}
+	if _, err := userMapper.FindByAuthToken(userModel.AuthToken); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for deleted user auth token, got %v", err)
+	}
+	if _, err := userMapper.FindByProvider(model.ProviderGoogle, userModel.Identities[model.ProviderGoogle].Subject); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for deleted user identity, got %v", err)
+	}
+	delete(insertedModels, userModel.Email)
+	assertSameUsers(t, insertedModels, findAllPages(t, userMapper, 10))
+
+	//unless asked for
+	AssertUser(t, userModel, mustFind(t, includingMapper, userModel.Email))
+	if foundModel, err := includingMapper.FindByAuthToken(userModel.AuthToken); err != nil {
+		t.Errorf("Failed to find deleted user by auth token: %v", err)
+	} else {
+		AssertUser(t, userModel, foundModel)
+	}
+	insertedModels[userModel.Email] = userModel
+	assertSameUsers(t, insertedModels, findAllPages(t, includingMapper, 10))
+	assertSameUsers(t, map[string]*model.User{userModel.Email: userModel}, findStatusPages(t, userMapper, model.UserStatusDeleted, 10))
+
+	if ok, err := softMapper.Delete(userModel); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error for deleting a deleted user, got %v and %v", ok, err)
+	}
+	if ok, err := softMapper.Delete(NewTestUser(4)); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error for deleting a missing user, got %v and %v", ok, err)
+	}
+	//a hard delete removes a deleted user
+	if ok, err := userMapper.Delete(userModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	if _, err := includingMapper.FindByID(userModel.Email); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for removed user, got %v", err)
+	}
+}
+
+func testRestore(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	softMapper := userMapper.With(datamapper.WithSoftDelete(true))
+
+	if ok, err := userMapper.Restore(userModel); ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want false and invalid input error for restoring a user not deleted, got %v and %v", ok, err)
+	}
+	userModel.Status = model.UserStatusInactive
+	if ok, err := softMapper.Delete(userModel); err != nil || !ok {
+		t.Fatalf("Failed to soft delete user: %v, %v", ok, err)
+	}
+	staleModel := *userModel
+	staleModel.Version--
+	if ok, err := userMapper.Restore(&staleModel); ok || !errors.Is(err, datamapper.ErrConflict) {
+		t.Errorf("want false and conflict error for stale restore, got %v and %v", ok, err)
+	}
+
+	ok, err := userMapper.Restore(userModel)
+	if err != nil || !ok {
+		t.Fatalf("Failed to restore user: %v, %v", ok, err)
+	}
+	//restored users are inactive until reactivated
+	if model.UserStatusInactive != userModel.Status || !userModel.DeletedAt.IsZero() || 3 != userModel.Version {
+		t.Errorf("want %v status, no deletedAt and version %v after restore, got %v, %v and %v",
+			model.UserStatusInactive, 3, userModel.Status, userModel.DeletedAt, userModel.Version)
+	}
+	AssertUser(t, userModel, mustFind(t, userMapper, userModel.Email))
+	if _, err := userMapper.FindByAuthToken(userModel.AuthToken); err != nil {
+		t.Errorf("Failed to find restored user by auth token: %v", err)
+	}
+	assertSameUsers(t, map[string]*model.User{userModel.Email: userModel}, findStatusPages(t, userMapper, model.UserStatusInactive, 10))
+	assertSameUsers(t, nil, findStatusPages(t, userMapper, model.UserStatusDeleted, 10))
+
+	if ok, err := userMapper.Restore(NewTestUser(2)); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error for restoring a missing user, got %v and %v", ok, err)
+	}
+}
+
+func testPurge(t *testing.T, userMapper datamapper.UserMapper) {
+	insertedModels := insertTestUsers(t, userMapper, 4)
+	softMapper := userMapper.With(datamapper.WithSoftDelete(true))
+	for i := 1; i <= 2; i++ {
+		if ok, err := softMapper.Delete(insertedModels[NewTestUser(i).Email]); err != nil || !ok {
+			t.Fatalf("Failed to soft delete user: %v, %v", ok, err)
+		}
+	}
+	//a user marked as deleted without deletion time is not purged
+	unknownModel := insertedModels[NewTestUser(3).Email]
+	unknownModel.Status = model.UserStatusDeleted
+	if ok, err := userMapper.Update(unknownModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+
+	//users deleted within the retention window are kept
+	if purged, err := userMapper.Purge(time.Hour); err != nil || purged != 0 {
+		t.Errorf("want no purged user within retention window, got %v and %v", purged, err)
+	}
+	userMapper.SetPageSize(1)
+	if purged, err := userMapper.Purge(0); err != nil || purged != 2 {
+		t.Errorf("want %v purged users, got %v and %v", 2, purged, err)
+	}
+	includingMapper := userMapper.With(datamapper.WithIncludeDeleted(true))
+	for i := 1; i <= 2; i++ {
+		if _, err := includingMapper.FindByID(NewTestUser(i).Email); !errors.Is(err, datamapper.ErrNotFound) {
+			t.Errorf("want not found error for purged user, got %v", err)
+		}
+	}
+	delete(insertedModels, NewTestUser(1).Email)
+	delete(insertedModels, NewTestUser(2).Email)
+	assertSameUsers(t, insertedModels, findAllPages(t, includingMapper, 1))
+	assertSameUsers(t, map[string]*model.User{unknownModel.Email: unknownModel}, findStatusPages(t, userMapper, model.UserStatusDeleted, 1))
+}
+
+func testFindByStatus(t *testing.T, userMapper datamapper.UserMapper) {
+	insertedModels := insertTestUsers(t, userMapper, 7)
+	userMapper.SetPageSize(2)
+
+	inactiveModels := map[string]*model.User{}
+	for i := 1; i <= 3; i++ {
+		userModel := insertedModels[NewTestUser(i).Email]
+		userModel.Status = model.UserStatusInactive
+		if ok, err := userMapper.Update(userModel); err != nil || !ok {
+			t.Fatalf("Failed to update user: %v, %v", ok, err)
+		}
+		inactiveModels[userModel.Email] = userModel
+		delete(insertedModels, userModel.Email)
+	}
+	assertSameUsers(t, inactiveModels, findStatusPages(t, userMapper, model.UserStatusInactive, 2))
+	assertSameUsers(t, insertedModels, findStatusPages(t, userMapper, model.UserStatusActive, 2))
+	assertSameUsers(t, nil, findStatusPages(t, userMapper, model.UserStatusDeleted, 2))
+
+	//the lookup follows status and primary key changes
+	userModel := inactiveModels[NewTestUser(1).Email]
+	userModel.Status = model.UserStatusActive
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	delete(inactiveModels, userModel.Email)
+	renamedModel := inactiveModels[NewTestUser(2).Email]
+	if ok, err := userMapper.Rename(renamedModel, "renamed"); err != nil || !ok {
+		t.Fatalf("Failed to rename user: %v, %v", ok, err)
+	}
+	movedModel := inactiveModels[NewTestUser(3).Email]
+	delete(inactiveModels, movedModel.Email)
+	if ok, err := userMapper.ChangeEmail(movedModel, "changed@testemail.com"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	inactiveModels[movedModel.Email] = movedModel
+	deletedModel := insertedModels[NewTestUser(4).Email]
+	if ok, err := userMapper.Delete(deletedModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	delete(insertedModels, deletedModel.Email)
+	insertedModels[userModel.Email] = userModel
+	assertSameUsers(t, inactiveModels, findStatusPages(t, userMapper, model.UserStatusInactive, 2))
+	assertSameUsers(t, insertedModels, findStatusPages(t, userMapper, model.UserStatusActive, 2))
+
+	if _, err := userMapper.FindByStatus("unknownStatus", ""); !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want invalid input error for unknown status, got %v", err)
+	}
+	if _, err := userMapper.FindByStatus(model.UserStatusActive, "!invalid"); !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want invalid input error for invalid cursor, got %v", err)
+	}
+}
+
+//findStatusPages is a function for finding the users with status by following page cursors until the last page
+func findStatusPages(tb testing.TB, userMapper datamapper.UserMapper, status string, pageSize int) []*model.User {
+	tb.Helper()
+	page, err := userMapper.FindByStatus(status, "")
+	if err != nil {
+		tb.Fatalf("findByStatus call failed: %v", err)
+	}
+	allModelSlice := page.Items
+	//Note: pages may be empty (e.g. when users are spread over partitions), but paging must come to an end
+	for pages := 1; page.NextCursor != ""; pages++ {
+		if pages > 100 {
+			tb.Fatalf("findByStatus did not reach the last page after %v calls", pages)
+		}
+		if len(page.Items) > pageSize {
+			tb.Fatalf("Returned slice length %v is more than page size %v", len(page.Items), pageSize)
+		}
+		page, err = userMapper.FindByStatus(status, page.NextCursor)
+		if err != nil {
+			tb.Fatalf("findByStatus call failed: %v", err)
+		}
+		allModelSlice = append(allModelSlice, page.Items...)
+	}
+	return allModelSlice
+}
+
+func testLinkAndUnlink(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+
+	//an identity at a new provider is linked alongside the existing ones
+	githubIdentity := NewTestIdentity("github", 1)
+	githubIdentity.LinkedAt = time.Time{}
+	ok, err := userMapper.Link(userModel, githubIdentity)
+	if err != nil || !ok {
+		t.Fatalf("Failed to link identity: %v, %v", ok, err)
+	}
+	if userModel.Version != 2 {
+		t.Errorf("want version 2 after link, got %v", userModel.Version)
+	}
+	linkedAt := userModel.Identities["github"].LinkedAt
+	if linkedAt.IsZero() {
+		t.Errorf("want linkedAt set by link, got zero time")
+	}
+	githubIdentity.LinkedAt = linkedAt
+	foundModel := mustFind(t, userMapper, userModel.Email)
+	AssertUser(t, userModel, foundModel)
+	if len(foundModel.Identities) != 3 {
+		t.Errorf("want 3 linked identities, got %v", foundModel.Identities)
+	}
+	if foundModel, err := userMapper.FindByProvider("github", githubIdentity.Subject); err != nil {
+		t.Errorf("Failed to find by linked identity: %v", err)
+	} else {
+		AssertUser(t, userModel, foundModel)
+	}
+
+	//linking at an already linked provider replaces the identity
+	replacedSubject := userModel.Identities[model.ProviderGoogle].Subject
+	googleIdentity := NewTestIdentity(model.ProviderGoogle, 3)
+	if ok, err := userMapper.Link(userModel, googleIdentity); err != nil || !ok {
+		t.Fatalf("Failed to relink identity: %v, %v", ok, err)
+	}
+	AssertUser(t, userModel, mustFind(t, userMapper, userModel.Email))
+	if _, err := userMapper.FindByProvider(model.ProviderGoogle, replacedSubject); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for replaced identity, got %v", err)
+	}
+	if _, err := userMapper.FindByProvider(model.ProviderGoogle, googleIdentity.Subject); err != nil {
+		t.Errorf("Failed to find by relinked identity: %v", err)
+	}
+
+	ok, err = userMapper.Unlink(userModel, "github")
+	if err != nil || !ok {
+		t.Fatalf("Failed to unlink identity: %v, %v", ok, err)
+	}
+	if _, linked := userModel.Identities["github"]; linked {
+		t.Errorf("want github identity removed from user, got %v", userModel.Identities)
+	}
+	AssertUser(t, userModel, mustFind(t, userMapper, userModel.Email))
+	if _, err := userMapper.FindByProvider("github", githubIdentity.Subject); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for unlinked identity, got %v", err)
+	}
+
+	//unlinking the last identity leaves the user without identities
+	for _, provider := range []string{model.ProviderGoogle, model.ProviderFacebook} {
+		if ok, err := userMapper.Unlink(userModel, provider); err != nil || !ok {
+			t.Fatalf("Failed to unlink %v identity: %v, %v", provider, ok, err)
+		}
+	}
+	if foundModel := mustFind(t, userMapper, userModel.Email); len(foundModel.Identities) != 0 {
+		t.Errorf("want no identities, got %v", foundModel.Identities)
+	}
+}
+
+func testLinkRejected(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	otherModel := NewTestUser(2)
+	mustInsert(t, userMapper, userModel)
+	mustInsert(t, userMapper, otherModel)
+
+	//an identity can't be linked to two users
+	ok, err := userMapper.Link(userModel, otherModel.Identities[model.ProviderGoogle])
+	if ok || !errors.Is(err, datamapper.ErrAlreadyExists) {
+		t.Fatalf("want false and already exists error, got %v and %v", ok, err)
+	}
+	var mapperErr *datamapper.Error
+	if errors.As(err, &mapperErr) {
+		if currentModel, isUser := mapperErr.Current.(*model.User); isUser {
+			AssertUser(t, otherModel, currentModel)
+		} else {
+			t.Errorf("want linked user as current record, got %v", mapperErr.Current)
+		}
+	}
+
+	//the version must be current
+	staleModel := *userModel
+	if ok, err := userMapper.Link(userModel, NewTestIdentity("github", 1)); err != nil || !ok {
+		t.Fatalf("Failed to link identity: %v, %v", ok, err)
+	}
+	if ok, err := userMapper.Link(&staleModel, NewTestIdentity("apple", 1)); ok || !errors.Is(err, datamapper.ErrConflict) {
+		t.Errorf("want false and conflict error for stale link, got %v and %v", ok, err)
+	}
+	if ok, err := userMapper.Unlink(&staleModel, "github"); ok || !errors.Is(err, datamapper.ErrConflict) {
+		t.Errorf("want false and conflict error for stale unlink, got %v and %v", ok, err)
+	}
+
+	if ok, err := userMapper.Unlink(userModel, "apple"); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error for unlinked provider, got %v and %v", ok, err)
+	}
+	if ok, err := userMapper.Link(userModel, model.Identity{Provider: "github"}); ok || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want false and invalid input error for empty subject, got %v and %v", ok, err)
+	}
+	missingModel := NewTestUser(3)
+	if ok, err := userMapper.Link(missingModel, NewTestIdentity("github", 3)); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error for missing user, got %v and %v", ok, err)
+	}
+	if ok, err := userMapper.Unlink(missingModel, model.ProviderGoogle); ok || !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want false and not found error for missing user, got %v and %v", ok, err)
+	}
+}
+
+func testIdentityTaken(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+	takenIdentity := userModel.Identities[model.ProviderGoogle]
+
+	//an identity linked to a user can't be written to another user, whatever the write
+	assertTaken := func(write string, ok bool, err error) {
+		t.Helper()
+		if ok || !errors.Is(err, datamapper.ErrAlreadyExists) {
+			t.Errorf("want false and already exists error for %v, got %v and %v", write, ok, err)
+			return
+		}
+		var mapperErr *datamapper.Error
+		if errors.As(err, &mapperErr) {
+			if currentModel, isUser := mapperErr.Current.(*model.User); !isUser || userModel.Email != currentModel.Email {
+				t.Errorf("want linked user as current record for %v, got %v", write, mapperErr.Current)
+			}
+		}
+	}
+	insertModel := NewTestUser(2)
+	insertModel.Identities[model.ProviderGoogle] = takenIdentity
+	ok, err := userMapper.Insert(insertModel)
+	assertTaken("insert", ok, err)
+	if _, err := userMapper.FindByID(insertModel.Email); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want rejected user not to be inserted, got %v", err)
+	}
+	ok, err = userMapper.Upsert(insertModel)
+	assertTaken("upsert", ok, err)
+
+	otherModel := NewTestUser(3)
+	mustInsert(t, userMapper, otherModel)
+	changedModel := *otherModel
+	changedModel.Identities = map[string]model.Identity{model.ProviderGoogle: takenIdentity}
+	ok, err = userMapper.Update(&changedModel)
+	assertTaken("update", ok, err)
+	ok, err = userMapper.Upsert(&changedModel)
+	assertTaken("upsert of an existing user", ok, err)
+	AssertUser(t, otherModel, mustFind(t, userMapper, otherModel.Email))
+
+	//the identity still resolves to the user it is linked to
+	if foundModel, err := userMapper.FindByProvider(model.ProviderGoogle, takenIdentity.Subject); err != nil {
+		t.Errorf("Failed to find by provider: %v", err)
+	} else {
+		AssertUser(t, userModel, foundModel)
+	}
+
+	//writing the user its own identities is allowed
+	userModel.Password = "changedPasswordHash"
+	if ok, err := userMapper.Update(userModel); err != nil || !ok {
+		t.Errorf("Failed to update user: %v, %v", ok, err)
+	}
+	if ok, err := userMapper.Upsert(userModel); err != nil || !ok {
+		t.Errorf("Failed to upsert user: %v, %v", ok, err)
+	}
+}
+
+//mustFind is a function for finding user by id, failing the test if it can't be found
+func mustFind(tb testing.TB, userMapper datamapper.UserMapper, id string) *model.User {
+	tb.Helper()
+	userModel, err := userMapper.FindByID(id)
+	if err != nil {
+		tb.Fatalf("Failed to find by id: %v", err)
+	}
+	return userModel
+}
+
+func testContextDone(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	mustInsert(t, userMapper, userModel)
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	expiredCtx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{"Canceled", canceledCtx, context.Canceled},
+		{"DeadlineExceeded", expiredCtx, datamapper.ErrTimeout},
+	} {
+		ctx := tc.ctx
+		newModel := NewTestUser(2)
+		changedModel := *userModel
+		changedModel.Password = "changedPasswordHash"
+		for _, op := range []struct {
+			name string
+			run  func() *goerrors.Error
+		}{
+			{"FindByID", func() *goerrors.Error { _, err := userMapper.FindByIDContext(ctx, userModel.Email); return err }},
+			{"FindByAuthToken", func() *goerrors.Error {
+				_, err := userMapper.FindByAuthTokenContext(ctx, userModel.AuthToken)
+				return err
+			}},
+			{"FindByProvider", func() *goerrors.Error {
+				_, err := userMapper.FindByProviderContext(ctx, model.ProviderGoogle, userModel.Identities[model.ProviderGoogle].Subject)
+				return err
+			}},
+			{"FindByStatus", func() *goerrors.Error {
+				_, err := userMapper.FindByStatusContext(ctx, model.UserStatusActive, "")
+				return err
+			}},
+			{"FindAll", func() *goerrors.Error { _, err := userMapper.FindAllContext(ctx); return err }},
+			{"FindPage", func() *goerrors.Error { _, err := userMapper.FindPageContext(ctx, ""); return err }},
+			{"Insert", func() *goerrors.Error { _, err := userMapper.InsertContext(ctx, newModel); return err }},
+			{"Upsert", func() *goerrors.Error { _, err := userMapper.UpsertContext(ctx, newModel); return err }},
+			{"Update", func() *goerrors.Error { _, err := userMapper.UpdateContext(ctx, &changedModel); return err }},
+			{"Rename", func() *goerrors.Error { _, err := userMapper.RenameContext(ctx, &changedModel, "renamed"); return err }},
+			{"ChangeEmail", func() *goerrors.Error {
+				_, err := userMapper.ChangeEmailContext(ctx, &changedModel, "changed@testemail.com")
+				return err
+			}},
+			{"Link", func() *goerrors.Error {
+				_, err := userMapper.LinkContext(ctx, &changedModel, NewTestIdentity("github", 1))
+				return err
+			}},
+			{"Unlink", func() *goerrors.Error {
+				_, err := userMapper.UnlinkContext(ctx, &changedModel, model.ProviderGoogle)
+				return err
+			}},
+			{"Restore", func() *goerrors.Error { _, err := userMapper.RestoreContext(ctx, &changedModel); return err }},
+			{"Purge", func() *goerrors.Error { _, err := userMapper.PurgeContext(ctx, 0); return err }},
+			{"Delete", func() *goerrors.Error { _, err := userMapper.DeleteContext(ctx, &changedModel); return err }},
+		} {
+			if err := op.run(); !errors.Is(err, tc.want) {
+				t.Errorf("%v %v: want %v error, got %v", tc.name, op.name, tc.want, err)
+			}
+		}
+	}
+
+	//nothing has been written
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+	if _, err := userMapper.FindByID(NewTestUser(2).Email); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for user inserted with done context, got %v", err)
+	}
+}
+
+func testWithOptions(t *testing.T, userMapper datamapper.UserMapper) {
+	userModel := NewTestUser(1)
+	optionsMapper := userMapper.With(datamapper.WithTimeout(time.Minute), datamapper.WithIdempotent(true))
+	mustInsert(t, optionsMapper, userModel)
+
+	//the datamapper returned by With shares the storage of the original one
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+
+	userModel.Password = "changedPasswordHash"
+	if ok, err := optionsMapper.Update(userModel); err != nil || !ok {
+		t.Fatalf("Failed to update user: %v, %v", ok, err)
+	}
+	foundModel, err = optionsMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	AssertUser(t, userModel, foundModel)
+}
+
+func testFindAllAndPage(t *testing.T, userMapper datamapper.UserMapper, records, pageSize int) {
+	insertedModels := insertTestUsers(t, userMapper, records)
+
+	userMapper.SetPageSize(pageSize)
+	assertSameUsers(t, insertedModels, findAllPages(t, userMapper, pageSize))
+}
+
+func testInterleavedPaging(t *testing.T, userMapper datamapper.UserMapper) {
+	insertedModels := insertTestUsers(t, userMapper, 5)
+	userMapper.SetPageSize(2)
+
+	//two callers paging the same query concurrently must not interfere with each other
+	first, err := userMapper.FindAll()
+	if err != nil {
+		t.Fatalf("findAll call failed: %v", err)
+	}
+	second, err := userMapper.FindAll()
+	if err != nil {
+		t.Fatalf("findAll call failed: %v", err)
+	}
+	firstModels, secondModels := first.Items, second.Items
+	for first.NextCursor != "" || second.NextCursor != "" {
+		if first.NextCursor != "" {
+			if first, err = userMapper.FindPage(first.NextCursor); err != nil {
+				t.Fatalf("findPage call failed: %v", err)
+			}
+			firstModels = append(firstModels, first.Items...)
+		}
+		if second.NextCursor != "" {
+			if second, err = userMapper.FindPage(second.NextCursor); err != nil {
+				t.Fatalf("findPage call failed: %v", err)
+			}
+			secondModels = append(secondModels, second.Items...)
+		}
+	}
+	assertSameUsers(t, insertedModels, firstModels)
+	assertSameUsers(t, insertedModels, secondModels)
+
+	//a cursor can be reused (e.g. a client retrying a request)
+	page, err := userMapper.FindAll()
+	if err != nil {
+		t.Fatalf("findAll call failed: %v", err)
+	}
+	again, err := userMapper.FindPage(page.NextCursor)
+	if err != nil {
+		t.Fatalf("findPage call failed: %v", err)
+	}
+	retried, err := userMapper.FindPage(page.NextCursor)
+	if err != nil {
+		t.Fatalf("findPage call failed: %v", err)
+	}
+	if len(again.Items) != len(retried.Items) {
+		t.Fatalf("want %v users for reused cursor, got %v", len(again.Items), len(retried.Items))
+	}
+	for i := range again.Items {
+		AssertUser(t, again.Items[i], retried.Items[i])
+	}
+}
+
+func testInvalidCursor(t *testing.T, userMapper datamapper.UserMapper) {
+	insertTestUsers(t, userMapper, 3)
+	userMapper.SetPageSize(1)
+
+	if _, err := userMapper.FindPage("not a valid cursor!"); !errors.Is(err, datamapper.ErrInvalidCursor) || !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want invalid input error caused by invalid cursor, got %v", err)
+	}
+
+	//signed cursors are rejected when tampered with or signed with another secret
+	userMapper.SetCursorSecret([]byte("secret"))
+	page, err := userMapper.FindAll()
+	if err != nil {
+		t.Fatalf("findAll call failed: %v", err)
+	}
+	if page.NextCursor == "" {
+		t.Fatal("want a next page cursor, got none")
+	}
+	if _, err := userMapper.FindPage(page.NextCursor); err != nil {
+		t.Errorf("findPage call failed: %v", err)
+	}
+	if _, err := userMapper.FindPage("A" + page.NextCursor); !errors.Is(err, datamapper.ErrInvalidCursor) {
+		t.Errorf("want invalid cursor error for tampered cursor, got %v", err)
+	}
+	userMapper.SetCursorSecret([]byte("another secret"))
+	if _, err := userMapper.FindPage(page.NextCursor); !errors.Is(err, datamapper.ErrInvalidCursor) {
+		t.Errorf("want invalid cursor error for cursor signed with another secret, got %v", err)
+	}
+
+	//a cursor is only accepted by the query it was returned by
+	statusPage, err := userMapper.FindByStatus(model.UserStatusActive, "")
+	if err != nil {
+		t.Fatalf("findByStatus call failed: %v", err)
+	}
+	if statusPage.NextCursor == "" {
+		t.Fatal("want a next page cursor, got none")
+	}
+	if _, err := userMapper.FindPage(statusPage.NextCursor); !errors.Is(err, datamapper.ErrInvalidCursor) {
+		t.Errorf("want invalid cursor error for cursor of FindByStatus, got %v", err)
+	}
+	if _, err := userMapper.FindByStatus(model.UserStatusInactive, statusPage.NextCursor); !errors.Is(err, datamapper.ErrInvalidCursor) {
+		t.Errorf("want invalid cursor error for cursor of another status, got %v", err)
+	}
+	page, err = userMapper.FindAll()
+	if err != nil {
+		t.Fatalf("findAll call failed: %v", err)
+	}
+	if _, err := userMapper.FindByStatus(model.UserStatusActive, page.NextCursor); !errors.Is(err, datamapper.ErrInvalidCursor) {
+		t.Errorf("want invalid cursor error for cursor of FindPage, got %v", err)
+	}
+}
+
+func testBidirectionalPaging(t *testing.T, userMapper datamapper.UserMapper) {
+	insertedModels := insertTestUsers(t, userMapper, 5)
+	userMapper.SetPageSize(2)
+
+	//page forward until the last page
+	page, err := userMapper.FindAll()
+	if err != nil {
+		t.Fatalf("findAll call failed: %v", err)
+	}
+	if page.HasPrevious() {
+		t.Errorf("want no previous page for the first page, got cursor %v", page.PreviousCursor)
+	}
+	forwardPages := []*datamapper.Page[*model.User]{page}
+	var allModelSlice []*model.User
+	allModelSlice = append(allModelSlice, page.Items...)
+	for page.HasNext() {
+		if page, err = userMapper.FindPage(page.NextCursor); err != nil {
+			t.Fatalf("findPage call failed: %v", err)
+		}
+		if !page.HasPrevious() {
+			t.Fatalf("want previous page for page %v, got none", len(forwardPages)+1)
+		}
+		forwardPages = append(forwardPages, page)
+		allModelSlice = append(allModelSlice, page.Items...)
+	}
+	assertSameUsers(t, insertedModels, allModelSlice)
+
+	//page backward from the last page, the same pages must be returned in reverse order
+	for i := len(forwardPages) - 2; i >= 0; i-- {
+		if page, err = userMapper.FindPage(page.PreviousCursor); err != nil {
+			t.Fatalf("findPage call failed: %v", err)
+		}
+		want := forwardPages[i]
+		if len(want.Items) != len(page.Items) {
+			t.Fatalf("page %v: want %v users, got %v", i+1, len(want.Items), len(page.Items))
+		}
+		for j := range want.Items {
+			AssertUser(t, want.Items[j], page.Items[j])
+		}
+		if want.HasPrevious() != page.HasPrevious() || !page.HasNext() {
+			t.Errorf("page %v: want %v for hasPrevious and true for hasNext, got %v and %v",
+				i+1, want.HasPrevious(), page.HasPrevious(), page.HasNext())
+		}
+	}
+	if page.HasPrevious() {
+		t.Errorf("want no previous page after paging back to the first page, got cursor %v", page.PreviousCursor)
+	}
+
+	//paging forward again from a page reached by paging backward
+	if page, err = userMapper.FindPage(page.NextCursor); err != nil {
+		t.Fatalf("findPage call failed: %v", err)
+	}
+	for j := range forwardPages[1].Items {
+		AssertUser(t, forwardPages[1].Items[j], page.Items[j])
+	}
+}
+
+func testDeepPaging(t *testing.T, userMapper datamapper.UserMapper) {
+	insertedModels := insertTestUsers(t, userMapper, datamapper.MaxCursorHistory+4)
+	userMapper.SetPageSize(1)
+
+	page, err := userMapper.FindAll()
+	if err != nil {
+		t.Fatalf("findAll call failed: %v", err)
+	}
+	allModelSlice := page.Items
+	for page.HasNext() {
+		if page, err = userMapper.FindPage(page.NextCursor); err != nil {
+			t.Fatalf("findPage call failed: %v", err)
+		}
+		allModelSlice = append(allModelSlice, page.Items...)
+	}
+	assertSameUsers(t, insertedModels, allModelSlice)
+
+	//cursors only carry the last pages, so paging backward stops before the first page
+	backward := 0
+	for ; page.HasPrevious(); backward++ {
+		if page, err = userMapper.FindPage(page.PreviousCursor); err != nil {
+			t.Fatalf("findPage call failed: %v", err)
+		}
+		if len(page.Items) != 1 {
+			t.Fatalf("want 1 user, got %v", len(page.Items))
+		}
+	}
+	if datamapper.MaxCursorHistory-1 != backward {
+		t.Errorf("want %v pages backward, got %v", datamapper.MaxCursorHistory-1, backward)
+	}
+	//paging forward still reaches the last page
+	for page.HasNext() {
+		if page, err = userMapper.FindPage(page.NextCursor); err != nil {
+			t.Fatalf("findPage call failed: %v", err)
+		}
+	}
+	if len(page.Items) != 1 || page.Items[0].Email != allModelSlice[len(allModelSlice)-1].Email {
+		t.Errorf("want last user %v, got %v", allModelSlice[len(allModelSlice)-1].Email, page.Items)
+	}
+}
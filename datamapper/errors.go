@@ -0,0 +1,123 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	stderrors "errors"
+	"testtrx/model"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//Sentinel errors classifying errors returned by datamappers, use errors.Is to check an error against them
+//(errors returned by datamappers are still *errors.Error from github.com/go-errors/errors, carrying the stack trace)
+var (
+	//ErrNotFound is the error kind for a record that doesn't exist
+	ErrNotFound = stderrors.New("not found")
+	//ErrAlreadyExists is the error kind for a record that can't be created because it already exists
+	ErrAlreadyExists = stderrors.New("already exists")
+	//ErrConflict is the error kind for a write that can't be applied because the record has been modified concurrently
+	ErrConflict = stderrors.New("conflict")
+	//ErrUnavailable is the error kind for a storage that can't serve the request (e.g. not enough replicas alive, no connection)
+	ErrUnavailable = stderrors.New("unavailable")
+	//ErrTimeout is the error kind for a request that didn't complete in time
+	ErrTimeout = stderrors.New("timeout")
+	//ErrInvalidInput is the error kind for a request that is rejected because of its input (e.g. malformed cursor, invalid query)
+	ErrInvalidInput = stderrors.New("invalid input")
+)
+
+//Error is a struct of datamapper error, classifying its cause with one of the sentinel error kinds
+//Use errors.As to access it from an error returned by a datamapper
+type Error struct {
+	Kind    error       //sentinel error kind (ErrNotFound, ErrAlreadyExists, ...)
+	Err     error       //underlying cause (e.g. the gocql error), may be nil
+	Current model.Model //currently stored record for ErrAlreadyExists and ErrConflict errors (nil if unknown)
+}
+
+//Error is a function for returning the error message
+func (e *Error) Error() string {
+	if e.Err == nil || e.Err.Error() == e.Kind.Error() {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+//Is is a function for matching the error against its kind (used by errors.Is)
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+//Unwrap is a function for returning the underlying cause (used by errors.Is and errors.As)
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//newError is a function for creating a datamapper error of kind with cause, the stack trace starts at the caller
+func newError(kind error, cause error) *errors.Error {
+	return errors.Wrap(&Error{Kind: kind, Err: cause}, 1)
+}
+
+//newCurrentError is a function for creating a datamapper error of kind carrying the currently stored record,
+//the stack trace starts at the caller
+func newCurrentError(kind error, current model.Model) *errors.Error {
+	return errors.Wrap(&Error{Kind: kind, Current: current}, 1)
+}
+
+//wrapError is a function for wrapping an error returned by gocql into a datamapper error classified by its kind,
+//errors that can't be classified are wrapped as they are, the stack trace starts at the caller
+func wrapError(err error) *errors.Error {
+	if kind := errorKind(err); kind != nil {
+		return errors.Wrap(&Error{Kind: kind, Err: err}, 1)
+	}
+	return errors.Wrap(err, 1)
+}
+
+//errorKind is a function for classifying an error returned by gocql, nil is returned if it can't be classified
+func errorKind(err error) error {
+	var unavailableErr *gocql.RequestErrUnavailable
+	var readTimeoutErr *gocql.RequestErrReadTimeout
+	var writeTimeoutErr *gocql.RequestErrWriteTimeout
+	var casWriteUnknownErr *gocql.RequestErrCASWriteUnknown
+	var alreadyExistsErr *gocql.RequestErrAlreadyExists
+	switch {
+	case stderrors.As(err, &unavailableErr):
+		return ErrUnavailable
+	case stderrors.As(err, &readTimeoutErr), stderrors.As(err, &writeTimeoutErr), stderrors.As(err, &casWriteUnknownErr):
+		return ErrTimeout
+	case stderrors.As(err, &alreadyExistsErr):
+		return ErrAlreadyExists
+	}
+	//other server side errors only carry an error code
+	var requestErr gocql.RequestError
+	if stderrors.As(err, &requestErr) {
+		switch requestErr.Code() {
+		case gocql.ErrCodeUnavailable, gocql.ErrCodeOverloaded, gocql.ErrCodeBootstrapping:
+			return ErrUnavailable
+		case gocql.ErrCodeReadTimeout, gocql.ErrCodeWriteTimeout, gocql.ErrCodeCASWriteUnknown:
+			return ErrTimeout
+		case gocql.ErrCodeSyntax, gocql.ErrCodeInvalid:
+			return ErrInvalidInput
+		case gocql.ErrCodeAlreadyExists:
+			return ErrAlreadyExists
+		}
+		return nil
+	}
+	switch {
+	case stderrors.Is(err, gocql.ErrNotFound):
+		return ErrNotFound
+	case stderrors.Is(err, gocql.ErrTimeoutNoResponse),
+		stderrors.Is(err, gocql.ErrTooManyTimeouts),
+		stderrors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout
+	case stderrors.Is(err, gocql.ErrUnavailable),
+		stderrors.Is(err, gocql.ErrNoConnections),
+		stderrors.Is(err, gocql.ErrConnectionClosed),
+		stderrors.Is(err, gocql.ErrNoStreams),
+		stderrors.Is(err, gocql.ErrSessionClosed):
+		return ErrUnavailable
+	case stderrors.Is(err, gocql.ErrQueryArgLength):
+		return ErrInvalidInput
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+//errors_test provides unit tests for datamapper errors classification
+package datamapper
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+func TestWrapErrorClassifiesGocqlErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		kind error
+	}{
+		{gocql.ErrNotFound, ErrNotFound},
+		{gocql.ErrTimeoutNoResponse, ErrTimeout},
+		{context.DeadlineExceeded, ErrTimeout},
+		{&gocql.RequestErrReadTimeout{}, ErrTimeout},
+		{&gocql.RequestErrWriteTimeout{}, ErrTimeout},
+		{gocql.ErrNoConnections, ErrUnavailable},
+		{&gocql.RequestErrUnavailable{}, ErrUnavailable},
+		{&gocql.RequestErrAlreadyExists{}, ErrAlreadyExists},
+		{gocql.ErrQueryArgLength, ErrInvalidInput},
+		{errors.New("unknown"), nil},
+	} {
+		err := wrapError(tc.err)
+		if tc.kind != nil && !errors.Is(err, tc.kind) {
+			t.Errorf("%T %v: want %v error, got %v", tc.err, tc.err, tc.kind, err)
+		}
+		//the underlying gocql error is still accessible
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%T %v: want underlying error to be kept, got %v", tc.err, tc.err, err)
+		}
+		var mapperErr *Error
+		if errors.As(err, &mapperErr) != (tc.kind != nil) {
+			t.Errorf("%T %v: want datamapper error %v, got %v", tc.err, tc.err, tc.kind != nil, err)
+		}
+	}
+}
+
+func TestWrapErrorKeepsStackTrace(t *testing.T) {
+	err := wrapError(gocql.ErrNotFound)
+	if !strings.Contains(err.ErrorStack(), "TestWrapErrorKeepsStackTrace") {
+		t.Errorf("want stack trace starting at the caller, got %v", err.ErrorStack())
+	}
+	if "not found" != err.Error() {
+		t.Errorf("want %v for error message, got %v", "not found", err.Error())
+	}
+	err = newError(ErrConflict, errors.New("version mismatch"))
+	if "conflict: version mismatch" != err.Error() {
+		t.Errorf("want %v for error message, got %v", "conflict: version mismatch", err.Error())
+	}
+}
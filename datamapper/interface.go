@@ -2,7 +2,9 @@
 package datamapper
 
 import (
+	"context"
 	"testtrx/model"
+	"time"
 
 	"github.com/go-errors/errors"
 )
@@ -11,11 +13,73 @@ import (
 //Note: watch for precision of seconds (cassandra can only support precision up to seconds)
 const TimeFormat = "2006-01-02 15:04:05 +0000 UTC"
 
-//DataMapper is an interface for data mapper
-type DataMapper interface {
-	FindById(id string) (*model.Model, *errors.Error)
-	FindAll() ([]*model.Model, *errors.Error)
-	Insert(model *model.Model) (bool, *errors.Error)
-	Update(model *model.Model) (bool, *errors.Error)
-	Delete(model *model.Model) (bool, *errors.Error)
+//DataMapper is an interface for data mapper of domain model type T
+//Note: T is usually a pointer to the model struct (e.g. *model.User), since models implement model.Model on pointer receivers
+//Every method has a Context variant, propagating cancellation and deadline of ctx to the queries
+//(the plain methods use context.Background())
+type DataMapper[T model.Model] interface {
+	FindByID(id string) (T, *errors.Error)
+	FindByIDContext(ctx context.Context, id string) (T, *errors.Error)
+	FindAll() (*Page[T], *errors.Error)
+	FindAllContext(ctx context.Context) (*Page[T], *errors.Error)
+	FindPage(cursor string) (*Page[T], *errors.Error)
+	FindPageContext(ctx context.Context, cursor string) (*Page[T], *errors.Error)
+	Insert(model T) (bool, *errors.Error)
+	InsertContext(ctx context.Context, model T) (bool, *errors.Error)
+	Upsert(model T) (bool, *errors.Error)
+	UpsertContext(ctx context.Context, model T) (bool, *errors.Error)
+	Update(model T) (bool, *errors.Error)
+	UpdateContext(ctx context.Context, model T) (bool, *errors.Error)
+	Delete(model T) (bool, *errors.Error)
+	DeleteContext(ctx context.Context, model T) (bool, *errors.Error)
+}
+
+//UserMapper is an interface for data mapper of user domain model
+type UserMapper interface {
+	DataMapper[*model.User]
+	SetPageSize(size int)
+	SetCursorSecret(secret []byte)
+	With(opts ...Option) UserMapper
+	FindByAuthToken(token string) (*model.User, *errors.Error)
+	FindByAuthTokenContext(ctx context.Context, token string) (*model.User, *errors.Error)
+	FindByProvider(provider, subject string) (*model.User, *errors.Error)
+	FindByProviderContext(ctx context.Context, provider, subject string) (*model.User, *errors.Error)
+	FindByStatus(status, cursor string) (*Page[*model.User], *errors.Error)
+	FindByStatusContext(ctx context.Context, status, cursor string) (*Page[*model.User], *errors.Error)
+	Rename(user *model.User, newName string) (bool, *errors.Error)
+	RenameContext(ctx context.Context, user *model.User, newName string) (bool, *errors.Error)
+	ChangeEmail(user *model.User, newEmail string) (bool, *errors.Error)
+	ChangeEmailContext(ctx context.Context, user *model.User, newEmail string) (bool, *errors.Error)
+	FindFormerEmails(email string) ([]string, *errors.Error)
+	FindFormerEmailsContext(ctx context.Context, email string) ([]string, *errors.Error)
+	Link(user *model.User, identity model.Identity) (bool, *errors.Error)
+	LinkContext(ctx context.Context, user *model.User, identity model.Identity) (bool, *errors.Error)
+	Unlink(user *model.User, provider string) (bool, *errors.Error)
+	UnlinkContext(ctx context.Context, user *model.User, provider string) (bool, *errors.Error)
+	Restore(user *model.User) (bool, *errors.Error)
+	RestoreContext(ctx context.Context, user *model.User) (bool, *errors.Error)
+	Purge(retention time.Duration) (int, *errors.Error)
+	PurgeContext(ctx context.Context, retention time.Duration) (int, *errors.Error)
+}
+
+//StatusHistoryMapper is an interface for data mapper of the history of user status transitions
+type StatusHistoryMapper interface {
+	Add(transition *model.StatusTransition) (bool, *errors.Error)
+	AddContext(ctx context.Context, transition *model.StatusTransition) (bool, *errors.Error)
+	FindByUser(email, name string) ([]*model.StatusTransition, *errors.Error)
+	FindByUserContext(ctx context.Context, email, name string) ([]*model.StatusTransition, *errors.Error)
+}
+
+//SessionMapper is an interface for data mapper of user sessions, expired sessions being neither found nor counted
+type SessionMapper interface {
+	Add(session *model.Session) (bool, *errors.Error)
+	AddContext(ctx context.Context, session *model.Session) (bool, *errors.Error)
+	FindByID(id string) (*model.Session, *errors.Error)
+	FindByIDContext(ctx context.Context, id string) (*model.Session, *errors.Error)
+	FindByUser(email string) ([]*model.Session, *errors.Error)
+	FindByUserContext(ctx context.Context, email string) ([]*model.Session, *errors.Error)
+	Delete(session *model.Session) (bool, *errors.Error)
+	DeleteContext(ctx context.Context, session *model.Session) (bool, *errors.Error)
+	DeleteByUser(email string) (int, *errors.Error)
+	DeleteByUserContext(ctx context.Context, email string) (int, *errors.Error)
 }
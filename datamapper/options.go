@@ -0,0 +1,161 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	"testtrx/model"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//Option is a function for setting an option of the queries run by a datamapper (or of the way they are run, e.g. WithSoftDelete)
+//Options are set as datamapper defaults when initializing it (e.g. NewUser) and can be overridden per call with With
+type Option func(*queryOptions)
+
+//queryOptions is a struct of the options of the queries run by a datamapper, unset options fall back to the session defaults
+type queryOptions struct {
+	consistency       *gocql.Consistency       //consistency of queries
+	serialConsistency *gocql.SerialConsistency //serial consistency of lightweight transactions
+	retryPolicy       gocql.RetryPolicy        //retry policy of queries
+	timeout           time.Duration            //timeout of an operation (covering all of its queries), none if 0
+	idempotent        *bool                    //whether queries other than lightweight transactions are idempotent
+	softDelete        bool                     //whether deleting marks records as deleted rather than removing them
+	includeDeleted    bool                     //whether finding records includes the ones marked as deleted
+}
+
+//WithConsistency is a function for setting the consistency of queries
+func WithConsistency(consistency gocql.Consistency) Option {
+	return func(o *queryOptions) {
+		o.consistency = &consistency
+	}
+}
+
+//WithSerialConsistency is a function for setting the serial consistency of lightweight transactions (conditional writes)
+func WithSerialConsistency(consistency gocql.SerialConsistency) Option {
+	return func(o *queryOptions) {
+		o.serialConsistency = &consistency
+	}
+}
+
+//WithRetryPolicy is a function for setting the retry policy of queries
+//Note: gocql retries whatever the policy allows, idempotent or not, so lightweight transactions (conditional writes) are never
+//retried whatever the policy (see noRetryPolicy)
+func WithRetryPolicy(policy gocql.RetryPolicy) Option {
+	return func(o *queryOptions) {
+		o.retryPolicy = policy
+	}
+}
+
+//WithTimeout is a function for setting the timeout of an operation, covering all of its queries (0 for no timeout)
+//The timeout applies on top of the deadline of the context passed to Context methods
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *queryOptions) {
+		o.timeout = timeout
+	}
+}
+
+//WithIdempotent is a function for setting whether queries are marked idempotent (i.e. safe to retry)
+//Note: lightweight transactions (conditional writes) are never marked idempotent, since retrying one may report a wrong outcome
+func WithIdempotent(idempotent bool) Option {
+	return func(o *queryOptions) {
+		o.idempotent = &idempotent
+	}
+}
+
+//WithSoftDelete is a function for setting whether deleting marks records as deleted (e.g. with model.UserStatusDeleted status)
+//rather than removing them, deleted records can then be restored until they are purged
+func WithSoftDelete(softDelete bool) Option {
+	return func(o *queryOptions) {
+		o.softDelete = softDelete
+	}
+}
+
+//WithIncludeDeleted is a function for setting whether finding records includes the ones marked as deleted (see WithSoftDelete),
+//which are left out by default
+func WithIncludeDeleted(includeDeleted bool) Option {
+	return func(o *queryOptions) {
+		o.includeDeleted = includeDeleted
+	}
+}
+
+//newQueryOptions is a function for initializing query options set by opts
+func newQueryOptions(opts []Option) queryOptions {
+	return queryOptions{}.with(opts)
+}
+
+//with is a function for returning a copy of the options overridden by opts
+func (o queryOptions) with(opts []Option) queryOptions {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+//context is a function for deriving the context of an operation from ctx, applying the timeout option
+func (o queryOptions) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, o.timeout)
+}
+
+//excludes is a function for checking whether user is left out of the found records, being marked as deleted
+func (o queryOptions) excludes(user *model.User) bool {
+	return !o.includeDeleted && user.Status == model.UserStatusDeleted
+}
+
+//query is a function for applying the options to a query
+func (o queryOptions) query(query *gocql.Query) *gocql.Query {
+	if o.consistency != nil {
+		query.Consistency(*o.consistency)
+	}
+	if o.retryPolicy != nil {
+		query.RetryPolicy(o.retryPolicy)
+	}
+	if o.idempotent != nil {
+		query.Idempotent(*o.idempotent)
+	}
+	return query
+}
+
+//noRetryPolicy is the retry policy of lightweight transactions, which are not retried since a retry of an applied one
+//would not be applied and report a wrong outcome (e.g. ErrAlreadyExists for the user just inserted, or a false ErrConflict)
+var noRetryPolicy gocql.RetryPolicy = &gocql.SimpleRetryPolicy{NumRetries: 0}
+
+//casQuery is a function for applying the options to a lightweight transaction query
+func (o queryOptions) casQuery(query *gocql.Query) *gocql.Query {
+	o.query(query).Idempotent(false).RetryPolicy(noRetryPolicy)
+	if o.serialConsistency != nil {
+		query.SerialConsistency(*o.serialConsistency)
+	}
+	return query
+}
+
+//batch is a function for applying the options to a batch, once all of its queries have been added
+func (o queryOptions) batch(batch *gocql.Batch) *gocql.Batch {
+	if o.consistency != nil {
+		batch.SetConsistency(*o.consistency)
+	}
+	if o.retryPolicy != nil {
+		batch.RetryPolicy(o.retryPolicy)
+	}
+	if o.idempotent != nil {
+		for i := range batch.Entries {
+			batch.Entries[i].Idempotent = *o.idempotent
+		}
+	}
+	return batch
+}
+
+//casBatch is a function for applying the options to a conditional batch, once all of its queries have been added
+func (o queryOptions) casBatch(batch *gocql.Batch) *gocql.Batch {
+	o.batch(batch).RetryPolicy(noRetryPolicy)
+	for i := range batch.Entries {
+		batch.Entries[i].Idempotent = false
+	}
+	if o.serialConsistency != nil {
+		batch.SerialConsistency(*o.serialConsistency)
+	}
+	return batch
+}
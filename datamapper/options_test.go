@@ -0,0 +1,110 @@
+//options_test provides unit tests for datamapper query options
+package datamapper
+
+import (
+	"context"
+	"testtrx/model"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestQueryOptionsDefaultToSession(t *testing.T) {
+	session := &gocql.Session{}
+	options := newQueryOptions(nil)
+
+	query := options.query(session.Query(`SELECT * FROM user`))
+	if session.Query(`SELECT * FROM user`).GetConsistency() != query.GetConsistency() {
+		t.Errorf("want session consistency, got %v", query.GetConsistency())
+	}
+	ctx, cancel := options.context(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("want no deadline without timeout option")
+	}
+}
+
+func TestQueryOptions(t *testing.T) {
+	session := &gocql.Session{}
+	options := newQueryOptions([]Option{
+		WithConsistency(gocql.LocalQuorum),
+		WithSerialConsistency(gocql.LocalSerial),
+		WithRetryPolicy(&gocql.SimpleRetryPolicy{NumRetries: 3}),
+		WithIdempotent(true),
+	})
+
+	query := options.query(session.Query(`SELECT * FROM user`))
+	if gocql.LocalQuorum != query.GetConsistency() {
+		t.Errorf("want %v consistency, got %v", gocql.LocalQuorum, query.GetConsistency())
+	}
+	if !query.IsIdempotent() {
+		t.Error("want idempotent query")
+	}
+	//lightweight transactions are never idempotent
+	casQuery := options.casQuery(session.Query(`DELETE FROM user WHERE user_email = ? IF EXISTS`))
+	if gocql.LocalQuorum != casQuery.GetConsistency() {
+		t.Errorf("want %v consistency, got %v", gocql.LocalQuorum, casQuery.GetConsistency())
+	}
+	if casQuery.IsIdempotent() {
+		t.Error("want non idempotent lightweight transaction")
+	}
+
+	batch := session.NewBatch(gocql.LoggedBatch)
+	batch.Query(`DELETE FROM user WHERE user_email = ?`)
+	options.batch(batch)
+	if gocql.LocalQuorum != batch.GetConsistency() {
+		t.Errorf("want %v consistency, got %v", gocql.LocalQuorum, batch.GetConsistency())
+	}
+	if !batch.IsIdempotent() {
+		t.Error("want idempotent batch")
+	}
+	casBatch := session.NewBatch(gocql.LoggedBatch)
+	casBatch.Query(`DELETE FROM user WHERE user_email = ? IF EXISTS`)
+	options.casBatch(casBatch)
+	if casBatch.IsIdempotent() {
+		t.Error("want non idempotent conditional batch")
+	}
+}
+
+func TestQueryOptionsTimeout(t *testing.T) {
+	options := newQueryOptions([]Option{WithTimeout(time.Minute)})
+
+	ctx, cancel := options.context(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("want deadline within %v, got %v", time.Minute, deadline)
+	}
+}
+
+func TestUserWithOverridesOptions(t *testing.T) {
+	userMapper := NewUser(nil, WithConsistency(gocql.One), WithTimeout(time.Minute))
+
+	overridden := userMapper.With(WithConsistency(gocql.LocalQuorum)).(*User)
+	if gocql.LocalQuorum != *overridden.options.consistency {
+		t.Errorf("want %v consistency, got %v", gocql.LocalQuorum, *overridden.options.consistency)
+	}
+	//options that are not overridden are kept
+	if time.Minute != overridden.options.timeout {
+		t.Errorf("want %v timeout, got %v", time.Minute, overridden.options.timeout)
+	}
+	//the datamapper defaults are unchanged
+	if gocql.One != *userMapper.options.consistency {
+		t.Errorf("want %v consistency, got %v", gocql.One, *userMapper.options.consistency)
+	}
+}
+
+func TestIncludeDeletedOption(t *testing.T) {
+	deletedUser := &model.User{Status: model.UserStatusDeleted}
+	activeUser := &model.User{Status: model.UserStatusActive}
+
+	options := newQueryOptions(nil)
+	if !options.excludes(deletedUser) || options.excludes(activeUser) {
+		t.Error("want only deleted users excluded by default")
+	}
+	options = newQueryOptions([]Option{WithIncludeDeleted(true)})
+	if options.excludes(deletedUser) || options.excludes(activeUser) {
+		t.Error("want no user excluded when including deleted users")
+	}
+}
@@ -0,0 +1,180 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	"fmt"
+	"testtrx/model"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//UserSession is a struct of datamapper for user sessions, stored in the user_session table (sessions of a user)
+//and the user_session_by_id lookup table, both written with a TTL so that expired sessions are removed by cassandra
+//Sessions are kept by user email, so they don't follow ChangeEmail (FindByUser and DeleteByUser use the email they were added with)
+type UserSession struct {
+	dbSession *gocql.Session //database connection session object
+	options   queryOptions   //options of the queries (consistency, timeout, ...)
+}
+
+//make sure UserSession satisfies the SessionMapper interface
+var _ SessionMapper = (*UserSession)(nil)
+
+//NewUserSession is a function for initializing a new user session datamapper, opts set the default options of its queries
+func NewUserSession(session *gocql.Session, opts ...Option) *UserSession {
+	return &UserSession{session, newQueryOptions(opts)}
+}
+
+//Add is a function for adding a session (see AddContext)
+func (s *UserSession) Add(session *model.Session) (bool, *errors.Error) {
+	return s.AddContext(context.Background(), session)
+}
+
+//AddContext is a function for adding session, with ctx for cancellation and deadline
+//The session is stored until its expiry time (rounded up to the second, the precision of cassandra TTLs)
+//It returns an ErrInvalidInput error if the session has no id or email, or if it is already expired
+func (s *UserSession) AddContext(ctx context.Context, session *model.Session) (bool, *errors.Error) {
+	ctx, cancel := s.options.context(ctx)
+	defer cancel()
+
+	ttl, err := sessionTTL(session, time.Now())
+	if err != nil {
+		return false, err
+	}
+	batch := s.dbSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(`INSERT INTO user_session (user_email, session_id, user_created_at, created_at, expires_at) VALUES (?, ?, ?, ?, ?) USING TTL ?`,
+		session.Email, session.ID, session.UserCreatedAt.UTC(), session.CreatedAt.UTC(), session.ExpiresAt.UTC(), ttl)
+	batch.Query(`INSERT INTO user_session_by_id (session_id, user_email, user_created_at, created_at, expires_at) VALUES (?, ?, ?, ?, ?) USING TTL ?`,
+		session.ID, session.Email, session.UserCreatedAt.UTC(), session.CreatedAt.UTC(), session.ExpiresAt.UTC(), ttl)
+	if err := s.dbSession.ExecuteBatch(s.options.batch(batch)); err != nil {
+		return false, wrapError(err)
+	}
+	return true, nil
+}
+
+//FindByID is a function for finding a session by its id (see FindByIDContext)
+func (s *UserSession) FindByID(id string) (*model.Session, *errors.Error) {
+	return s.FindByIDContext(context.Background(), id)
+}
+
+//FindByIDContext is a function for finding a session by its id, with ctx for cancellation and deadline
+//It returns an ErrNotFound error if no session has id or if it is expired
+func (s *UserSession) FindByIDContext(ctx context.Context, id string) (*model.Session, *errors.Error) {
+	ctx, cancel := s.options.context(ctx)
+	defer cancel()
+
+	if id == "" {
+		return nil, newError(ErrInvalidInput, fmt.Errorf("empty session id"))
+	}
+	session := &model.Session{ID: id}
+	if err := s.options.query(s.dbSession.Query(`SELECT user_email, user_created_at, created_at, expires_at
+			FROM user_session_by_id
+			WHERE session_id = ?`, id)).
+		WithContext(ctx).
+		Scan(&session.Email, &session.UserCreatedAt, &session.CreatedAt, &session.ExpiresAt); err != nil {
+		return nil, wrapError(err)
+	}
+	//the row outlives the session by up to a second, the TTL being rounded up
+	if !session.ExpiresAt.After(time.Now()) {
+		return nil, newError(ErrNotFound, fmt.Errorf("session %v is expired", id))
+	}
+	return session, nil
+}
+
+//FindByUser is a function for finding the sessions of the user with email (see FindByUserContext)
+func (s *UserSession) FindByUser(email string) ([]*model.Session, *errors.Error) {
+	return s.FindByUserContext(context.Background(), email)
+}
+
+//FindByUserContext is a function for finding the unexpired sessions of the user with email, ordered by id,
+//with ctx for cancellation and deadline
+func (s *UserSession) FindByUserContext(ctx context.Context, email string) ([]*model.Session, *errors.Error) {
+	ctx, cancel := s.options.context(ctx)
+	defer cancel()
+
+	iter := s.options.query(s.dbSession.Query(`SELECT session_id, user_created_at, created_at, expires_at
+		FROM user_session
+		WHERE user_email = ?`, email)).WithContext(ctx).Iter()
+	var sessions []*model.Session
+	now := time.Now()
+	session := model.Session{Email: email}
+	for iter.Scan(&session.ID, &session.UserCreatedAt, &session.CreatedAt, &session.ExpiresAt) {
+		if !session.ExpiresAt.After(now) {
+			continue
+		}
+		found := session
+		sessions = append(sessions, &found)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, wrapError(err)
+	}
+	return sessions, nil
+}
+
+//Delete is a function for deleting a session (see DeleteContext)
+func (s *UserSession) Delete(session *model.Session) (bool, *errors.Error) {
+	return s.DeleteContext(context.Background(), session)
+}
+
+//DeleteContext is a function for deleting session, with ctx for cancellation and deadline
+//Note: deleting a session that doesn't exist (e.g. already expired) is not an error
+func (s *UserSession) DeleteContext(ctx context.Context, session *model.Session) (bool, *errors.Error) {
+	ctx, cancel := s.options.context(ctx)
+	defer cancel()
+
+	batch := s.dbSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(`DELETE FROM user_session WHERE user_email = ? AND session_id = ?`, session.Email, session.ID)
+	batch.Query(`DELETE FROM user_session_by_id WHERE session_id = ?`, session.ID)
+	if err := s.dbSession.ExecuteBatch(s.options.batch(batch)); err != nil {
+		return false, wrapError(err)
+	}
+	return true, nil
+}
+
+//DeleteByUser is a function for deleting all the sessions of the user with email (see DeleteByUserContext)
+func (s *UserSession) DeleteByUser(email string) (int, *errors.Error) {
+	return s.DeleteByUserContext(context.Background(), email)
+}
+
+//DeleteByUserContext is a function for deleting all the sessions of the user with email, with ctx for cancellation and deadline,
+//returning the number of unexpired sessions deleted
+func (s *UserSession) DeleteByUserContext(ctx context.Context, email string) (int, *errors.Error) {
+	ctx, cancel := s.options.context(ctx)
+	defer cancel()
+
+	var id string
+	var expiresAt time.Time
+	count := 0
+	now := time.Now()
+	batch := s.dbSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(`DELETE FROM user_session WHERE user_email = ?`, email)
+	iter := s.options.query(s.dbSession.Query(`SELECT session_id, expires_at FROM user_session WHERE user_email = ?`, email)).
+		WithContext(ctx).Iter()
+	for iter.Scan(&id, &expiresAt) {
+		batch.Query(`DELETE FROM user_session_by_id WHERE session_id = ?`, id)
+		if expiresAt.After(now) {
+			count++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, wrapError(err)
+	}
+	if err := s.dbSession.ExecuteBatch(s.options.batch(batch)); err != nil {
+		return 0, wrapError(err)
+	}
+	return count, nil
+}
+
+//sessionTTL is a function for checking that session can be added at now, returning its TTL in seconds (rounded up)
+func sessionTTL(session *model.Session, now time.Time) (int, *errors.Error) {
+	if session.ID == "" || session.Email == "" {
+		return 0, newError(ErrInvalidInput, fmt.Errorf("empty session id or email"))
+	}
+	ttl := session.ExpiresAt.Sub(now)
+	if ttl <= 0 {
+		return 0, newError(ErrInvalidInput, fmt.Errorf("session %v is already expired", session.ID))
+	}
+	return int((ttl + time.Second - 1) / time.Second), nil
+}
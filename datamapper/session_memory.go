@@ -0,0 +1,162 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testtrx/model"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+//MemoryUserSession is a struct of in-memory datamapper for user sessions
+//It behaves the same way as the cassandra backed UserSession datamapper and is safe for concurrent use,
+//expired sessions being removed when sessions are added
+type MemoryUserSession struct {
+	mutex sync.RWMutex             //guards rows
+	rows  map[string]model.Session //stored sessions keyed by id
+}
+
+//make sure MemoryUserSession satisfies the SessionMapper interface
+var _ SessionMapper = (*MemoryUserSession)(nil)
+
+//NewMemoryUserSession is a function for initializing a new in-memory user session datamapper
+func NewMemoryUserSession() *MemoryUserSession {
+	return &MemoryUserSession{rows: map[string]model.Session{}}
+}
+
+//Add is a function for adding a session (see AddContext)
+func (m *MemoryUserSession) Add(session *model.Session) (bool, *errors.Error) {
+	return m.AddContext(context.Background(), session)
+}
+
+//AddContext is a function for adding session, with ctx for cancellation and deadline
+//It returns an ErrInvalidInput error if the session has no id or email, or if it is already expired
+func (m *MemoryUserSession) AddContext(ctx context.Context, session *model.Session) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+	now := time.Now()
+	if _, err := sessionTTL(session, now); err != nil {
+		return false, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, stored := range m.rows {
+		if !stored.ExpiresAt.After(now) {
+			delete(m.rows, id)
+		}
+	}
+	stored := *session
+	//same as loading the timestamps stored by UserSession
+	stored.UserCreatedAt = stored.UserCreatedAt.UTC().Truncate(time.Millisecond)
+	stored.CreatedAt = stored.CreatedAt.UTC().Truncate(time.Millisecond)
+	stored.ExpiresAt = stored.ExpiresAt.UTC().Truncate(time.Millisecond)
+	m.rows[session.ID] = stored
+	return true, nil
+}
+
+//FindByID is a function for finding a session by its id (see FindByIDContext)
+func (m *MemoryUserSession) FindByID(id string) (*model.Session, *errors.Error) {
+	return m.FindByIDContext(context.Background(), id)
+}
+
+//FindByIDContext is a function for finding a session by its id, with ctx for cancellation and deadline
+//It returns an ErrNotFound error if no session has id or if it is expired
+func (m *MemoryUserSession) FindByIDContext(ctx context.Context, id string) (*model.Session, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+	if id == "" {
+		return nil, newError(ErrInvalidInput, fmt.Errorf("empty session id"))
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	stored, exists := m.rows[id]
+	if !exists || !stored.ExpiresAt.After(time.Now()) {
+		return nil, newError(ErrNotFound, fmt.Errorf("session %v not found", id))
+	}
+	return &stored, nil
+}
+
+//FindByUser is a function for finding the sessions of the user with email (see FindByUserContext)
+func (m *MemoryUserSession) FindByUser(email string) ([]*model.Session, *errors.Error) {
+	return m.FindByUserContext(context.Background(), email)
+}
+
+//FindByUserContext is a function for finding the unexpired sessions of the user with email, ordered by id,
+//with ctx for cancellation and deadline
+func (m *MemoryUserSession) FindByUserContext(ctx context.Context, email string) ([]*model.Session, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var sessions []*model.Session
+	now := time.Now()
+	for _, stored := range m.rows {
+		if stored.Email == email && stored.ExpiresAt.After(now) {
+			session := stored
+			sessions = append(sessions, &session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions, nil
+}
+
+//Delete is a function for deleting a session (see DeleteContext)
+func (m *MemoryUserSession) Delete(session *model.Session) (bool, *errors.Error) {
+	return m.DeleteContext(context.Background(), session)
+}
+
+//DeleteContext is a function for deleting session, with ctx for cancellation and deadline
+//Note: deleting a session that doesn't exist (e.g. already expired) is not an error
+func (m *MemoryUserSession) DeleteContext(ctx context.Context, session *model.Session) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.rows, session.ID)
+	return true, nil
+}
+
+//DeleteByUser is a function for deleting all the sessions of the user with email (see DeleteByUserContext)
+func (m *MemoryUserSession) DeleteByUser(email string) (int, *errors.Error) {
+	return m.DeleteByUserContext(context.Background(), email)
+}
+
+//DeleteByUserContext is a function for deleting all the sessions of the user with email, with ctx for cancellation and deadline,
+//returning the number of unexpired sessions deleted
+func (m *MemoryUserSession) DeleteByUserContext(ctx context.Context, email string) (int, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapError(err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	count := 0
+	now := time.Now()
+	for id, stored := range m.rows {
+		if stored.Email != email {
+			continue
+		}
+		if stored.ExpiresAt.After(now) {
+			count++
+		}
+		delete(m.rows, id)
+	}
+	return count, nil
+}
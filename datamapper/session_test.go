@@ -0,0 +1,17 @@
+//session_test provides unit tests for user session datamapper
+package datamapper_test
+
+import (
+	"testtrx/datamapper"
+	"testtrx/datamapper/datamappertest"
+
+	"testing"
+)
+
+func TestSessionMapperSuite(t *testing.T) {
+	datamappertest.RunSessionMapperSuite(t, func(t *testing.T) datamapper.SessionMapper {
+		initUserTable(t)
+		t.Cleanup(func() { cleanupUserTable(t) })
+		return datamapper.NewUserSession(initTest())
+	})
+}
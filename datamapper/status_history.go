@@ -0,0 +1,131 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	"testtrx/model"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//StatusHistory is a struct of datamapper for the history of user status transitions, stored in the user_status_history table
+//Transitions are kept by user primary key (user email and name), the User datamapper moves them along with the user on Rename and ChangeEmail
+type StatusHistory struct {
+	dbSession *gocql.Session //database connection session object
+	options   queryOptions   //options of the queries (consistency, timeout, ...)
+}
+
+//make sure StatusHistory satisfies the StatusHistoryMapper interface
+var _ StatusHistoryMapper = (*StatusHistory)(nil)
+
+//NewStatusHistory is a function for initializing a new status history datamapper, opts set the default options of its queries
+func NewStatusHistory(session *gocql.Session, opts ...Option) *StatusHistory {
+	return &StatusHistory{session, newQueryOptions(opts)}
+}
+
+//Add is a function for adding transition to the history (see AddContext)
+func (s *StatusHistory) Add(transition *model.StatusTransition) (bool, *errors.Error) {
+	return s.AddContext(context.Background(), transition)
+}
+
+//AddContext is a function for adding transition to the history of its user, with ctx for cancellation and deadline
+//Note: transitions are identified by a time UUID of transition.At, so transitions made at the same time are all kept
+func (s *StatusHistory) AddContext(ctx context.Context, transition *model.StatusTransition) (bool, *errors.Error) {
+	ctx, cancel := s.options.context(ctx)
+	defer cancel()
+
+	if err := s.options.query(s.dbSession.Query(`
+		INSERT INTO user_status_history (
+			user_email,
+			name,
+			changed_at,
+			from_status,
+			to_status,
+			reason,
+			actor
+			) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		transition.Email,
+		transition.Name,
+		gocql.UUIDFromTime(transition.At),
+		transition.From,
+		transition.To,
+		transition.Reason,
+		transition.Actor)).WithContext(ctx).Exec(); err != nil {
+		return false, wrapError(err)
+	}
+	return true, nil
+}
+
+//FindByUser is a function for finding the status transitions of the user with email and name (see FindByUserContext)
+func (s *StatusHistory) FindByUser(email, name string) ([]*model.StatusTransition, *errors.Error) {
+	return s.FindByUserContext(context.Background(), email, name)
+}
+
+//FindByUserContext is a function for finding the status transitions of the user with email and name, latest first,
+//with ctx for cancellation and deadline
+//Transition times are loaded in UTC, with the 100 nanoseconds precision of time UUIDs
+func (s *StatusHistory) FindByUserContext(ctx context.Context, email, name string) ([]*model.StatusTransition, *errors.Error) {
+	ctx, cancel := s.options.context(ctx)
+	defer cancel()
+
+	iter := s.options.query(s.dbSession.Query(`SELECT changed_at, from_status, to_status, reason, actor
+		FROM user_status_history
+		WHERE user_email = ? AND name = ?`, email, name)).WithContext(ctx).Iter()
+	var transitions []*model.StatusTransition
+	var changedAt gocql.UUID
+	transition := model.StatusTransition{Email: email, Name: name}
+	for iter.Scan(&changedAt, &transition.From, &transition.To, &transition.Reason, &transition.Actor) {
+		transition.At = changedAt.Time().UTC()
+		found := transition
+		transitions = append(transitions, &found)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, wrapError(err)
+	}
+	return transitions, nil
+}
+
+//moveStatusHistory is a function for moving the status transitions of the user with email and name to newEmail and newName,
+//after the user has been renamed or has changed email, so that its history follows it and is not inherited by a later user with the old key
+func (u *User) moveStatusHistory(ctx context.Context, email, name, newEmail, newName string) *errors.Error {
+	iter := u.options.query(u.dbSession.Query(`SELECT changed_at, from_status, to_status, reason, actor
+		FROM user_status_history
+		WHERE user_email = ? AND name = ?`, email, name)).WithContext(ctx).Iter()
+	batch := u.dbSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	var changedAt gocql.UUID
+	var from, to, reason, actor string
+	for iter.Scan(&changedAt, &from, &to, &reason, &actor) {
+		batch.Query(`
+			INSERT INTO user_status_history (
+				user_email,
+				name,
+				changed_at,
+				from_status,
+				to_status,
+				reason,
+				actor
+				) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			newEmail,
+			newName,
+			changedAt,
+			from,
+			to,
+			reason,
+			actor)
+	}
+	if err := iter.Close(); err != nil {
+		return wrapError(err)
+	}
+	if batch.Size() == 0 {
+		return nil
+	}
+	batch.Query(`
+		DELETE FROM user_status_history WHERE user_email = ? AND name = ?`,
+		email,
+		name)
+	if err := u.dbSession.ExecuteBatch(u.options.batch(batch)); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
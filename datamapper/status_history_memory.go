@@ -0,0 +1,88 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testtrx/model"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+//MemoryStatusHistory is a struct of in-memory datamapper for the history of user status transitions
+//It behaves the same way as the cassandra backed StatusHistory datamapper and is safe for concurrent use
+type MemoryStatusHistory struct {
+	mutex sync.RWMutex                           //guards rows
+	rows  map[[2]string][]model.StatusTransition //stored transitions in adding order, keyed by user email and name
+}
+
+//make sure MemoryStatusHistory satisfies the StatusHistoryMapper interface
+var _ StatusHistoryMapper = (*MemoryStatusHistory)(nil)
+
+//NewMemoryStatusHistory is a function for initializing a new in-memory status history datamapper
+func NewMemoryStatusHistory() *MemoryStatusHistory {
+	return &MemoryStatusHistory{rows: map[[2]string][]model.StatusTransition{}}
+}
+
+//Add is a function for adding transition to the history (see AddContext)
+func (m *MemoryStatusHistory) Add(transition *model.StatusTransition) (bool, *errors.Error) {
+	return m.AddContext(context.Background(), transition)
+}
+
+//AddContext is a function for adding transition to the history of its user, with ctx for cancellation and deadline
+func (m *MemoryStatusHistory) AddContext(ctx context.Context, transition *model.StatusTransition) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored := *transition
+	//same as loading the time UUID stored by StatusHistory
+	stored.At = stored.At.UTC().Truncate(100 * time.Nanosecond)
+	key := [2]string{transition.Email, transition.Name}
+	m.rows[key] = append(m.rows[key], stored)
+	return true, nil
+}
+
+//FindByUser is a function for finding the status transitions of the user with email and name (see FindByUserContext)
+func (m *MemoryStatusHistory) FindByUser(email, name string) ([]*model.StatusTransition, *errors.Error) {
+	return m.FindByUserContext(context.Background(), email, name)
+}
+
+//FindByUserContext is a function for finding the status transitions of the user with email and name, latest first,
+//with ctx for cancellation and deadline
+func (m *MemoryStatusHistory) FindByUserContext(ctx context.Context, email, name string) ([]*model.StatusTransition, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	stored := m.rows[[2]string{email, name}]
+	var transitions []*model.StatusTransition
+	for i := len(stored) - 1; i >= 0; i-- {
+		transition := stored[i]
+		transitions = append(transitions, &transition)
+	}
+	//transitions added out of time order are still returned latest first, the ones made at the same time latest added first
+	sort.SliceStable(transitions, func(i, j int) bool { return transitions[i].At.After(transitions[j].At) })
+	return transitions, nil
+}
+
+//move is a function for moving the status transitions of the user with email and name to newEmail and newName (see MemoryUser.StatusHistory)
+func (m *MemoryStatusHistory) move(email, name, newEmail, newName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key, newKey := [2]string{email, name}, [2]string{newEmail, newName}
+	for _, transition := range m.rows[key] {
+		transition.Email, transition.Name = newEmail, newName
+		m.rows[newKey] = append(m.rows[newKey], transition)
+	}
+	delete(m.rows, key)
+}
@@ -0,0 +1,25 @@
+//status_history_test provides unit tests for status history datamapper
+package datamapper_test
+
+import (
+	"testtrx/datamapper"
+	"testtrx/datamapper/datamappertest"
+
+	"testing"
+)
+
+func TestStatusHistoryMapperSuite(t *testing.T) {
+	datamappertest.RunStatusHistoryMapperSuite(t, func(t *testing.T) datamapper.StatusHistoryMapper {
+		initUserTable(t)
+		t.Cleanup(func() { cleanupUserTable(t) })
+		return datamapper.NewStatusHistory(initTest())
+	})
+}
+
+func TestUserStatusHistorySuite(t *testing.T) {
+	datamappertest.RunUserStatusHistorySuite(t, func(t *testing.T) (datamapper.UserMapper, datamapper.StatusHistoryMapper) {
+		initUserTable(t)
+		t.Cleanup(func() { cleanupUserTable(t) })
+		return initUserMapperTest(t), datamapper.NewStatusHistory(initTest())
+	})
+}
@@ -2,25 +2,41 @@
 package datamapper
 
 import (
+	"context"
+	stderrors "errors"
 	"fmt"
 	"testtrx/model"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/gocql/gocql"
 )
 
 //User is a struct of datamapper for user domain model
+//Note: User doesn't hold any query state (result paging state is handed to callers as cursors), so it can be shared across goroutines
 type User struct {
-	dbSession     *gocql.Session //database connection session object
-	pagedQuery    *gocql.Query   //query object (storing this is required for result paging)
-	pageSize      int            //size of page (no of records per page) for query result paging
-	nextPageState []byte         //page state of next page for result paging purpose
+	dbSession   *gocql.Session //database connection session object
+	pageSize    int            //size of page (no of records per page) for query result paging
+	cursorCodec CursorCodec    //codec for encoding/decoding page states of result paging into cursors
+	options     queryOptions   //options of the queries (consistency, timeout, ...)
 }
 
-//NewUser is a function for initializing a new user datamapper
-func NewUser(session *gocql.Session) *User {
+//make sure User satisfies the UserMapper interface
+var _ UserMapper = (*User)(nil)
+
+//NewUser is a function for initializing a new user datamapper, opts set the default options of its queries
+//(e.g. WithConsistency(gocql.LocalQuorum)), unset options fall back to the session defaults
+func NewUser(session *gocql.Session, opts ...Option) *User {
 	//Note: pageSize defaults to 10
-	return &User{session, nil, 10, nil}
+	return &User{session, 10, NewCursorCodec(nil), newQueryOptions(opts)}
+}
+
+//With is a function for returning a copy of the datamapper with its query options overridden by opts,
+//e.g. for reading at a different consistency in a single call: userMapper.With(WithConsistency(gocql.One)).FindAll()
+func (u *User) With(opts ...Option) UserMapper {
+	userCopy := *u
+	userCopy.options = u.options.with(opts)
+	return &userCopy
 }
 
 //SetPageSize is a function for setting query result page size (no of records perpage)
@@ -28,76 +44,237 @@ func (u *User) SetPageSize(size int) {
 	u.pageSize = size
 }
 
-//FindByID is a function for finding an user by id
+//SetCursorSecret is a function for setting the secret key used for signing page cursors (cursors are not signed if secret is empty)
+func (u *User) SetCursorSecret(secret []byte) {
+	u.cursorCodec = NewCursorCodec(secret)
+}
+
+//userColumns is the list of user table columns loaded into user model, in the same order as scanned by userScanDest
+const userColumns = `
+	user_email,
+	password,
+	name,
+	status,
+	last_activity,
+	auth_token,
+	identities,
+	created_at,
+	deleted_at,
+	version`
+
+//userScanDest is a function for returning the scan destinations of userColumns for loading into userModel
+func userScanDest(userModel *model.User) []interface{} {
+	return []interface{}{
+		&userModel.Email,
+		&userModel.Password,
+		&userModel.Name,
+		&userModel.Status,
+		&userModel.LastActivity,
+		&userModel.AuthToken,
+		&identitiesColumn{&userModel.Identities},
+		&userModel.CreatedAt,
+		&userModel.DeletedAt,
+		&userModel.Version,
+	}
+}
+
+//maxEmailRedirects is the maximum number of email change redirects followed when finding a user by id
+const maxEmailRedirects = 8
+
+//FindByID is a function for finding an user by id (see FindByIDContext)
 func (u *User) FindByID(id string) (*model.User, *errors.Error) {
+	return u.FindByIDContext(context.Background(), id)
+}
+
+//FindByIDContext is a function for finding an user by id, with ctx for cancellation and deadline
+//If no user has the email id but its email was changed (see ChangeEmail), the user is found by following the redirect
+//to the new email, in which case the returned user's Email differs from id
+//A well formed id is normalized first (see model.NormalizeEmail), so a user is found whatever the case of its email domain,
+//falling back to id as is if no user is found (e.g. a user stored before emails were normalized)
+//A user marked as deleted is not found, unless WithIncludeDeleted is set
+func (u *User) FindByIDContext(ctx context.Context, id string) (*model.User, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	email := findEmail(id)
+	userModel, err := u.findRedirected(ctx, email)
+	if email != id && stderrors.Is(err, ErrNotFound) {
+		userModel, err = u.findRedirected(ctx, id)
+	}
+	if err == nil && u.options.excludes(userModel) {
+		return nil, newError(ErrNotFound, gocql.ErrNotFound)
+	}
+	return userModel, err
+}
+
+//findRedirected is a function for finding an user by email, following the redirects of changed emails (see FindByIDContext)
+func (u *User) findRedirected(ctx context.Context, email string) (*model.User, *errors.Error) {
+	for redirects := 0; ; redirects++ {
+		userModel, err := u.findByEmail(ctx, email)
+		if err == nil || !stderrors.Is(err, ErrNotFound) || redirects == maxEmailRedirects {
+			return userModel, err
+		}
+		newEmail, redirectErr := u.findEmailRedirect(ctx, email)
+		if redirectErr != nil {
+			if stderrors.Is(redirectErr, ErrNotFound) {
+				return nil, err
+			}
+			return nil, redirectErr
+		}
+		email = newEmail
+	}
+}
+
+//findByEmail is a function for finding an user by email (the first user of the partition, ordered by name)
+func (u *User) findByEmail(ctx context.Context, email string) (*model.User, *errors.Error) {
 	userModel := model.User{}
 
-	if err := u.dbSession.Query(`SELECT 
-			user_email,
-			password,
-			name,
-			status,
-			last_activity,
-			auth_token,
-			google_token,
-			facebook_token
+	if err := u.options.query(u.dbSession.Query(`SELECT `+userColumns+`
+			FROM user
+			WHERE user_email = ? LIMIT 1`, email)).
+		WithContext(ctx).
+		Scan(userScanDest(&userModel)...); err != nil {
+		return nil, wrapError(err)
+	}
+	return &userModel, nil
+}
+
+//findEmailRedirect is a function for finding the new email of an email that has been changed
+func (u *User) findEmailRedirect(ctx context.Context, email string) (string, *errors.Error) {
+	var newEmail string
+	if err := u.options.query(u.dbSession.Query(`SELECT new_email
+			FROM user_email_redirect
+			WHERE old_email = ?`, email)).
+		WithContext(ctx).
+		Scan(&newEmail); err != nil {
+		return "", wrapError(err)
+	}
+	return newEmail, nil
+}
+
+//FindFormerEmails is a function for finding the former emails of the user with email (see FindFormerEmailsContext)
+func (u *User) FindFormerEmails(email string) ([]string, *errors.Error) {
+	return u.FindFormerEmailsContext(context.Background(), email)
+}
+
+//FindFormerEmailsContext is a function for finding the former emails of the user with email, i.e. the emails redirecting to email
+//(directly or through other redirects, see ChangeEmail) that no user has anymore, with ctx for cancellation and deadline
+//The redirects are looked up in the user_email_redirect_by_new table, whose lookups are checked against the redirects
+//since they are not removed when a redirect becomes obsolete
+func (u *User) FindFormerEmailsContext(ctx context.Context, email string) ([]string, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	var formerEmails []string
+	newEmails := []string{email}
+	for redirects := 0; len(newEmails) > 0 && redirects < maxEmailRedirects; redirects++ {
+		var oldEmails []string
+		for _, newEmail := range newEmails {
+			candidates, err := u.findRedirectsTo(ctx, newEmail)
+			if err != nil {
+				return nil, err
+			}
+			for _, oldEmail := range candidates {
+				redirected, err := u.findEmailRedirect(ctx, oldEmail)
+				if stderrors.Is(err, ErrNotFound) || (err == nil && redirected != newEmail) {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				//same as FindByID, a redirect is not followed once a user has the email again
+				if _, err := u.findByEmail(ctx, oldEmail); err == nil {
+					continue
+				} else if !stderrors.Is(err, ErrNotFound) {
+					return nil, err
+				}
+				oldEmails = append(oldEmails, oldEmail)
+			}
+		}
+		formerEmails = append(formerEmails, oldEmails...)
+		newEmails = oldEmails
+	}
+	return formerEmails, nil
+}
+
+//findRedirectsTo is a function for finding the old emails looked up as redirecting to email (including obsolete ones)
+func (u *User) findRedirectsTo(ctx context.Context, email string) ([]string, *errors.Error) {
+	var oldEmail string
+	var oldEmails []string
+	iter := u.options.query(u.dbSession.Query(`SELECT old_email
+		FROM user_email_redirect_by_new
+		WHERE new_email = ?`, email)).WithContext(ctx).Iter()
+	for iter.Scan(&oldEmail) {
+		oldEmails = append(oldEmails, oldEmail)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, wrapError(err)
+	}
+	return oldEmails, nil
+}
+
+//findByKey is a function for finding an user by its primary key (user email and name)
+func (u *User) findByKey(ctx context.Context, email, name string) (*model.User, *errors.Error) {
+	userModel := model.User{}
+
+	if err := u.options.query(u.dbSession.Query(`SELECT `+userColumns+`
 			FROM user
-			WHERE user_email = ? LIMIT 1`, id).
-		Consistency(gocql.One).
-		Scan(&userModel.Email,
-			&userModel.Password,
-			&userModel.Name,
-			&userModel.Status,
-			&userModel.LastActivity,
-			&userModel.AuthToken,
-			&userModel.GoogleToken,
-			&userModel.FacebookToken); err != nil {
-		return nil, errors.Wrap(err, 0)
+			WHERE user_email = ? AND name = ?`, email, name)).
+		WithContext(ctx).
+		Scan(userScanDest(&userModel)...); err != nil {
+		return nil, wrapError(err)
 	}
 	return &userModel, nil
 }
 
-//FindAll is a function for finding all user with paging capability
-func (u *User) FindAll() ([]*model.User, *errors.Error) {
-	u.pagedQuery = u.dbSession.Query(`SELECT
-		user_email,
-		password,
-		name,
-		status,
-		last_activity,
-		auth_token,
-		google_token,
-		facebook_token
-	FROM user`)
-	iter := u.pagedQuery.PageState(nil).PageSize(u.pageSize).Iter()
-	//the iterator page state becomes page state for next page
-	u.nextPageState = iter.PageState()
+//FindAll is a function for finding all user, returning the first page of the result (see FindAllContext)
+func (u *User) FindAll() (*Page[*model.User], *errors.Error) {
+	return u.FindAllContext(context.Background())
+}
 
-	return u.scanQueryResult(iter)
+//FindAllContext is a function for finding all user, returning the first page of the result, with ctx for cancellation and deadline
+func (u *User) FindAllContext(ctx context.Context) (*Page[*model.User], *errors.Error) {
+	return u.FindPageContext(ctx, "")
 }
 
-//NextPage is a function for getting the previous page query results of the previously executed 'select' query
-func (u *User) NextPage() ([]*model.User, *errors.Error, bool) {
-	if nil == u.pagedQuery {
-		return nil,  errors.Wrap(fmt.Errorf("Can't iterate next page, no query has been performed"), 0), true
+//FindPage is a function for finding the page of all user pointed by cursor (as returned in Page.NextCursor or Page.PreviousCursor) (see FindPageContext)
+func (u *User) FindPage(cursor string) (*Page[*model.User], *errors.Error) {
+	return u.FindPageContext(context.Background(), cursor)
+}
+
+//FindPageContext is a function for finding the page of all user pointed by cursor (as returned in Page.NextCursor or Page.PreviousCursor), with ctx for cancellation and deadline
+//An empty cursor points to the first page
+//Users marked as deleted are left out unless WithIncludeDeleted is set, so a page may hold less than the page size users
+func (u *User) FindPageContext(ctx context.Context, cursor string) (*Page[*model.User], *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	history, err := u.cursorCodec.decodeHistory(cursorQueryAll, cursor)
+	if err != nil {
+		return nil, err
 	}
-	temp := u.nextPageState
-	iter := u.pagedQuery.PageState(temp).PageSize(u.pageSize).Iter()
+	pageState := history[len(history)-1]
+	//Note: setting the page state (even a nil one) disables gocql automatic paging, so the iterator only fetches one page
+	iter := u.options.query(u.dbSession.Query(`SELECT ` + userColumns + `
+	FROM user`)).WithContext(ctx).PageState(pageState).PageSize(u.pageSize).Iter()
+	//the iterator page state becomes page state for next page (it is empty if this is the last page)
+	nextPageState := iter.PageState()
 
-	//check whether iter.PageState() is empty, if it is empty then we have reached the last page
-	if len(iter.PageState()) == 0 {
-		//reset properties
-		u.nextPageState = nil
-		u.pagedQuery = nil
+	userList, err := u.scanQueryResult(iter)
+	if err != nil {
+		return nil, err
+	}
+	return newPage(u.cursorCodec, cursorQueryAll, u.visible(userList), history, nextPageState), nil
+}
 
-		modelSlice, err := u.scanQueryResult(iter)
-		return modelSlice, err, true
+//visible is a function for returning the users of userList that are not left out of the found records (see WithIncludeDeleted)
+func (u *User) visible(userList []*model.User) []*model.User {
+	var visibleList []*model.User
+	for _, userModel := range userList {
+		if !u.options.excludes(userModel) {
+			visibleList = append(visibleList, userModel)
+		}
 	}
-	//else we still have more pages to iterate
-	//the iterator page state becomes page state for the next page
-	u.nextPageState = iter.PageState()
-	modelSlice, err := u.scanQueryResult(iter)
-	return modelSlice, err, false 
+	return visibleList
 }
 
 //scanQueryResult is a function for scanning records to model objects from an iterator of query result
@@ -107,16 +284,7 @@ func (u *User) scanQueryResult(iter *gocql.Iter) ([]*model.User, *errors.Error)
 
 	for done == false {
 		userModel := model.User{}
-		ok := iter.Scan(
-			&userModel.Email,
-			&userModel.Password,
-			&userModel.Name,
-			&userModel.Status,
-			&userModel.LastActivity,
-			&userModel.AuthToken,
-			&userModel.GoogleToken,
-			&userModel.FacebookToken,
-		)
+		ok := iter.Scan(userScanDest(&userModel)...)
 		if ok {
 			userList = append(userList, &userModel)
 		} else {
@@ -126,15 +294,137 @@ func (u *User) scanQueryResult(iter *gocql.Iter) ([]*model.User, *errors.Error)
 	//close the iterator (to get any errors that occured during or after iteration)
 	//see: https://github.com/gocql/gocql/issues/57#issuecomment-25573670
 	if err := iter.Close(); err != nil {
-		return nil, errors.Wrap(err, 0)
+		return nil, wrapError(err)
 	}
 	return userList, nil
 }
 
-//Insert is a function for inserting new user
+//Insert is a function for inserting new user (see InsertContext)
 func (u *User) Insert(user *model.User) (bool, *errors.Error) {
+	return u.InsertContext(context.Background(), user)
+}
+
+//InsertContext is a function for inserting new user, with ctx for cancellation and deadline
+//It refuses to store a second user with the same email (even with another name, see claimEmail),
+//returning false and an ErrAlreadyExists error carrying the existing user (as Error.Current) instead
+//The user is stored with version 1 and the current time as creation time (user.Version and user.CreatedAt are set accordingly)
+//It returns false and an ErrInvalidInput error if the user is not valid (see model.User.Validate), its email being normalized beforehand
+//It returns false and an ErrAlreadyExists error carrying the other user if an identity of user is linked to another user (see Link)
+func (u *User) InsertContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	user.Normalize()
+	if err := validateUser(user, nil); err != nil {
+		return false, err
+	}
+	if err := u.checkIdentitiesNotLinked(ctx, user, nil); err != nil {
+		return false, err
+	}
+	user.CreatedAt = newCreatedAt()
+	if err := u.claimEmail(ctx, user, 1); err != nil {
+		return false, err
+	}
+	user.Version = 1
+	return true, u.syncLookups(ctx, nil, user)
+}
+
+//Upsert is a function for inserting a user, overwriting the existing user with the same primary key (user email and name) if any (see UpsertContext)
+func (u *User) Upsert(user *model.User) (bool, *errors.Error) {
+	return u.UpsertContext(context.Background(), user)
+}
+
+//UpsertContext is a function for inserting a user, overwriting the existing user with the same primary key (user email and name) if any, with ctx for cancellation and deadline
+//The version of user is not checked, the user is stored with the version following the stored one (1 for a new user),
+//user.Version being set accordingly, and with the creation time of the stored one (the current time for a new user, see Insert)
+//Note: the stored version is read before the write, so two concurrent upserts of the same user may store the same version
+//It returns false and an ErrInvalidInput error if the user is not valid (see model.User.Validate), its email being normalized beforehand,
+//or if its status can't change from the existing user status
+//It returns false and an ErrAlreadyExists error carrying the existing user if no user has the primary key but a user already has the email
+//(see claimEmail), or carrying the other user if an identity of user is linked to another user (see Link)
+func (u *User) UpsertContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
 
-	if err := u.dbSession.Query(`
+	user.Normalize()
+	previous, err := u.storedLookups(ctx, user.Email, user.Name)
+	if err != nil {
+		return false, err
+	}
+	if err := validateUser(user, previous); err != nil {
+		return false, err
+	}
+	if err := u.checkIdentitiesNotLinked(ctx, user, previous); err != nil {
+		return false, err
+	}
+	if previous == nil {
+		//same as Insert, a new user claims its email
+		user.CreatedAt = newCreatedAt()
+		if err := u.claimEmail(ctx, user, 1); err != nil {
+			return false, err
+		}
+		user.Version = 1
+		return true, u.syncLookups(ctx, nil, user)
+	}
+	user.CreatedAt = previous.CreatedAt
+	//the user and its auth token lookup are written together
+	batch := u.dbSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(insertStatement, insertValues(user, previous.Version+1)...)
+	addLookupSync(batch, previous, user)
+	if err := u.dbSession.ExecuteBatch(u.options.batch(batch)); err != nil {
+		return false, wrapError(err)
+	}
+	user.Version = previous.Version + 1
+	return true, nil
+}
+
+//claimEmail is a function for inserting user with version as the only user of its email, with a conditional batch claiming
+//the email (setting the email_owner static column of its partition to the user name) atomically with the insert
+//Note: the primary key is (user email, name), so 'IF NOT EXISTS' alone would accept a second user with the same email and another name
+//The claim of a user that doesn't exist anymore (deleted or moved by ChangeEmail) is stale, it is taken over provided it doesn't change
+//in between
+//It returns an ErrAlreadyExists error carrying the existing user if a user already has the email
+func (u *User) claimEmail(ctx context.Context, user *model.User, version int64) *errors.Error {
+	//an unclaimed email has a null owner
+	var owner interface{}
+	for attempt := 0; ; attempt++ {
+		batch := u.dbSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+		batch.Query(`
+			UPDATE user SET email_owner = ? WHERE user_email = ? IF email_owner = ?`,
+			user.Name,
+			user.Email,
+			owner)
+		batch.Query(insertStatement, insertValues(user, version)...)
+		existing := map[string]interface{}{}
+		applied, iter, batchErr := u.dbSession.MapExecuteBatchCAS(u.options.casBatch(batch), existing)
+		if iter != nil {
+			if closeErr := iter.Close(); batchErr == nil {
+				batchErr = closeErr
+			}
+		}
+		if batchErr != nil {
+			return wrapError(batchErr)
+		}
+		if applied {
+			return nil
+		}
+		current, err := u.findByEmail(ctx, user.Email)
+		if err == nil {
+			return newCurrentError(ErrAlreadyExists, current)
+		} else if !stderrors.Is(err, ErrNotFound) {
+			return err
+		}
+		staleOwner, _ := existing["email_owner"].(string)
+		if attempt > 0 || staleOwner == "" {
+			//the claim changed in between, the email is being claimed concurrently
+			return newError(ErrAlreadyExists, fmt.Errorf("email %v is already claimed", user.Email))
+		}
+		owner = staleOwner
+	}
+}
+
+//insertStatement is the statement for inserting user, bound with values returned by insertValues
+const insertStatement = `
 		INSERT INTO user (
 			user_email, 
 			password, 
@@ -142,9 +432,15 @@ func (u *User) Insert(user *model.User) (bool, *errors.Error) {
 			status, 
 			last_activity,
 			auth_token,
-			google_token,
-			facebook_token
-			 ) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			identities,
+			created_at,
+			deleted_at,
+			version
+			 ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+//insertValues is a function for returning the values of insertStatement for inserting user with version
+func insertValues(user *model.User, version int64) []interface{} {
+	return []interface{}{
 		user.Email,
 		user.Password,
 		user.Name,
@@ -155,27 +451,63 @@ func (u *User) Insert(user *model.User) (bool, *errors.Error) {
 		//and gocql always assumed the timezone to be UTC when loading timestamp data
 		user.LastActivity.UTC(),
 		user.AuthToken,
-		user.GoogleToken,
-		user.FacebookToken,
-	).Exec(); err != nil {
-		return false, errors.Wrap(err, 0)
+		identityRecords(user.Identities),
+		user.CreatedAt.UTC(),
+		user.DeletedAt.UTC(),
+		version,
 	}
-	return true, nil
 }
 
-//Update is a function for updating a user
+//newCreatedAt is a function for returning the creation time of a user being inserted, at the stored precision (see model.User.CreatedAt)
+func newCreatedAt() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+//Update is a function for updating a user (see UpdateContext)
 func (u *User) Update(user *model.User) (bool, *errors.Error) {
+	return u.UpdateContext(context.Background(), user)
+}
 
-	//Note: user_email and name cannot be updated since they are part of the primary key (fields part of primary key can't be updated in cassandra)
-	if err := u.dbSession.Query(`
+//UpdateContext is a function for updating a user, with ctx for cancellation and deadline
+//The update is only applied if the stored user still has the same version as user (optimistic concurrency control),
+//in which case the version is incremented (user.Version is incremented accordingly)
+//It returns false and an ErrConflict error carrying the latest stored user (as Error.Current) if the version is stale,
+//or false and an ErrNotFound error if the user doesn't exist
+//It returns false and an ErrInvalidInput error if the user is not valid (see model.User.Validate)
+//or if its status can't change from the stored user status (see model.UserStatusTransitions)
+//It returns false and an ErrAlreadyExists error carrying the other user if an identity of user is linked to another user (see Link)
+func (u *User) UpdateContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	//the looked up values are read beforehand for updating their lookups, it can't have changed in between if the version condition is met
+	previous, err := u.storedLookups(ctx, user.Email, user.Name)
+	if err != nil {
+		return false, err
+	}
+	//for the same reason the status transition is only checked against the stored status of the same version,
+	//the update is not applied otherwise
+	stored := previous
+	if previous != nil && previous.Version != user.Version {
+		stored = nil
+	}
+	if err := validateUser(user, stored); err != nil {
+		return false, err
+	}
+	if err := u.checkIdentitiesNotLinked(ctx, user, previous); err != nil {
+		return false, err
+	}
+	//Note: user_email and name cannot be updated since they are part of the primary key (fields part of primary key can't be updated in cassandra), use Rename for changing name
+	applied, queryErr := u.options.casQuery(u.dbSession.Query(`
 		UPDATE user SET
 			password = ?,
 			status = ?,
 			last_activity = ?,
 			auth_token = ?,
-			google_token = ?,
-			facebook_token = ?
-		WHERE user_email = ? AND name = ? IF EXISTS`,
+			identities = ?,
+			deleted_at = ?,
+			version = ?
+		WHERE user_email = ? AND name = ? IF version = ?`,
 		user.Password,
 		user.Status,
 		//Note: for consistency when saving and loading time data into/from cassandra,
@@ -184,29 +516,264 @@ func (u *User) Update(user *model.User) (bool, *errors.Error) {
 		//and gocql always assumed the timezone to be UTC when loading timestamp data
 		user.LastActivity.UTC(),
 		user.AuthToken,
-		user.GoogleToken,
-		user.FacebookToken,
+		identityRecords(user.Identities),
+		user.DeletedAt.UTC(),
+		user.Version+1,
 		user.Email,
-		user.Name).Exec(); err != nil {
-		return false, errors.Wrap(err, 0)
+		user.Name,
+		user.Version)).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if queryErr != nil {
+		return false, wrapError(queryErr)
 	}
-	//NOTE: there is no way to get affected rows of an update/delete query in cassandra
-	//see: https://stackoverflow.com/questions/28611459/how-to-know-affected-rows-in-cassandracql
-	//if the query was performed successfully without any problem, then consider query is successful
-	return true, nil
+	if !applied {
+		//the condition is not met either because the version is stale or because the user doesn't exist
+		return false, u.conflictError(ctx, user)
+	}
+	user.Version++
+	return true, u.syncLookups(ctx, previous, user)
+}
+
+//conflictError is a function for creating the error of a conditional write of user that was not applied,
+//an ErrConflict error carrying the latest stored user if it exists, an ErrNotFound error otherwise
+func (u *User) conflictError(ctx context.Context, user *model.User) *errors.Error {
+	current, err := u.findByKey(ctx, user.Email, user.Name)
+	if err != nil {
+		return err
+	}
+	return newCurrentError(ErrConflict, current)
+}
+
+//Rename is a function for changing the name of a user (see RenameContext)
+func (u *User) Rename(user *model.User, newName string) (bool, *errors.Error) {
+	return u.RenameContext(context.Background(), user, newName)
 }
 
-//Delete is a function for deleting user
+//RenameContext is a function for changing the name of a user, with ctx for cancellation and deadline
+//Since name is part of the primary key (and can't be updated), the user is moved to a new row with newName by a conditional
+//logged batch (deleting the current row and inserting the new one atomically), under the same optimistic concurrency control as Update
+//The status history of the user is moved to the new row afterwards (see StatusHistory), true is returned along with the error if that fails
+//It returns false and an ErrAlreadyExists error carrying the existing user if a user with newName already exists,
+//an ErrConflict error carrying the latest stored user if the version is stale, or an ErrNotFound error if the user doesn't exist
+//It returns false and an ErrInvalidInput error if the renamed user is not valid (e.g. newName is empty, see model.User.Validate)
+//On success user.Name is set to newName and user.Version is incremented
+func (u *User) RenameContext(ctx context.Context, user *model.User, newName string) (bool, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	if newName == user.Name {
+		return false, newError(ErrInvalidInput, fmt.Errorf("user %v is already named %v", user.Email, newName))
+	}
+	//the looked up values of the current row are read beforehand for moving their lookups to the new row
+	previous, err := u.storedLookups(ctx, user.Email, user.Name)
+	if err != nil {
+		return false, err
+	}
+	renamed := *user
+	renamed.Name = newName
+	//the creation time is kept, whatever the one of user
+	if previous != nil {
+		renamed.CreatedAt = previous.CreatedAt
+	}
+	//the renamed user is written as a whole, so it is validated the same way as by Update
+	stored := previous
+	if previous != nil && previous.Version != user.Version {
+		stored = nil
+	}
+	if err := validateUser(&renamed, stored); err != nil {
+		return false, err
+	}
+
+	//Note: conditional batches are only allowed within a single partition, which is the case since user_email is unchanged
+	batch := u.dbSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(`
+		DELETE FROM user
+		WHERE user_email = ? AND name = ? IF version = ?`,
+		user.Email,
+		user.Name,
+		user.Version)
+	batch.Query(insertStatement+` IF NOT EXISTS`, insertValues(&renamed, user.Version+1)...)
+	//the email claim follows the user (see claimEmail)
+	batch.Query(`
+		UPDATE user SET email_owner = ? WHERE user_email = ?`,
+		newName,
+		user.Email)
+
+	applied, iter, batchErr := u.dbSession.MapExecuteBatchCAS(u.options.casBatch(batch), map[string]interface{}{})
+	if iter != nil {
+		if closeErr := iter.Close(); batchErr == nil {
+			batchErr = closeErr
+		}
+	}
+	if batchErr != nil {
+		return false, wrapError(batchErr)
+	}
+	if !applied {
+		//find out which condition was not met
+		if existing, err := u.findByKey(ctx, user.Email, newName); err == nil {
+			return false, newCurrentError(ErrAlreadyExists, existing)
+		}
+		return false, u.conflictError(ctx, user)
+	}
+	oldName := user.Name
+	user.Name = newName
+	user.CreatedAt = renamed.CreatedAt
+	user.Version++
+	if err := u.syncLookups(ctx, previous, user); err != nil {
+		return true, err
+	}
+	return true, u.moveStatusHistory(ctx, user.Email, oldName, user.Email, newName)
+}
+
+//ChangeEmail is a function for changing the email of a user (see ChangeEmailContext)
+func (u *User) ChangeEmail(user *model.User, newEmail string) (bool, *errors.Error) {
+	return u.ChangeEmailContext(context.Background(), user, newEmail)
+}
+
+//ChangeEmailContext is a function for changing the email of a user, with ctx for cancellation and deadline
+//Since user_email is the partition key, the user is moved to a new partition and a redirect from the old email to the new one
+//is stored so that old references still resolve (see FindByID), under the same optimistic concurrency control as Update
+//Note: cassandra can't apply conditions across partitions, so the move is performed in steps (claiming the new email, storing the redirect,
+//then conditionally deleting the old row) and the previous steps are reverted if a later one is not applied
+//The status history of the user is moved to the new email afterwards (see StatusHistory), true is returned along with the error if that fails
+//It returns false and an ErrAlreadyExists error carrying the existing user if a user with newEmail already exists,
+//an ErrConflict error carrying the latest stored user if the version is stale, an ErrNotFound error if the user doesn't exist,
+//or an ErrInvalidInput error if newEmail is malformed
+//On success user.Email is set to newEmail (in its canonical form, see model.NormalizeEmail) and user.Version is incremented
+func (u *User) ChangeEmailContext(ctx context.Context, user *model.User, newEmail string) (bool, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	newEmail, err := normalizeEmail(newEmail)
+	if err != nil {
+		return false, err
+	}
+	if newEmail == user.Email {
+		return false, newError(ErrInvalidInput, fmt.Errorf("user %v already has email %v", user.Email, newEmail))
+	}
+	//the looked up values of the current row are read beforehand for moving their lookups to the new row
+	previous, err := u.storedLookups(ctx, user.Email, user.Name)
+	if err != nil {
+		return false, err
+	}
+	moved := *user
+	moved.Email = newEmail
+	//the creation time is kept, whatever the one of user
+	if previous != nil {
+		moved.CreatedAt = previous.CreatedAt
+	}
+
+	//claim the new email
+	if err := u.claimEmail(ctx, &moved, user.Version+1); err != nil {
+		return false, err
+	}
+
+	//store the redirect, any redirect of the new email is obsolete since it now belongs to this user
+	batch := u.dbSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(`
+		INSERT INTO user_email_redirect (old_email, new_email, changed_at) VALUES (?, ?, ?)`,
+		user.Email,
+		newEmail,
+		time.Now().UTC())
+	batch.Query(`
+		INSERT INTO user_email_redirect_by_new (new_email, old_email) VALUES (?, ?)`,
+		newEmail,
+		user.Email)
+	batch.Query(`
+		DELETE FROM user_email_redirect WHERE old_email = ?`,
+		newEmail)
+	addLookupSync(batch, previous, &moved)
+	if err := u.dbSession.ExecuteBatch(u.options.batch(batch)); err != nil {
+		return false, u.revertEmailChange(&moved, user.Email, previous, wrapError(err))
+	}
+
+	//remove the old row, provided it has not been modified in the meantime
+	applied, queryErr := u.options.casQuery(u.dbSession.Query(`
+		DELETE FROM user
+		WHERE user_email = ? AND name = ? IF version = ?`,
+		user.Email,
+		user.Name,
+		user.Version)).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if queryErr != nil {
+		return false, u.revertEmailChange(&moved, user.Email, previous, wrapError(queryErr))
+	}
+	if !applied {
+		return false, u.revertEmailChange(&moved, user.Email, previous, u.conflictError(ctx, user))
+	}
+	oldEmail := user.Email
+	user.Email = newEmail
+	user.CreatedAt = moved.CreatedAt
+	user.Version++
+	return true, u.moveStatusHistory(ctx, oldEmail, user.Name, newEmail, user.Name)
+}
+
+//revertEmailChange is a function for reverting a failed email change of the user moved from oldEmail, returning cause
+//(or the revert error if the revert fails as well), the lookups being pointed back to previous (the looked up values of the user
+//stored with oldEmail, nil if none)
+//Note: the revert doesn't use the context of the email change, since the change may have failed because the context is done
+func (u *User) revertEmailChange(moved *model.User, oldEmail string, previous *model.User, cause *errors.Error) *errors.Error {
+	batch := u.dbSession.NewBatch(gocql.LoggedBatch)
+	batch.Query(`
+		DELETE FROM user WHERE user_email = ? AND name = ?`,
+		moved.Email,
+		moved.Name)
+	batch.Query(`
+		DELETE FROM user_email_redirect WHERE old_email = ?`,
+		oldEmail)
+	batch.Query(`
+		DELETE FROM user_email_redirect_by_new WHERE new_email = ? AND old_email = ?`,
+		moved.Email,
+		oldEmail)
+	addLookupSync(batch, moved, previous)
+	if err := u.dbSession.ExecuteBatch(u.options.batch(batch)); err != nil {
+		return errors.WrapPrefix(err, "failed to revert email change after: "+cause.Error(), 0)
+	}
+	return cause
+}
+
+//Delete is a function for deleting user (see DeleteContext)
 func (u *User) Delete(user *model.User) (bool, *errors.Error) {
-	if err := u.dbSession.Query(`
+	return u.DeleteContext(context.Background(), user)
+}
+
+//DeleteContext is a function for deleting user, with ctx for cancellation and deadline
+//If WithSoftDelete is set, the user is marked as deleted instead (see softDelete)
+//It returns false and an ErrNotFound error if the user doesn't exist
+func (u *User) DeleteContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	previous, err := u.storedLookups(ctx, user.Email, user.Name)
+	if err != nil {
+		return false, err
+	}
+	if u.options.softDelete {
+		return u.softDelete(ctx, user, previous)
+	}
+	query := u.options.casQuery(u.dbSession.Query(`
 		DELETE FROM user 
 		WHERE user_email = ? AND name = ? IF EXISTS`,
 		user.Email,
-		user.Name).Exec(); err != nil {
-		return false, errors.Wrap(err, 0)
+		user.Name)).WithContext(ctx)
+
+	applied, err := execCAS(query)
+	if !applied {
+		return false, err
 	}
-	//NOTE: there is no way to get affected rows of an update/delete query in cassandra
+	return true, u.syncLookups(ctx, previous, nil)
+}
+
+//execCAS is a function for executing a lightweight transaction query with 'IF EXISTS' condition,
+//returning false and an ErrNotFound error if it was not applied because the record doesn't exist
+func execCAS(query *gocql.Query) (bool, *errors.Error) {
+	//NOTE: there is no way to get affected rows of an update/delete query in cassandra,
+	//but lightweight transactions return an '[applied]' column telling whether the condition was met
 	//see: https://stackoverflow.com/questions/28611459/how-to-know-affected-rows-in-cassandracql
-	//if the query was performed successfully without any problem, then consider query is successful
+	applied, err := query.MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, wrapError(err)
+	}
+	if !applied {
+		return false, newError(ErrNotFound, nil)
+	}
 	return true, nil
 }
@@ -0,0 +1,145 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	"fmt"
+	"testtrx/model"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+//Note: when soft delete is set (see WithSoftDelete), deleted users are kept with model.UserStatusDeleted status and their deletion time,
+//they are left out of the found users (unless WithIncludeDeleted is set) until they are restored or purged
+
+//softDelete is a function for marking user as deleted, previous being its stored looked up values (nil if it doesn't exist)
+//It returns false and an ErrNotFound error if the user doesn't exist or is already marked as deleted,
+//or an ErrConflict error carrying the latest stored user if the user is modified concurrently
+//On success user.Status, user.DeletedAt and user.Version are set to the stored ones
+func (u *User) softDelete(ctx context.Context, user *model.User, previous *model.User) (bool, *errors.Error) {
+	if previous == nil || previous.Status == model.UserStatusDeleted {
+		return false, newError(ErrNotFound, nil)
+	}
+	deletedAt := time.Now()
+	//Note: the deletion doesn't depend on user version (same as a hard delete), only on the stored user not changing in between
+	applied, queryErr := u.options.casQuery(u.dbSession.Query(`
+		UPDATE user SET
+			status = ?,
+			deleted_at = ?,
+			version = ?
+		WHERE user_email = ? AND name = ? IF version = ?`,
+		model.UserStatusDeleted,
+		deletedAt.UTC(),
+		previous.Version+1,
+		user.Email,
+		user.Name,
+		previous.Version)).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if queryErr != nil {
+		return false, wrapError(queryErr)
+	}
+	if !applied {
+		return false, u.conflictError(ctx, user)
+	}
+	user.Status = model.UserStatusDeleted
+	user.DeletedAt = deletedAt
+	user.Version = previous.Version + 1
+	deleted := *previous
+	deleted.Status = model.UserStatusDeleted
+	return true, u.syncLookups(ctx, previous, &deleted)
+}
+
+//Restore is a function for restoring a user marked as deleted (see RestoreContext)
+func (u *User) Restore(user *model.User) (bool, *errors.Error) {
+	return u.RestoreContext(context.Background(), user)
+}
+
+//RestoreContext is a function for restoring a user marked as deleted (see WithSoftDelete) as an inactive user (see model.UserStatusTransitions),
+//with ctx for cancellation and deadline
+//The user is restored under the same optimistic concurrency control as Update
+//It returns false and an ErrInvalidInput error if the user is not marked as deleted, an ErrConflict error carrying the latest stored user
+//if the version is stale, or an ErrNotFound error if the user doesn't exist (e.g. it has been purged)
+//On success user.Status is set to model.UserStatusInactive, user.DeletedAt is cleared and user.Version is incremented
+func (u *User) RestoreContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	previous, err := u.storedLookups(ctx, user.Email, user.Name)
+	if err != nil {
+		return false, err
+	}
+	if previous == nil {
+		return false, newError(ErrNotFound, nil)
+	}
+	if previous.Status != model.UserStatusDeleted {
+		return false, newError(ErrInvalidInput, fmt.Errorf("user %v is not deleted", user.Email))
+	}
+	applied, queryErr := u.options.casQuery(u.dbSession.Query(`
+		UPDATE user SET
+			status = ?,
+			deleted_at = null,
+			version = ?
+		WHERE user_email = ? AND name = ? IF version = ?`,
+		model.UserStatusInactive,
+		user.Version+1,
+		user.Email,
+		user.Name,
+		user.Version)).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if queryErr != nil {
+		return false, wrapError(queryErr)
+	}
+	if !applied {
+		return false, u.conflictError(ctx, user)
+	}
+	user.Status = model.UserStatusInactive
+	user.DeletedAt = time.Time{}
+	user.Version++
+	restored := *previous
+	restored.Status = model.UserStatusInactive
+	return true, u.syncLookups(ctx, previous, &restored)
+}
+
+//Purge is a function for removing the users marked as deleted for longer than retention (see PurgeContext)
+func (u *User) Purge(retention time.Duration) (int, *errors.Error) {
+	return u.PurgeContext(context.Background(), retention)
+}
+
+//PurgeContext is a function for removing the users marked as deleted for longer than retention, returning the number of removed users,
+//with ctx for cancellation and deadline
+//Users marked as deleted without deletion time (e.g. by Update) and users modified while being purged are left
+func (u *User) PurgeContext(ctx context.Context, retention time.Duration) (int, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	deletedBefore := time.Now().Add(-retention)
+	purged := 0
+	for cursor, first := "", true; first || cursor != ""; first = false {
+		page, err := u.FindByStatusContext(ctx, model.UserStatusDeleted, cursor)
+		if err != nil {
+			return purged, err
+		}
+		for _, deleted := range page.Items {
+			if deleted.DeletedAt.IsZero() || deleted.DeletedAt.After(deletedBefore) {
+				continue
+			}
+			applied, err := u.options.casQuery(u.dbSession.Query(`
+				DELETE FROM user
+				WHERE user_email = ? AND name = ? IF version = ?`,
+				deleted.Email,
+				deleted.Name,
+				deleted.Version)).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+			if err != nil {
+				return purged, wrapError(err)
+			}
+			if !applied {
+				continue
+			}
+			purged++
+			if err := u.syncLookups(ctx, deleted, nil); err != nil {
+				return purged, err
+			}
+		}
+		cursor = page.NextCursor
+	}
+	return purged, nil
+}
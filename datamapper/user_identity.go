@@ -0,0 +1,248 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"testtrx/model"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//Note: the identities linked to a user are stored in the identities column of user, a map of user_identity values keyed by provider,
+//so that supporting a new identity provider doesn't require any schema change
+
+//identityRecord is a struct of a user_identity value, the cql tags being the names of its fields
+type identityRecord struct {
+	Subject      string    `cql:"subject"`
+	AccessToken  string    `cql:"access_token"`
+	RefreshToken string    `cql:"refresh_token"`
+	ExpiresAt    time.Time `cql:"expires_at"`
+	LinkedAt     time.Time `cql:"linked_at"`
+}
+
+//identityRecords is a function for converting identities to the values of the identities column
+func identityRecords(identities map[string]model.Identity) map[string]identityRecord {
+	records := make(map[string]identityRecord, len(identities))
+	for provider, identity := range identities {
+		records[provider] = newIdentityRecord(identity)
+	}
+	return records
+}
+
+//newIdentityRecord is a function for converting identity to a user_identity value
+func newIdentityRecord(identity model.Identity) identityRecord {
+	return identityRecord{
+		Subject:      identity.Subject,
+		AccessToken:  identity.AccessToken,
+		RefreshToken: identity.RefreshToken,
+		//Note: same as user last activity, times are converted to UTC prior to saving them in gocql
+		ExpiresAt: identity.ExpiresAt.UTC(),
+		LinkedAt:  identity.LinkedAt.UTC(),
+	}
+}
+
+//identitiesColumn is a struct of scan destination of the identities column, loading it into the identities of a user model
+type identitiesColumn struct {
+	identities *map[string]model.Identity
+}
+
+//UnmarshalCQL is a function for loading a value of the identities column (implementing gocql.Unmarshaler)
+func (c *identitiesColumn) UnmarshalCQL(info gocql.TypeInfo, data []byte) error {
+	var records map[string]identityRecord
+	if err := gocql.Unmarshal(info, data, &records); err != nil {
+		return err
+	}
+	//Note: cassandra doesn't distinguish an empty map from a null one, both are loaded as nil
+	*c.identities = nil
+	for provider, record := range records {
+		if *c.identities == nil {
+			*c.identities = map[string]model.Identity{}
+		}
+		(*c.identities)[provider] = model.Identity{
+			Provider:     provider,
+			Subject:      record.Subject,
+			AccessToken:  record.AccessToken,
+			RefreshToken: record.RefreshToken,
+			ExpiresAt:    record.ExpiresAt,
+			LinkedAt:     record.LinkedAt,
+		}
+	}
+	return nil
+}
+
+//Link is a function for linking an identity at an external identity provider to a user (see LinkContext)
+func (u *User) Link(user *model.User, identity model.Identity) (bool, *errors.Error) {
+	return u.LinkContext(context.Background(), user, identity)
+}
+
+//LinkContext is a function for linking an identity at an external identity provider to a user, replacing the identity of the user
+//at the same provider if any, with ctx for cancellation and deadline
+//The identity is linked under the same optimistic concurrency control as Update, LinkedAt is set to the current time if it is zero
+//It returns false and an ErrAlreadyExists error carrying the user the identity is linked to if it is linked to another user,
+//an ErrConflict error carrying the latest stored user if the version is stale, or an ErrNotFound error if the user doesn't exist
+//On success the identity is set in user.Identities and user.Version is incremented
+//Note: the check of the identity being linked to another user is not atomic with the link, two users linking the same identity
+//concurrently may both succeed (FindByProvider then finds the last one)
+func (u *User) LinkContext(ctx context.Context, user *model.User, identity model.Identity) (bool, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	if err := validateIdentity(identity); err != nil {
+		return false, err
+	}
+	if err := u.checkNotLinked(ctx, user, identity); err != nil {
+		return false, err
+	}
+	if identity.LinkedAt.IsZero() {
+		identity.LinkedAt = time.Now()
+	}
+	previous, err := u.storedLookups(ctx, user.Email, user.Name)
+	if err != nil {
+		return false, err
+	}
+	if previous == nil {
+		//the user doesn't exist, which the condition below reports
+		previous = &model.User{Email: user.Email, Name: user.Name}
+	}
+	applied, queryErr := u.options.casQuery(u.dbSession.Query(`
+		UPDATE user SET
+			identities[?] = ?,
+			version = ?
+		WHERE user_email = ? AND name = ? IF version = ?`,
+		identity.Provider,
+		newIdentityRecord(identity),
+		user.Version+1,
+		user.Email,
+		user.Name,
+		user.Version)).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if queryErr != nil {
+		return false, wrapError(queryErr)
+	}
+	if !applied {
+		return false, u.conflictError(ctx, user)
+	}
+	user.Identities = withIdentity(user.Identities, identity)
+	user.Version++
+	//the condition being met, previous is the stored user the identity has been linked to
+	linked := *previous
+	linked.Identities = withIdentity(previous.Identities, identity)
+	return true, u.syncLookups(ctx, previous, &linked)
+}
+
+//Unlink is a function for unlinking the identity at an external identity provider from a user (see UnlinkContext)
+func (u *User) Unlink(user *model.User, provider string) (bool, *errors.Error) {
+	return u.UnlinkContext(context.Background(), user, provider)
+}
+
+//UnlinkContext is a function for unlinking the identity at an external identity provider (e.g. model.ProviderGoogle) from a user,
+//with ctx for cancellation and deadline
+//The identity is unlinked under the same optimistic concurrency control as Update
+//It returns false and an ErrNotFound error if the user doesn't exist or has no identity linked at provider,
+//or an ErrConflict error carrying the latest stored user if the version is stale
+//On success the identity is removed from user.Identities and user.Version is incremented
+func (u *User) UnlinkContext(ctx context.Context, user *model.User, provider string) (bool, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	if provider == "" {
+		return false, newError(ErrInvalidInput, fmt.Errorf("empty provider"))
+	}
+	previous, err := u.storedLookups(ctx, user.Email, user.Name)
+	if err != nil {
+		return false, err
+	}
+	if previous == nil {
+		return false, newError(ErrNotFound, nil)
+	}
+	if _, ok := previous.Identities[provider]; !ok {
+		return false, newError(ErrNotFound, fmt.Errorf("user %v has no identity linked at %v", user.Email, provider))
+	}
+	applied, queryErr := u.options.casQuery(u.dbSession.Query(`
+		UPDATE user SET
+			identities = identities - ?,
+			version = ?
+		WHERE user_email = ? AND name = ? IF version = ?`,
+		[]string{provider},
+		user.Version+1,
+		user.Email,
+		user.Name,
+		user.Version)).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if queryErr != nil {
+		return false, wrapError(queryErr)
+	}
+	if !applied {
+		return false, u.conflictError(ctx, user)
+	}
+	user.Identities = withoutIdentity(user.Identities, provider)
+	user.Version++
+	unlinked := *previous
+	unlinked.Identities = withoutIdentity(previous.Identities, provider)
+	return true, u.syncLookups(ctx, previous, &unlinked)
+}
+
+//checkNotLinked is a function for checking that identity is not linked to another user than user,
+//returning an ErrAlreadyExists error carrying the other user if it is
+func (u *User) checkNotLinked(ctx context.Context, user *model.User, identity model.Identity) *errors.Error {
+	//Note: an identity linked to a user marked as deleted is kept for the user to be restored
+	linked, err := u.With(WithIncludeDeleted(true)).FindByProviderContext(ctx, identity.Provider, identity.Subject)
+	if stderrors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if linked.Email != user.Email || linked.Name != user.Name {
+		return newCurrentError(ErrAlreadyExists, linked)
+	}
+	return nil
+}
+
+//checkIdentitiesNotLinked is a function for checking that the identities of user are not linked to another user (see checkNotLinked),
+//previous being its stored looked up values (nil if none or unknown) whose unchanged identities are not checked again
+func (u *User) checkIdentitiesNotLinked(ctx context.Context, user *model.User, previous *model.User) *errors.Error {
+	for provider, identity := range user.Identities {
+		if previous != nil && previous.ExternalIdentities()[provider] == identity.Subject {
+			continue
+		}
+		if err := u.checkNotLinked(ctx, user, model.Identity{Provider: provider, Subject: identity.Subject}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//validateIdentity is a function for checking that identity has a provider and a subject
+func validateIdentity(identity model.Identity) *errors.Error {
+	if identity.Provider == "" || identity.Subject == "" {
+		return newError(ErrInvalidInput, fmt.Errorf("empty provider or subject"))
+	}
+	return nil
+}
+
+//withIdentity is a function for returning a copy of identities with identity set at its provider
+func withIdentity(identities map[string]model.Identity, identity model.Identity) map[string]model.Identity {
+	identitiesCopy := make(map[string]model.Identity, len(identities)+1)
+	for provider, linked := range identities {
+		identitiesCopy[provider] = linked
+	}
+	identitiesCopy[identity.Provider] = identity
+	return identitiesCopy
+}
+
+//withoutIdentity is a function for returning a copy of identities without the identity at provider (nil if none is left)
+func withoutIdentity(identities map[string]model.Identity, provider string) map[string]model.Identity {
+	var identitiesCopy map[string]model.Identity
+	for linkedProvider, linked := range identities {
+		if linkedProvider == provider {
+			continue
+		}
+		if identitiesCopy == nil {
+			identitiesCopy = map[string]model.Identity{}
+		}
+		identitiesCopy[linkedProvider] = linked
+	}
+	return identitiesCopy
+}
@@ -0,0 +1,158 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"testtrx/model"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//Note: users are looked up by other values than their primary key through lookup tables (the value to user primary key),
+//user_by_auth_token, user_by_external_identity and user_by_status (see user_status.go), which are updated after every write of a user
+//User writes are lightweight transactions, which can't be batched with writes to other tables, so lookups are updated by
+//a separate logged batch once the user is written (a write returning true with an error means the lookups could not be updated),
+//lookups are checked against the user so that a stale lookup never resolves
+
+//FindByAuthToken is a function for finding an user by auth token (see FindByAuthTokenContext)
+func (u *User) FindByAuthToken(token string) (*model.User, *errors.Error) {
+	return u.FindByAuthTokenContext(context.Background(), token)
+}
+
+//FindByAuthTokenContext is a function for finding an user by auth token, with ctx for cancellation and deadline
+//A user marked as deleted is not found, unless WithIncludeDeleted is set
+func (u *User) FindByAuthTokenContext(ctx context.Context, token string) (*model.User, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	if token == "" {
+		return nil, newError(ErrInvalidInput, fmt.Errorf("empty auth token"))
+	}
+	var email, name string
+	if err := u.options.query(u.dbSession.Query(`SELECT user_email, name
+			FROM user_by_auth_token
+			WHERE auth_token = ?`, token)).
+		WithContext(ctx).
+		Scan(&email, &name); err != nil {
+		return nil, wrapError(err)
+	}
+	return u.findLookedUp(ctx, email, name, func(user *model.User) bool { return user.AuthToken == token && !u.options.excludes(user) })
+}
+
+//FindByProvider is a function for finding an user by its identity at an external identity provider (see FindByProviderContext)
+func (u *User) FindByProvider(provider, subject string) (*model.User, *errors.Error) {
+	return u.FindByProviderContext(context.Background(), provider, subject)
+}
+
+//FindByProviderContext is a function for finding an user by its identity at an external identity provider (e.g. model.ProviderGoogle),
+//subject being the user identifier at the provider, with ctx for cancellation and deadline
+//A user marked as deleted is not found, unless WithIncludeDeleted is set
+func (u *User) FindByProviderContext(ctx context.Context, provider, subject string) (*model.User, *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	if provider == "" || subject == "" {
+		return nil, newError(ErrInvalidInput, fmt.Errorf("empty provider or subject"))
+	}
+	var email, name string
+	if err := u.options.query(u.dbSession.Query(`SELECT user_email, name
+			FROM user_by_external_identity
+			WHERE provider = ? AND subject = ?`, provider, subject)).
+		WithContext(ctx).
+		Scan(&email, &name); err != nil {
+		return nil, wrapError(err)
+	}
+	return u.findLookedUp(ctx, email, name, func(user *model.User) bool {
+		return user.ExternalIdentities()[provider] == subject && !u.options.excludes(user)
+	})
+}
+
+//findLookedUp is a function for finding the user with email and name found in a lookup table, matches checking that the lookup is not stale
+func (u *User) findLookedUp(ctx context.Context, email, name string, matches func(user *model.User) bool) (*model.User, *errors.Error) {
+	userModel, err := u.findByKey(ctx, email, name)
+	if err != nil {
+		return nil, err
+	}
+	if !matches(userModel) {
+		//the lookup is stale (e.g. the token has been changed)
+		return nil, newError(ErrNotFound, gocql.ErrNotFound)
+	}
+	return userModel, nil
+}
+
+//storedLookups is a function for reading the looked up values (and the version and creation time) stored for the user with email and name (nil if the user doesn't exist)
+func (u *User) storedLookups(ctx context.Context, email, name string) (*model.User, *errors.Error) {
+	stored := model.User{Email: email, Name: name}
+	err := u.options.query(u.dbSession.Query(`SELECT status, auth_token, identities, created_at, version
+			FROM user
+			WHERE user_email = ? AND name = ?`, email, name)).
+		WithContext(ctx).
+		Scan(&stored.Status, &stored.AuthToken, &identitiesColumn{&stored.Identities}, &stored.CreatedAt, &stored.Version)
+	if stderrors.Is(err, gocql.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, wrapError(err)
+	}
+	return &stored, nil
+}
+
+//syncLookups is a function for updating the lookups of user (nil if it has been deleted) with a logged batch,
+//removing the lookups of the values of previous (the user stored before the write, nil if none) that changed
+func (u *User) syncLookups(ctx context.Context, previous *model.User, user *model.User) *errors.Error {
+	batch := u.dbSession.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	addLookupSync(batch, previous, user)
+	if batch.Size() == 0 {
+		return nil
+	}
+	if err := u.dbSession.ExecuteBatch(u.options.batch(batch)); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+//addLookupSync is a function for adding to batch the statements updating the lookups of user (nil if it has been deleted),
+//removing the lookups of the values of previous (nil if none) that changed
+//Note: lookups of unchanged values are written again, so that they point to the current primary key of user
+func addLookupSync(batch *gocql.Batch, previous *model.User, user *model.User) {
+	addStatusSync(batch, previous, user)
+
+	current := &model.User{}
+	if user != nil {
+		current = user
+	}
+	if previous != nil && previous.AuthToken != "" && previous.AuthToken != current.AuthToken {
+		batch.Query(`
+			DELETE FROM user_by_auth_token WHERE auth_token = ?`,
+			previous.AuthToken)
+	}
+	if current.AuthToken != "" {
+		batch.Query(`
+			INSERT INTO user_by_auth_token (auth_token, user_email, name) VALUES (?, ?, ?)`,
+			current.AuthToken,
+			current.Email,
+			current.Name)
+	}
+
+	identities := current.ExternalIdentities()
+	if previous != nil {
+		for provider, subject := range previous.ExternalIdentities() {
+			if identities[provider] != subject {
+				batch.Query(`
+					DELETE FROM user_by_external_identity WHERE provider = ? AND subject = ?`,
+					provider,
+					subject)
+			}
+		}
+	}
+	for provider, subject := range identities {
+		batch.Query(`
+			INSERT INTO user_by_external_identity (provider, subject, user_email, name) VALUES (?, ?, ?, ?)`,
+			provider,
+			subject,
+			current.Email,
+			current.Name)
+	}
+}
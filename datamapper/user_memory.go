@@ -0,0 +1,802 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testtrx/model"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//MemoryUser is a struct of in-memory datamapper for user domain model
+//It behaves the same way as the cassandra backed User datamapper (including its primary key of user email and name),
+//and is safe for concurrent use, which makes it suitable for tests that don't need a running cluster
+//Note: operations don't block, so the context of the Context methods is only checked before running them
+type MemoryUser struct {
+	mutex       *sync.RWMutex                     //guards all fields below, shared with the copies returned by With
+	rows        map[string]map[string]*model.User //stored users, keyed by user email (partition key) then name (clustering key)
+	redirects   map[string]string                 //email change redirects, new email keyed by old email
+	history     *MemoryStatusHistory              //status history moved along with the users (see StatusHistory)
+	pageSize    int                               //size of page (no of records per page) for query result paging
+	cursorCodec CursorCodec                       //codec for encoding/decoding page states of result paging into cursors
+	options     queryOptions                      //options of the datamapper, only soft delete options apply
+}
+
+//make sure MemoryUser satisfies the UserMapper interface
+var _ UserMapper = (*MemoryUser)(nil)
+
+//NewMemoryUser is a function for initializing a new in-memory user datamapper
+func NewMemoryUser() *MemoryUser {
+	//Note: pageSize defaults to 10 (same as User datamapper)
+	return &MemoryUser{mutex: &sync.RWMutex{}, rows: map[string]map[string]*model.User{}, redirects: map[string]string{},
+		history: NewMemoryStatusHistory(), pageSize: 10}
+}
+
+//StatusHistory is a function for returning the status history datamapper of the stored users
+//Same as the cassandra backed datamappers sharing a keyspace, the history is moved along with the users on Rename and ChangeEmail
+func (m *MemoryUser) StatusHistory() *MemoryStatusHistory {
+	return m.history
+}
+
+//SetPageSize is a function for setting query result page size (no of records perpage)
+func (m *MemoryUser) SetPageSize(size int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pageSize = size
+}
+
+//SetCursorSecret is a function for setting the secret key used for signing page cursors (cursors are not signed if secret is empty)
+func (m *MemoryUser) SetCursorSecret(secret []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.cursorCodec = NewCursorCodec(secret)
+}
+
+//With is a function for returning a copy of the datamapper (sharing its stored users) with its options overridden by opts
+//Note: only soft delete options (WithSoftDelete and WithIncludeDeleted) apply to the in-memory datamapper
+func (m *MemoryUser) With(opts ...Option) UserMapper {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	memoryCopy := *m
+	memoryCopy.options = m.options.with(opts)
+	return &memoryCopy
+}
+
+//FindByID is a function for finding an user by id (see FindByIDContext)
+func (m *MemoryUser) FindByID(id string) (*model.User, *errors.Error) {
+	return m.FindByIDContext(context.Background(), id)
+}
+
+//FindByIDContext is a function for finding an user by id, with ctx for cancellation and deadline
+//If no user has the email id but its email was changed (see ChangeEmail), the user is found by following the redirect
+//to the new email, in which case the returned user's Email differs from id
+//A well formed id is normalized first (see model.NormalizeEmail), so a user is found whatever the case of its email domain,
+//falling back to id as is if no user is found (e.g. a user stored before emails were normalized)
+func (m *MemoryUser) FindByIDContext(ctx context.Context, id string) (*model.User, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	email := findEmail(id)
+	userModel := m.findRedirected(email)
+	if email != id && userModel == nil {
+		userModel = m.findRedirected(id)
+	}
+	if userModel == nil || m.options.excludes(userModel) {
+		//mimic gocql behaviour of a 'select' query with no result
+		return nil, newError(ErrNotFound, gocql.ErrNotFound)
+	}
+	return userModel, nil
+}
+
+//findRedirected is a function for finding a copy of the user of email, following the redirects of changed emails, nil if none
+//Note: caller must hold the lock
+func (m *MemoryUser) findRedirected(email string) *model.User {
+	for redirects := 0; len(m.rows[email]) == 0; redirects++ {
+		newEmail, ok := m.redirects[email]
+		if !ok || redirects == maxEmailRedirects {
+			return nil
+		}
+		email = newEmail
+	}
+	return m.first(email)
+}
+
+//FindByAuthToken is a function for finding an user by auth token (see FindByAuthTokenContext)
+func (m *MemoryUser) FindByAuthToken(token string) (*model.User, *errors.Error) {
+	return m.FindByAuthTokenContext(context.Background(), token)
+}
+
+//FindByAuthTokenContext is a function for finding an user by auth token, with ctx for cancellation and deadline
+func (m *MemoryUser) FindByAuthTokenContext(ctx context.Context, token string) (*model.User, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	if token == "" {
+		return nil, newError(ErrInvalidInput, fmt.Errorf("empty auth token"))
+	}
+	return m.find(func(user *model.User) bool { return user.AuthToken == token && !m.options.excludes(user) })
+}
+
+//FindByProvider is a function for finding an user by its identity at an external identity provider (see FindByProviderContext)
+func (m *MemoryUser) FindByProvider(provider, subject string) (*model.User, *errors.Error) {
+	return m.FindByProviderContext(context.Background(), provider, subject)
+}
+
+//FindByProviderContext is a function for finding an user by its identity at an external identity provider (e.g. model.ProviderGoogle),
+//subject being the user identifier at the provider, with ctx for cancellation and deadline
+func (m *MemoryUser) FindByProviderContext(ctx context.Context, provider, subject string) (*model.User, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	if provider == "" || subject == "" {
+		return nil, newError(ErrInvalidInput, fmt.Errorf("empty provider or subject"))
+	}
+	return m.find(func(user *model.User) bool {
+		return user.ExternalIdentities()[provider] == subject && !m.options.excludes(user)
+	})
+}
+
+//find is a function for finding the user matching a condition (same as a lookup table, at most one user is expected to match)
+func (m *MemoryUser) find(matches func(user *model.User) bool) (*model.User, *errors.Error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, partition := range m.rows {
+		for _, user := range partition {
+			if matches(user) {
+				return copyUser(user), nil
+			}
+		}
+	}
+	return nil, newError(ErrNotFound, gocql.ErrNotFound)
+}
+
+//first is a function for returning a copy of the first user of the partition of email, nil if there is none
+//Note: caller must hold the lock
+func (m *MemoryUser) first(email string) *model.User {
+	partition := m.rows[email]
+	if len(partition) == 0 {
+		return nil
+	}
+	//rows of a partition are ordered by name (clustering order), the first one is returned (same as 'LIMIT 1')
+	return copyUser(partition[sortedKeys(partition)[0]])
+}
+
+//FindAll is a function for finding all user, returning the first page of the result (see FindAllContext)
+func (m *MemoryUser) FindAll() (*Page[*model.User], *errors.Error) {
+	return m.FindAllContext(context.Background())
+}
+
+//FindAllContext is a function for finding all user, returning the first page of the result, with ctx for cancellation and deadline
+func (m *MemoryUser) FindAllContext(ctx context.Context) (*Page[*model.User], *errors.Error) {
+	return m.FindPageContext(ctx, "")
+}
+
+//FindPage is a function for finding the page of all user pointed by cursor (as returned in Page.NextCursor or Page.PreviousCursor) (see FindPageContext)
+func (m *MemoryUser) FindPage(cursor string) (*Page[*model.User], *errors.Error) {
+	return m.FindPageContext(context.Background(), cursor)
+}
+
+//FindPageContext is a function for finding the page of all user pointed by cursor (as returned in Page.NextCursor or Page.PreviousCursor), with ctx for cancellation and deadline
+//An empty cursor points to the first page
+func (m *MemoryUser) FindPageContext(ctx context.Context, cursor string) (*Page[*model.User], *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+	return m.findPage(cursorQueryAll, cursor, func(user *model.User) bool { return !m.options.excludes(user) })
+}
+
+//FindByStatus is a function for finding the page of users with status pointed by cursor (see FindByStatusContext)
+func (m *MemoryUser) FindByStatus(status, cursor string) (*Page[*model.User], *errors.Error) {
+	return m.FindByStatusContext(context.Background(), status, cursor)
+}
+
+//FindByStatusContext is a function for finding the page of users with status (e.g. model.UserStatusInactive) pointed by cursor
+//(as returned in Page.NextCursor or Page.PreviousCursor, an empty cursor pointing to the first page), with ctx for cancellation and deadline
+func (m *MemoryUser) FindByStatusContext(ctx context.Context, status, cursor string) (*Page[*model.User], *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	if _, ok := model.UserStatusMap[status]; !ok {
+		return nil, newError(ErrInvalidInput, fmt.Errorf("unknown user status %v", status))
+	}
+	return m.findPage(statusCursorQuery(status), cursor, func(user *model.User) bool { return user.Status == status })
+}
+
+//findPage is a function for finding the page pointed by cursor of the users matching a condition, query identifying the cursors
+//of the condition (see encodeHistory)
+func (m *MemoryUser) findPage(query, cursor string, matches func(user *model.User) bool) (*Page[*model.User], *errors.Error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	history, err := m.cursorCodec.decodeHistory(query, cursor)
+	if err != nil {
+		return nil, err
+	}
+	pageState := history[len(history)-1]
+	//the page state is the primary key of the last record of the previous page,
+	//so paging is not affected by records inserted or deleted in between (similar to cassandra page state)
+	var lastKey [2]string
+	if pageState != nil {
+		if jsonErr := json.Unmarshal(pageState, &lastKey); jsonErr != nil {
+			return nil, newError(ErrInvalidInput, ErrInvalidCursor)
+		}
+	}
+
+	var all []*model.User
+	for _, user := range m.all() {
+		if matches(user) {
+			all = append(all, user)
+		}
+	}
+	start := sort.Search(len(all), func(i int) bool {
+		return pageState == nil || compareKey(all[i].Email, all[i].Name, lastKey) > 0
+	})
+	end := start + m.pageSize
+	if end >= len(all) {
+		return newPage(m.cursorCodec, query, all[start:], history, nil), nil
+	}
+	last := all[end-1]
+	nextPageState, _ := json.Marshal([2]string{last.Email, last.Name})
+	return newPage(m.cursorCodec, query, all[start:end], history, nextPageState), nil
+}
+
+//all is a function for returning copies of all stored users ordered by user email then name
+//Note: caller must hold the lock
+func (m *MemoryUser) all() []*model.User {
+	var userList []*model.User
+	for _, email := range sortedKeys(m.rows) {
+		partition := m.rows[email]
+		for _, name := range sortedKeys(partition) {
+			userList = append(userList, copyUser(partition[name]))
+		}
+	}
+	return userList
+}
+
+//compareKey is a function for comparing the primary key of a user (email and name) with key, in the same manner as strings.Compare
+func compareKey(email, name string, key [2]string) int {
+	if c := strings.Compare(email, key[0]); c != 0 {
+		return c
+	}
+	return strings.Compare(name, key[1])
+}
+
+//Insert is a function for inserting new user (see InsertContext)
+func (m *MemoryUser) Insert(user *model.User) (bool, *errors.Error) {
+	return m.InsertContext(context.Background(), user)
+}
+
+//InsertContext is a function for inserting new user, with ctx for cancellation and deadline
+//It refuses to store a second user with the same email (even with another name),
+//returning false and an ErrAlreadyExists error carrying the existing user (as Error.Current) instead
+//The user is stored with version 1 and the current time as creation time (user.Version and user.CreatedAt are set accordingly)
+//It returns false and an ErrInvalidInput error if the user is not valid (see model.User.Validate), its email being normalized beforehand
+//It returns false and an ErrAlreadyExists error carrying the other user if an identity of user is linked to another user (see Link)
+func (m *MemoryUser) InsertContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+	user.Normalize()
+	if err := validateUser(user, nil); err != nil {
+		return false, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if existing := m.first(user.Email); existing != nil {
+		return false, newCurrentError(ErrAlreadyExists, existing)
+	}
+	if err := m.checkIdentitiesNotLinked(user, nil); err != nil {
+		return false, err
+	}
+	user.Version = 1
+	user.CreatedAt = newCreatedAt()
+	m.put(user)
+	return true, nil
+}
+
+//Upsert is a function for inserting a user, overwriting the existing user with the same primary key (user email and name) if any (see UpsertContext)
+func (m *MemoryUser) Upsert(user *model.User) (bool, *errors.Error) {
+	return m.UpsertContext(context.Background(), user)
+}
+
+//UpsertContext is a function for inserting a user, overwriting the existing user with the same primary key (user email and name) if any, with ctx for cancellation and deadline
+//The version of user is not checked, the user is stored with the version following the stored one (1 for a new user),
+//user.Version being set accordingly, and with the creation time of the stored one (the current time for a new user, see Insert)
+//It returns false and an ErrInvalidInput error if the user is not valid (see model.User.Validate), its email being normalized beforehand,
+//or if its status can't change from the existing user status
+//It returns false and an ErrAlreadyExists error carrying the existing user if no user has the primary key but a user already has the email,
+//or carrying the other user if an identity of user is linked to another user (see Link)
+func (m *MemoryUser) UpsertContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+
+	user.Normalize()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	previous, exists := m.rows[user.Email][user.Name]
+	if err := validateUser(user, previous); err != nil {
+		return false, err
+	}
+	if existing := m.first(user.Email); !exists && existing != nil {
+		return false, newCurrentError(ErrAlreadyExists, existing)
+	}
+	if err := m.checkIdentitiesNotLinked(user, previous); err != nil {
+		return false, err
+	}
+	user.Version, user.CreatedAt = 1, newCreatedAt()
+	if exists {
+		user.Version, user.CreatedAt = previous.Version+1, previous.CreatedAt
+	}
+	m.put(user)
+	return true, nil
+}
+
+//put is a function for storing a copy of user, overwriting the existing user with the same primary key
+//Note: caller must hold the write lock
+func (m *MemoryUser) put(user *model.User) {
+	partition, ok := m.rows[user.Email]
+	if !ok {
+		partition = map[string]*model.User{}
+		m.rows[user.Email] = partition
+	}
+	partition[user.Name] = storedUser(user)
+}
+
+//Update is a function for updating a user (see UpdateContext)
+func (m *MemoryUser) Update(user *model.User) (bool, *errors.Error) {
+	return m.UpdateContext(context.Background(), user)
+}
+
+//UpdateContext is a function for updating a user, with ctx for cancellation and deadline
+//The update is only applied if the stored user still has the same version as user (optimistic concurrency control),
+//in which case the version is incremented (user.Version is incremented accordingly)
+//It returns false and an ErrConflict error carrying the latest stored user (as Error.Current) if the version is stale,
+//or false and an ErrNotFound error if the user doesn't exist
+//It returns false and an ErrInvalidInput error if the user is not valid (see model.User.Validate)
+//or if its status can't change from the stored user status (see model.UserStatusTransitions)
+//It returns false and an ErrAlreadyExists error carrying the other user if an identity of user is linked to another user (see Link)
+func (m *MemoryUser) UpdateContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+	if err := validateUser(user, nil); err != nil {
+		return false, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	//Note: same as the 'IF version = ?' condition, a non existing user is not created
+	current, ok := m.rows[user.Email][user.Name]
+	if !ok {
+		return false, newError(ErrNotFound, nil)
+	}
+	if current.Version != user.Version {
+		return false, newCurrentError(ErrConflict, copyUser(current))
+	}
+	if err := validateUser(user, current); err != nil {
+		return false, err
+	}
+	if err := m.checkIdentitiesNotLinked(user, current); err != nil {
+		return false, err
+	}
+	user.Version++
+	stored := storedUser(user)
+	//same as the update of User, the creation time is not written
+	stored.CreatedAt = current.CreatedAt
+	m.rows[user.Email][user.Name] = stored
+	return true, nil
+}
+
+//Rename is a function for changing the name of a user (see RenameContext)
+func (m *MemoryUser) Rename(user *model.User, newName string) (bool, *errors.Error) {
+	return m.RenameContext(context.Background(), user, newName)
+}
+
+//RenameContext is a function for changing the name of a user, with ctx for cancellation and deadline
+//Since name is part of the primary key, the user is moved to a new row with newName, under the same optimistic concurrency control as Update
+//The status history of the user is moved along with it (see StatusHistory)
+//It returns false and an ErrAlreadyExists error carrying the existing user if a user with newName already exists,
+//an ErrConflict error carrying the latest stored user if the version is stale, or an ErrNotFound error if the user doesn't exist
+//It returns false and an ErrInvalidInput error if the renamed user is not valid (e.g. newName is empty, see model.User.Validate)
+//On success user.Name is set to newName and user.Version is incremented
+func (m *MemoryUser) RenameContext(ctx context.Context, user *model.User, newName string) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if newName == user.Name {
+		return false, newError(ErrInvalidInput, fmt.Errorf("user %v is already named %v", user.Email, newName))
+	}
+	if existing, ok := m.rows[user.Email][newName]; ok {
+		return false, newCurrentError(ErrAlreadyExists, copyUser(existing))
+	}
+	current, ok := m.rows[user.Email][user.Name]
+	if !ok {
+		return false, newError(ErrNotFound, nil)
+	}
+	if current.Version != user.Version {
+		return false, newCurrentError(ErrConflict, copyUser(current))
+	}
+	renamed := *user
+	renamed.Name = newName
+	if err := validateUser(&renamed, current); err != nil {
+		return false, err
+	}
+	delete(m.rows[user.Email], user.Name)
+	m.history.move(user.Email, user.Name, user.Email, newName)
+	user.Name = newName
+	user.CreatedAt = current.CreatedAt
+	user.Version++
+	m.put(user)
+	return true, nil
+}
+
+//ChangeEmail is a function for changing the email of a user (see ChangeEmailContext)
+func (m *MemoryUser) ChangeEmail(user *model.User, newEmail string) (bool, *errors.Error) {
+	return m.ChangeEmailContext(context.Background(), user, newEmail)
+}
+
+//ChangeEmailContext is a function for changing the email of a user, with ctx for cancellation and deadline
+//The user is moved to a new partition and a redirect from the old email to the new one is stored so that old references still resolve
+//(see FindByID), under the same optimistic concurrency control as Update
+//The status history of the user is moved along with it (see StatusHistory)
+//It returns false and an ErrAlreadyExists error carrying the existing user if a user with newEmail already exists,
+//an ErrConflict error carrying the latest stored user if the version is stale, an ErrNotFound error if the user doesn't exist,
+//or an ErrInvalidInput error if newEmail is malformed
+//On success user.Email is set to newEmail (in its canonical form, see model.NormalizeEmail) and user.Version is incremented
+func (m *MemoryUser) ChangeEmailContext(ctx context.Context, user *model.User, newEmail string) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+	newEmail, err := normalizeEmail(newEmail)
+	if err != nil {
+		return false, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if newEmail == user.Email {
+		return false, newError(ErrInvalidInput, fmt.Errorf("user %v already has email %v", user.Email, newEmail))
+	}
+	if existing := m.first(newEmail); existing != nil {
+		return false, newCurrentError(ErrAlreadyExists, existing)
+	}
+	current, ok := m.rows[user.Email][user.Name]
+	if !ok {
+		return false, newError(ErrNotFound, nil)
+	}
+	if current.Version != user.Version {
+		return false, newCurrentError(ErrConflict, copyUser(current))
+	}
+	m.remove(user.Email, user.Name)
+	m.redirects[user.Email] = newEmail
+	//any redirect of the new email is obsolete since it now belongs to this user
+	delete(m.redirects, newEmail)
+	m.history.move(user.Email, user.Name, newEmail, user.Name)
+	user.Email = newEmail
+	user.CreatedAt = current.CreatedAt
+	user.Version++
+	m.put(user)
+	return true, nil
+}
+
+//FindFormerEmails is a function for finding the former emails of the user with email (see FindFormerEmailsContext)
+func (m *MemoryUser) FindFormerEmails(email string) ([]string, *errors.Error) {
+	return m.FindFormerEmailsContext(context.Background(), email)
+}
+
+//FindFormerEmailsContext is a function for finding the former emails of the user with email, i.e. the emails redirecting to email
+//(directly or through other redirects, see ChangeEmail) that no user has anymore, with ctx for cancellation and deadline
+func (m *MemoryUser) FindFormerEmailsContext(ctx context.Context, email string) ([]string, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var formerEmails []string
+	newEmails := []string{email}
+	for redirects := 0; len(newEmails) > 0 && redirects < maxEmailRedirects; redirects++ {
+		var oldEmails []string
+		for _, newEmail := range newEmails {
+			for _, oldEmail := range sortedKeys(m.redirects) {
+				//same as FindByID, a redirect is not followed once a user has the email again
+				if m.redirects[oldEmail] == newEmail && len(m.rows[oldEmail]) == 0 {
+					oldEmails = append(oldEmails, oldEmail)
+				}
+			}
+		}
+		formerEmails = append(formerEmails, oldEmails...)
+		newEmails = oldEmails
+	}
+	return formerEmails, nil
+}
+
+//Link is a function for linking an identity at an external identity provider to a user (see LinkContext)
+func (m *MemoryUser) Link(user *model.User, identity model.Identity) (bool, *errors.Error) {
+	return m.LinkContext(context.Background(), user, identity)
+}
+
+//LinkContext is a function for linking an identity at an external identity provider to a user, replacing the identity of the user
+//at the same provider if any, with ctx for cancellation and deadline
+//The identity is linked under the same optimistic concurrency control as Update, LinkedAt is set to the current time if it is zero
+//It returns false and an ErrAlreadyExists error carrying the user the identity is linked to if it is linked to another user,
+//an ErrConflict error carrying the latest stored user if the version is stale, or an ErrNotFound error if the user doesn't exist
+//On success the identity is set in user.Identities and user.Version is incremented
+func (m *MemoryUser) LinkContext(ctx context.Context, user *model.User, identity model.Identity) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+	if err := validateIdentity(identity); err != nil {
+		return false, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.checkNotLinked(user, identity.Provider, identity.Subject); err != nil {
+		return false, err
+	}
+	current, ok := m.rows[user.Email][user.Name]
+	if !ok {
+		return false, newError(ErrNotFound, nil)
+	}
+	if current.Version != user.Version {
+		return false, newCurrentError(ErrConflict, copyUser(current))
+	}
+	if identity.LinkedAt.IsZero() {
+		identity.LinkedAt = time.Now()
+	}
+	current.Identities = withIdentity(current.Identities, identity)
+	current.Version++
+	m.rows[user.Email][user.Name] = storedUser(current)
+	user.Identities = withIdentity(user.Identities, identity)
+	user.Version++
+	return true, nil
+}
+
+//Unlink is a function for unlinking the identity at an external identity provider from a user (see UnlinkContext)
+func (m *MemoryUser) Unlink(user *model.User, provider string) (bool, *errors.Error) {
+	return m.UnlinkContext(context.Background(), user, provider)
+}
+
+//UnlinkContext is a function for unlinking the identity at an external identity provider (e.g. model.ProviderGoogle) from a user,
+//with ctx for cancellation and deadline
+//The identity is unlinked under the same optimistic concurrency control as Update
+//It returns false and an ErrNotFound error if the user doesn't exist or has no identity linked at provider,
+//or an ErrConflict error carrying the latest stored user if the version is stale
+//On success the identity is removed from user.Identities and user.Version is incremented
+func (m *MemoryUser) UnlinkContext(ctx context.Context, user *model.User, provider string) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+	if provider == "" {
+		return false, newError(ErrInvalidInput, fmt.Errorf("empty provider"))
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current, ok := m.rows[user.Email][user.Name]
+	if !ok {
+		return false, newError(ErrNotFound, nil)
+	}
+	if _, ok := current.Identities[provider]; !ok {
+		return false, newError(ErrNotFound, fmt.Errorf("user %v has no identity linked at %v", user.Email, provider))
+	}
+	if current.Version != user.Version {
+		return false, newCurrentError(ErrConflict, copyUser(current))
+	}
+	current.Identities = withoutIdentity(current.Identities, provider)
+	current.Version++
+	m.rows[user.Email][user.Name] = storedUser(current)
+	user.Identities = withoutIdentity(user.Identities, provider)
+	user.Version++
+	return true, nil
+}
+
+//checkNotLinked is a function for checking that the identity at provider with subject is not linked to another user than user,
+//returning an ErrAlreadyExists error carrying the other user if it is
+//Note: caller must hold the lock
+func (m *MemoryUser) checkNotLinked(user *model.User, provider, subject string) *errors.Error {
+	for _, partition := range m.rows {
+		for _, linked := range partition {
+			if linked.ExternalIdentities()[provider] == subject && (linked.Email != user.Email || linked.Name != user.Name) {
+				return newCurrentError(ErrAlreadyExists, copyUser(linked))
+			}
+		}
+	}
+	return nil
+}
+
+//checkIdentitiesNotLinked is a function for checking that the identities of user are not linked to another user (see checkNotLinked),
+//previous being its stored user (nil if none) whose unchanged identities are not checked again
+//Note: caller must hold the lock
+func (m *MemoryUser) checkIdentitiesNotLinked(user *model.User, previous *model.User) *errors.Error {
+	for provider, identity := range user.Identities {
+		if previous != nil && previous.ExternalIdentities()[provider] == identity.Subject {
+			continue
+		}
+		if err := m.checkNotLinked(user, provider, identity.Subject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Delete is a function for deleting user (see DeleteContext)
+func (m *MemoryUser) Delete(user *model.User) (bool, *errors.Error) {
+	return m.DeleteContext(context.Background(), user)
+}
+
+//DeleteContext is a function for deleting user, with ctx for cancellation and deadline
+//If WithSoftDelete is set, the user is marked as deleted instead, regardless of its version
+//It returns false and an ErrNotFound error if the user doesn't exist (or is already marked as deleted when soft deleting)
+func (m *MemoryUser) DeleteContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	partition := m.rows[user.Email]
+	current, ok := partition[user.Name]
+	if !ok {
+		return false, newError(ErrNotFound, nil)
+	}
+	if m.options.softDelete {
+		if current.Status == model.UserStatusDeleted {
+			return false, newError(ErrNotFound, nil)
+		}
+		current.Status = model.UserStatusDeleted
+		current.DeletedAt = time.Now()
+		current.Version++
+		partition[user.Name] = storedUser(current)
+		user.Status, user.DeletedAt, user.Version = current.Status, current.DeletedAt, current.Version
+		return true, nil
+	}
+	m.remove(user.Email, user.Name)
+	return true, nil
+}
+
+//remove is a function for removing the stored user with email and name
+//Note: caller must hold the write lock
+func (m *MemoryUser) remove(email, name string) {
+	partition := m.rows[email]
+	delete(partition, name)
+	if len(partition) == 0 {
+		delete(m.rows, email)
+	}
+}
+
+//Restore is a function for restoring a user marked as deleted (see RestoreContext)
+func (m *MemoryUser) Restore(user *model.User) (bool, *errors.Error) {
+	return m.RestoreContext(context.Background(), user)
+}
+
+//RestoreContext is a function for restoring a user marked as deleted (see WithSoftDelete) as an inactive user (see model.UserStatusTransitions),
+//with ctx for cancellation and deadline
+//The user is restored under the same optimistic concurrency control as Update
+//It returns false and an ErrInvalidInput error if the user is not marked as deleted, an ErrConflict error carrying the latest stored user
+//if the version is stale, or an ErrNotFound error if the user doesn't exist (e.g. it has been purged)
+//On success user.Status is set to model.UserStatusInactive, user.DeletedAt is cleared and user.Version is incremented
+func (m *MemoryUser) RestoreContext(ctx context.Context, user *model.User) (bool, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current, ok := m.rows[user.Email][user.Name]
+	if !ok {
+		return false, newError(ErrNotFound, nil)
+	}
+	if current.Status != model.UserStatusDeleted {
+		return false, newError(ErrInvalidInput, fmt.Errorf("user %v is not deleted", user.Email))
+	}
+	if current.Version != user.Version {
+		return false, newCurrentError(ErrConflict, copyUser(current))
+	}
+	current.Status = model.UserStatusInactive
+	current.DeletedAt = time.Time{}
+	current.Version++
+	m.rows[user.Email][user.Name] = storedUser(current)
+	user.Status, user.DeletedAt, user.Version = current.Status, current.DeletedAt, current.Version
+	return true, nil
+}
+
+//Purge is a function for removing the users marked as deleted for longer than retention (see PurgeContext)
+func (m *MemoryUser) Purge(retention time.Duration) (int, *errors.Error) {
+	return m.PurgeContext(context.Background(), retention)
+}
+
+//PurgeContext is a function for removing the users marked as deleted for longer than retention, returning the number of removed users,
+//with ctx for cancellation and deadline
+//Users marked as deleted without deletion time (e.g. by Update) are left
+func (m *MemoryUser) PurgeContext(ctx context.Context, retention time.Duration) (int, *errors.Error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapError(err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	deletedBefore := time.Now().Add(-retention)
+	purged := 0
+	for _, deleted := range m.all() {
+		if deleted.Status != model.UserStatusDeleted || deleted.DeletedAt.IsZero() || deleted.DeletedAt.After(deletedBefore) {
+			continue
+		}
+		m.remove(deleted.Email, deleted.Name)
+		purged++
+	}
+	return purged, nil
+}
+
+//storedUser is a function for returning a copy of user the way cassandra would store it
+func storedUser(user *model.User) *model.User {
+	stored := copyUser(user)
+	//cassandra stores timestamp as milliseconds since epoch (no timezone info) and gocql loads it as UTC
+	stored.LastActivity = stored.LastActivity.UTC().Truncate(time.Millisecond)
+	stored.CreatedAt = stored.CreatedAt.UTC().Truncate(time.Millisecond)
+	stored.DeletedAt = stored.DeletedAt.UTC().Truncate(time.Millisecond)
+	//an empty map is stored as null, and identities are keyed by provider (same as the identities column)
+	stored.Identities = nil
+	for provider, identity := range user.Identities {
+		identity.Provider = provider
+		identity.ExpiresAt = identity.ExpiresAt.UTC().Truncate(time.Millisecond)
+		identity.LinkedAt = identity.LinkedAt.UTC().Truncate(time.Millisecond)
+		stored.Identities = withIdentity(stored.Identities, identity)
+	}
+	return stored
+}
+
+//copyUser is a function for returning a copy of user so that stored records are not shared with callers
+func copyUser(user *model.User) *model.User {
+	userCopy := *user
+	if user.Identities != nil {
+		userCopy.Identities = make(map[string]model.Identity, len(user.Identities))
+		for provider, identity := range user.Identities {
+			userCopy.Identities[provider] = identity
+		}
+	}
+	return &userCopy
+}
+
+//sortedKeys is a function for returning the keys of a map in ascending order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,107 @@
+//user_memory_test provides unit tests for in-memory user datamapper
+package datamapper_test
+
+import (
+	"testtrx/datamapper"
+	"testtrx/datamapper/datamappertest"
+	"testtrx/model"
+
+	"sync"
+	"testing"
+)
+
+func TestMemoryUserMapperSuite(t *testing.T) {
+	datamappertest.RunUserMapperSuite(t, func(t *testing.T) datamapper.UserMapper {
+		return datamapper.NewMemoryUser()
+	})
+}
+
+func TestMemoryStatusHistoryMapperSuite(t *testing.T) {
+	datamappertest.RunStatusHistoryMapperSuite(t, func(t *testing.T) datamapper.StatusHistoryMapper {
+		return datamapper.NewMemoryStatusHistory()
+	})
+}
+
+func TestMemoryUserStatusHistorySuite(t *testing.T) {
+	datamappertest.RunUserStatusHistorySuite(t, func(t *testing.T) (datamapper.UserMapper, datamapper.StatusHistoryMapper) {
+		userMapper := datamapper.NewMemoryUser()
+		return userMapper, userMapper.StatusHistory()
+	})
+}
+
+func TestMemorySessionMapperSuite(t *testing.T) {
+	datamappertest.RunSessionMapperSuite(t, func(t *testing.T) datamapper.SessionMapper {
+		return datamapper.NewMemoryUserSession()
+	})
+}
+
+func TestMemoryStoredUserIsCopied(t *testing.T) {
+	userMapper := datamapper.NewMemoryUser()
+
+	userModel := datamappertest.NewTestUser(1)
+	_, err := userMapper.Insert(userModel)
+	if err != nil {
+		t.Errorf("Failed to insert user: %v", err)
+	}
+
+	//modifying the inserted model must not modify the stored user
+	userModel.Password = "modifiedPasswordHash"
+
+	foundModel, err := userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	if "dummyPasswordHash" != foundModel.Password {
+		t.Errorf("want %v for password, got %v", "dummyPasswordHash", foundModel.Password)
+	}
+
+	//modifying the found model must not modify the stored user either
+	foundModel.Password = "modifiedPasswordHash"
+
+	foundModel, err = userMapper.FindByID(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	if "dummyPasswordHash" != foundModel.Password {
+		t.Errorf("want %v for password, got %v", "dummyPasswordHash", foundModel.Password)
+	}
+}
+
+func TestMemoryConcurrentAccess(t *testing.T) {
+	userMapper := datamapper.NewMemoryUser()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userModel := datamappertest.NewTestUser(i)
+			if _, err := userMapper.Insert(userModel); err != nil {
+				t.Errorf("Failed to insert user: %v", err)
+			}
+			if _, err := userMapper.FindByID(userModel.Email); err != nil {
+				t.Errorf("Failed to find by id: %v", err)
+			}
+			userModel.Status = model.UserStatusInactive
+			if _, err := userMapper.Update(userModel); err != nil {
+				t.Errorf("Failed to update user: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	userMapper.SetPageSize(100)
+	page, err := userMapper.FindAll()
+	if err != nil {
+		t.Fatalf("findAll call failed: %v", err)
+	}
+	allModelSlice := page.Items
+	if len(allModelSlice) != 50 {
+		t.Errorf("want %v for allModelSlice length, got %v", 50, len(allModelSlice))
+	}
+	for _, eachModel := range allModelSlice {
+		if model.UserStatusInactive != eachModel.Status {
+			t.Errorf("user %v: want %v for status, got %v", eachModel.Name, model.UserStatusInactive, eachModel.Status)
+		}
+	}
+}
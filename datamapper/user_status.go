@@ -0,0 +1,143 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"context"
+	"encoding/binary"
+	stderrors "errors"
+	"hash/fnv"
+	"testtrx/model"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//Note: users are listed by status through the user_by_status lookup table, maintained along with the other lookup tables (see user_lookup.go)
+//Its partitions are split into statusBuckets buckets by user email so that a status shared by most users doesn't make a hot partition
+
+//statusBuckets is the number of buckets of each status in user_by_status
+//Note: changing it requires rewriting user_by_status (the bucket of a user is also computed by the schema migration filling the table)
+const statusBuckets = 16
+
+//statusBucket is a function for returning the user_by_status bucket of the user with email
+func statusBucket(email string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(email))
+	return int(hash.Sum32() % statusBuckets)
+}
+
+//FindByStatus is a function for finding the page of users with status pointed by cursor (see FindByStatusContext)
+func (u *User) FindByStatus(status, cursor string) (*Page[*model.User], *errors.Error) {
+	return u.FindByStatusContext(context.Background(), status, cursor)
+}
+
+//FindByStatusContext is a function for finding the page of users with status (e.g. model.UserStatusInactive) pointed by cursor
+//(as returned in Page.NextCursor or Page.PreviousCursor, an empty cursor pointing to the first page), with ctx for cancellation and deadline
+//Users are not ordered, and a page may hold less than the page size users (even none) since users whose status changed
+//while being listed are left out
+func (u *User) FindByStatusContext(ctx context.Context, status, cursor string) (*Page[*model.User], *errors.Error) {
+	ctx, cancel := u.options.context(ctx)
+	defer cancel()
+
+	if err := model.ValidateStatus(status); err != nil {
+		return nil, newError(ErrInvalidInput, err)
+	}
+	history, err := u.cursorCodec.decodeHistory(statusCursorQuery(status), cursor)
+	if err != nil {
+		return nil, err
+	}
+	bucket, pageState, err := decodeStatusPageState(history[len(history)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	//the page is filled from the buckets in turn, a bucket being left for the next one once all of its entries are read
+	var userList []*model.User
+	var nextPageState []byte
+	for remaining := u.pageSize; remaining > 0 && bucket < statusBuckets; {
+		iter := u.options.query(u.dbSession.Query(`SELECT user_email, name
+			FROM user_by_status
+			WHERE status = ? AND bucket = ?`, status, bucket)).WithContext(ctx).PageState(pageState).PageSize(remaining).Iter()
+		bucketPageState := iter.PageState()
+		var keys [][2]string
+		var email, name string
+		for iter.Scan(&email, &name) {
+			keys = append(keys, [2]string{email, name})
+		}
+		if err := iter.Close(); err != nil {
+			return nil, wrapError(err)
+		}
+		for _, key := range keys {
+			userModel, err := u.findLookedUp(ctx, key[0], key[1], func(user *model.User) bool { return user.Status == status })
+			if stderrors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			userList = append(userList, userModel)
+		}
+		remaining -= len(keys)
+
+		if len(bucketPageState) != 0 {
+			pageState = bucketPageState
+			nextPageState = encodeStatusPageState(bucket, pageState)
+			continue
+		}
+		bucket, pageState, nextPageState = bucket+1, nil, nil
+		if bucket < statusBuckets {
+			nextPageState = encodeStatusPageState(bucket, nil)
+		}
+	}
+	return newPage(u.cursorCodec, statusCursorQuery(status), userList, history, nextPageState), nil
+}
+
+//statusCursorQuery is a function for returning the query of the cursors of FindByStatus with status (see encodeHistory)
+func statusCursorQuery(status string) string {
+	return "status:" + status
+}
+
+//encodeStatusPageState is a function for encoding the page state of FindByStatus, made of the bucket and of its page state
+func encodeStatusPageState(bucket int, pageState []byte) []byte {
+	return append(binary.AppendUvarint(nil, uint64(bucket)), pageState...)
+}
+
+//decodeStatusPageState is a function for decoding the page state of FindByStatus, an empty one being the start of the first bucket
+func decodeStatusPageState(state []byte) (int, []byte, *errors.Error) {
+	if len(state) == 0 {
+		return 0, nil, nil
+	}
+	bucket, n := binary.Uvarint(state)
+	if n <= 0 || bucket >= statusBuckets {
+		return 0, nil, newError(ErrInvalidInput, ErrInvalidCursor)
+	}
+	if n == len(state) {
+		return int(bucket), nil, nil
+	}
+	return int(bucket), state[n:], nil
+}
+
+//addStatusSync is a function for adding to batch the statements updating the status lookup of user (nil if it has been deleted),
+//removing the lookup of previous (nil if none) if its status or primary key changed
+func addStatusSync(batch *gocql.Batch, previous *model.User, user *model.User) {
+	current := &model.User{}
+	if user != nil {
+		current = user
+	}
+	if previous != nil && previous.Status != "" &&
+		(previous.Status != current.Status || previous.Email != current.Email || previous.Name != current.Name) {
+		batch.Query(`
+			DELETE FROM user_by_status WHERE status = ? AND bucket = ? AND user_email = ? AND name = ?`,
+			previous.Status,
+			statusBucket(previous.Email),
+			previous.Email,
+			previous.Name)
+	}
+	if current.Status != "" {
+		batch.Query(`
+			INSERT INTO user_by_status (status, bucket, user_email, name) VALUES (?, ?, ?, ?)`,
+			current.Status,
+			statusBucket(current.Email),
+			current.Email,
+			current.Name)
+	}
+}
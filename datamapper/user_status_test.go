@@ -0,0 +1,57 @@
+//user_status_test provides unit tests for status lookup bucketing and paging
+package datamapper
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestStatusBucket(t *testing.T) {
+	used := map[int]bool{}
+	for i := 0; i < 1000; i++ {
+		email := "user" + strconv.Itoa(i) + "@testemail.com"
+		bucket := statusBucket(email)
+		if bucket < 0 || bucket >= statusBuckets {
+			t.Fatalf("want bucket in [0, %v) for %v, got %v", statusBuckets, email, bucket)
+		}
+		if bucket != statusBucket(email) {
+			t.Fatalf("want same bucket for %v", email)
+		}
+		used[bucket] = true
+	}
+	//users must be spread over all buckets
+	if len(used) != statusBuckets {
+		t.Errorf("want %v buckets used, got %v", statusBuckets, len(used))
+	}
+}
+
+func TestStatusPageState(t *testing.T) {
+	for _, tc := range []struct {
+		bucket    int
+		pageState []byte
+	}{
+		{0, nil},
+		{3, nil},
+		{statusBuckets - 1, []byte{0x00, 0x01, 'p', 'a', 'g', 'e'}},
+	} {
+		bucket, pageState, err := decodeStatusPageState(encodeStatusPageState(tc.bucket, tc.pageState))
+		if err != nil {
+			t.Fatalf("Failed to decode page state: %v", err)
+		}
+		if tc.bucket != bucket || !bytes.Equal(tc.pageState, pageState) {
+			t.Errorf("want bucket %v and page state %v, got %v and %v", tc.bucket, tc.pageState, bucket, pageState)
+		}
+	}
+
+	//the first page starts at the first bucket
+	if bucket, pageState, err := decodeStatusPageState(nil); err != nil || bucket != 0 || pageState != nil {
+		t.Errorf("want first bucket for empty page state, got %v, %v and %v", bucket, pageState, err)
+	}
+	for _, state := range [][]byte{{0x80}, encodeStatusPageState(statusBuckets, nil)} {
+		if _, _, err := decodeStatusPageState(state); !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("want invalid input error for page state %v, got %v", state, err)
+		}
+	}
+}
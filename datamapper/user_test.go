@@ -3,6 +3,8 @@ package datamapper_test
 
 import (
 	"testtrx/datamapper"
+	"testtrx/datamapper/datamappertest"
+	"testtrx/migration"
 	"testtrx/model"
 
 	"github.com/go-errors/errors"
@@ -27,38 +29,60 @@ func initUserMapperTest(tb testing.TB) *datamapper.User {
 	return datamapper.NewUser(session)
 }
 
+//initUserTable is a function for (re)creating the user tables by applying the schema migrations on an empty schema
 func initUserTable(tb testing.TB) {
-	session := initTest()
+	migrator := initMigrator(tb)
 
-	err := session.Query(`DROP TABLE IF EXISTS user`).Exec()
+	_, err := migrator.DownTo(0)
 	if err != nil {
-		tb.Fatalf("Failed to drop table: %v", err)
+		tb.Fatalf("Failed to revert migrations: %v", err)
 	}
 
-	err = session.Query(`CREATE TABLE user (
-		user_email varchar,
-		password varchar,
-		name varchar,
-		status varchar,
-		last_activity timestamp,
-		auth_token varchar,
-		google_token varchar,
-		facebook_token varchar,
-	PRIMARY KEY ((user_email), name)
-	) WITH CLUSTERING ORDER BY (name asc)`).Exec()
-
+	_, err = migrator.Up()
 	if err != nil {
-		tb.Fatalf("Failed to create table: %v", err)
+		tb.Fatalf("Failed to apply migrations: %v", err)
 	}
 }
 
+//cleanupUserTable is a function for dropping the user tables by reverting the schema migrations
 func cleanupUserTable(tb testing.TB) {
-	session := initTest()
+	_, err := initMigrator(tb).DownTo(0)
+	if err != nil {
+		tb.Fatalf("Failed to revert migrations: %v", err)
+	}
+}
 
-	err := session.Query(`DROP TABLE IF EXISTS user`).Exec()
+func initMigrator(tb testing.TB) *migration.Migrator {
+	migrator, err := migration.NewMigrator(initTest(), migration.Migrations)
 	if err != nil {
-		tb.Fatalf("Failed to drop table: %v", err)
+		tb.Fatalf("Failed to init migrator: %v", err)
+	}
+	return migrator
+}
+
+func TestMigrationAppliedAgain(t *testing.T) {
+	initUserTable(t)
+	migrator := initMigrator(t)
+
+	//a migration whose backfill failed after its column has been added is applied again
+	if _, err := migrator.DownTo(1); err != nil {
+		t.Fatalf("Failed to revert migrations: %v", err)
 	}
+	if err := initTest().Query(`ALTER TABLE user ADD version bigint`).Exec(); err != nil {
+		t.Fatalf("Failed to add column: %v", err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Errorf("Failed to apply migrations again: %v", err)
+	}
+	cleanupUserTable(t)
+}
+
+func TestUserMapperSuite(t *testing.T) {
+	datamappertest.RunUserMapperSuite(t, func(t *testing.T) datamapper.UserMapper {
+		initUserTable(t)
+		t.Cleanup(func() { cleanupUserTable(t) })
+		return initUserMapperTest(t)
+	})
 }
 
 func TestInsert(t *testing.T) {
@@ -72,14 +96,16 @@ func TestInsert(t *testing.T) {
 	//initiate the model objects to insert
 	for i := 1; i <= 5; i++ {
 		userModelSlice = append(userModelSlice, model.User{
-			"user" + strconv.Itoa(i) + "@testEmail.com",
-			"dummyPasswordHash",
-			strconv.Itoa(i),
-			model.UserStatusActive,
-			nowTime,
-			"dummyAuthToken" + strconv.Itoa(i),
-			"dummyGoogleToken" + strconv.Itoa(i),
-			"dummyFacebookToken" + strconv.Itoa(i)})
+			Email:        "user" + strconv.Itoa(i) + "@testemail.com",
+			Password:     "dummyPasswordHash",
+			Name:         strconv.Itoa(i),
+			Status:       model.UserStatusActive,
+			LastActivity: nowTime,
+			AuthToken:    "dummyAuthToken" + strconv.Itoa(i),
+			Identities: map[string]model.Identity{
+				model.ProviderGoogle:   {Provider: model.ProviderGoogle, Subject: "dummyGoogleSubject" + strconv.Itoa(i)},
+				model.ProviderFacebook: {Provider: model.ProviderFacebook, Subject: "dummyFacebookSubject" + strconv.Itoa(i)},
+			}})
 	}
 
 	//insert the models
@@ -91,7 +117,8 @@ func TestInsert(t *testing.T) {
 	}
 
 	//confirm the inserted models by performing select query
-	var userEmail, password, name, status, authToken, googleToken, facebookToken string
+	var userEmail, password, name, status, authToken string
+	var identities map[string]map[string]interface{}
 	var lastActivity time.Time
 
 	// list all records
@@ -104,17 +131,16 @@ func TestInsert(t *testing.T) {
 		status,
 		last_activity,
 		auth_token,
-		google_token,
-		facebook_token
+		identities
 		 FROM user`).Iter()
-	for iter.Scan(&userEmail, &password, &name, &status, &lastActivity, &authToken, &googleToken, &facebookToken) {
+	for iter.Scan(&userEmail, &password, &name, &status, &lastActivity, &authToken, &identities) {
 		counter, err := strconv.Atoi(name)
 		if err != nil {
 			t.Errorf("failed converting name: %v to integer counter", counter)
 		}
 
-		if "user"+strconv.Itoa(counter)+"@testEmail.com" != userEmail {
-			t.Errorf("counter:%v, want %v for userEmail, got %v", counter, "user"+strconv.Itoa(counter)+"@testEmail.com", userEmail)
+		if "user"+strconv.Itoa(counter)+"@testemail.com" != userEmail {
+			t.Errorf("counter:%v, want %v for userEmail, got %v", counter, "user"+strconv.Itoa(counter)+"@testemail.com", userEmail)
 		}
 		if "dummyPasswordHash" != password {
 			t.Errorf("counter:%v, want %v for password, got %v", counter, "dummyPasswordHash", password)
@@ -134,11 +160,11 @@ func TestInsert(t *testing.T) {
 		if "dummyAuthToken"+strconv.Itoa(counter) != authToken {
 			t.Errorf("counter:%v, want %v for authToken, got %v", counter, "dummyAuthToken"+strconv.Itoa(counter), authToken)
 		}
-		if "dummyGoogleToken"+strconv.Itoa(counter) != googleToken {
-			t.Errorf("counter:%v, want %v for googleToken, got %v", counter, "dummyGoogleToken"+strconv.Itoa(counter), googleToken)
+		if "dummyGoogleSubject"+strconv.Itoa(counter) != identities[model.ProviderGoogle]["subject"] {
+			t.Errorf("counter:%v, want %v for google subject, got %v", counter, "dummyGoogleSubject"+strconv.Itoa(counter), identities[model.ProviderGoogle]["subject"])
 		}
-		if "dummyFacebookToken"+strconv.Itoa(counter) != facebookToken {
-			t.Errorf("counter:%v, want %v for facebookToken, got %v", counter, "dummyFacebookToken"+strconv.Itoa(counter), facebookToken)
+		if "dummyFacebookSubject"+strconv.Itoa(counter) != identities[model.ProviderFacebook]["subject"] {
+			t.Errorf("counter:%v, want %v for facebook subject, got %v", counter, "dummyFacebookSubject"+strconv.Itoa(counter), identities[model.ProviderFacebook]["subject"])
 		}
 	}
 	if err := iter.Close(); err != nil {
@@ -156,14 +182,16 @@ func TestUpdate(t *testing.T) {
 
 	//initiate the model object to insert
 	userModel := model.User{
-		"user1@testEmail.com",
-		"dummyPasswordHash",
-		"user1",
-		model.UserStatusActive,
-		nowTime,
-		"dummyAuthToken1",
-		"dummyGoogleToken1",
-		"dummyFacebookToken1"}
+		Email:        "user1@testemail.com",
+		Password:     "dummyPasswordHash",
+		Name:         "user1",
+		Status:       model.UserStatusActive,
+		LastActivity: nowTime,
+		AuthToken:    "dummyAuthToken1",
+		Identities: map[string]model.Identity{
+			model.ProviderGoogle:   {Provider: model.ProviderGoogle, Subject: "dummyGoogleSubject1"},
+			model.ProviderFacebook: {Provider: model.ProviderFacebook, Subject: "dummyFacebookSubject1"},
+		}}
 
 	//insert the models
 	_, err := userMapper.Insert(&userModel)
@@ -181,7 +209,8 @@ func TestUpdate(t *testing.T) {
 	}
 
 	//check whether user has really been updated
-	var userEmail, password, name, status, authToken, googleToken, facebookToken string
+	var userEmail, password, name, status, authToken string
+	var identities map[string]map[string]interface{}
 	var lastActivity time.Time
 
 	if err := session.Query(`SELECT 
@@ -191,9 +220,8 @@ func TestUpdate(t *testing.T) {
 		status,
 		last_activity,
 		auth_token,
-		google_token,
-		facebook_token
-		 FROM user WHERE user_email = 'user1@testEmail.com'`).
+		identities
+		 FROM user WHERE user_email = 'user1@testemail.com'`).
 		Consistency(gocql.One).
 		Scan(&userEmail,
 			&password,
@@ -201,13 +229,12 @@ func TestUpdate(t *testing.T) {
 			&status,
 			&lastActivity,
 			&authToken,
-			&googleToken,
-			&facebookToken); err != nil {
+			&identities); err != nil {
 		t.Errorf("Failed to perform select query: %v", err)
 	}
 
-	if "user1@testEmail.com" != userEmail {
-		t.Errorf("want %v for userEmail, got %v", "user1@testEmail.com", userEmail)
+	if "user1@testemail.com" != userEmail {
+		t.Errorf("want %v for userEmail, got %v", "user1@testemail.com", userEmail)
 	}
 	if "dummyPasswordHash" != password {
 		t.Errorf("want %v for password, got %v", "dummyPasswordHash", password)
@@ -227,11 +254,11 @@ func TestUpdate(t *testing.T) {
 	if "updatedDummyAuthToken" != authToken {
 		t.Errorf("want %v for authToken, got %v", "updatedDummyAuthToken", authToken)
 	}
-	if "dummyGoogleToken1" != googleToken {
-		t.Errorf("want %v for googleToken, got %v", "dummyGoogleToken1", googleToken)
+	if "dummyGoogleSubject1" != identities[model.ProviderGoogle]["subject"] {
+		t.Errorf("want %v for google subject, got %v", "dummyGoogleSubject1", identities[model.ProviderGoogle]["subject"])
 	}
-	if "dummyFacebookToken1" != facebookToken {
-		t.Errorf("want %v for facebookToken, got %v", "dummyFacebookToken1", facebookToken)
+	if "dummyFacebookSubject1" != identities[model.ProviderFacebook]["subject"] {
+		t.Errorf("want %v for facebook subject, got %v", "dummyFacebookSubject1", identities[model.ProviderFacebook]["subject"])
 	}
 	cleanupUserTable(t)
 }
@@ -245,14 +272,16 @@ func TestDelete(t *testing.T) {
 
 	//initiate the model object to insert
 	userModel := model.User{
-		"user1@testEmail.com",
-		"dummyPasswordHash",
-		"user1",
-		model.UserStatusActive,
-		nowTime,
-		"dummyAuthToken1",
-		"dummyGoogleToken1",
-		"dummyFacebookToken1"}
+		Email:        "user1@testemail.com",
+		Password:     "dummyPasswordHash",
+		Name:         "user1",
+		Status:       model.UserStatusActive,
+		LastActivity: nowTime,
+		AuthToken:    "dummyAuthToken1",
+		Identities: map[string]model.Identity{
+			model.ProviderGoogle:   {Provider: model.ProviderGoogle, Subject: "dummyGoogleSubject1"},
+			model.ProviderFacebook: {Provider: model.ProviderFacebook, Subject: "dummyFacebookSubject1"},
+		}}
 
 	//insert the models
 	_, err := userMapper.Insert(&userModel)
@@ -267,7 +296,8 @@ func TestDelete(t *testing.T) {
 	}
 
 	//check whether user has really been deleted
-	var userEmail, password, name, status, authToken, googleToken, facebookToken string
+	var userEmail, password, name, status, authToken string
+	var identities map[string]map[string]interface{}
 	var lastActivity time.Time
 
 	queryErr := session.Query(`SELECT 
@@ -277,9 +307,8 @@ func TestDelete(t *testing.T) {
 		status,
 		last_activity,
 		auth_token,
-		google_token,
-		facebook_token
-		 FROM user WHERE user_email = 'user1@testEmail.com'`).
+		identities
+		 FROM user WHERE user_email = 'user1@testemail.com'`).
 		Consistency(gocql.One).
 		Scan(&userEmail,
 			&password,
@@ -287,8 +316,7 @@ func TestDelete(t *testing.T) {
 			&status,
 			&lastActivity,
 			&authToken,
-			&googleToken,
-			&facebookToken)
+			&identities)
 	if queryErr == nil {
 		t.Error("Error expected but got none")
 	} else if "not found" != queryErr.Error() {
@@ -305,14 +333,16 @@ func TestFindById(t *testing.T) {
 
 	//initiate the model object to insert
 	userModel := model.User{
-		"user1@testEmail.com",
-		"dummyPasswordHash",
-		"user1",
-		model.UserStatusActive,
-		nowTime,
-		"dummyAuthToken1",
-		"dummyGoogleToken1",
-		"dummyFacebookToken1"}
+		Email:        "user1@testemail.com",
+		Password:     "dummyPasswordHash",
+		Name:         "user1",
+		Status:       model.UserStatusActive,
+		LastActivity: nowTime,
+		AuthToken:    "dummyAuthToken1",
+		Identities: map[string]model.Identity{
+			model.ProviderGoogle:   {Provider: model.ProviderGoogle, Subject: "dummyGoogleSubject1"},
+			model.ProviderFacebook: {Provider: model.ProviderFacebook, Subject: "dummyFacebookSubject1"},
+		}}
 
 	//insert the models
 	_, err := userMapper.Insert(&userModel)
@@ -348,11 +378,22 @@ func TestFindById(t *testing.T) {
 	if userModel.AuthToken != foundModel.AuthToken {
 		t.Errorf("want %v for authToken, got %v", userModel.AuthToken, foundModel.AuthToken)
 	}
-	if userModel.GoogleToken != foundModel.GoogleToken {
-		t.Errorf("want %v for googleToken, got %v", userModel.GoogleToken, foundModel.GoogleToken)
+	for provider, identity := range userModel.Identities {
+		if identity.Subject != foundModel.Identities[provider].Subject {
+			t.Errorf("want %v for %v subject, got %v", identity.Subject, provider, foundModel.Identities[provider].Subject)
+		}
 	}
-	if userModel.FacebookToken != foundModel.FacebookToken {
-		t.Errorf("want %v for facebookToken, got %v", userModel.FacebookToken, foundModel.FacebookToken)
+
+	//a user stored before emails were normalized is found by its raw email
+	if queryErr := initTest().Query(`INSERT INTO user (user_email, name, status, version) VALUES (?, ?, ?, ?)`,
+		"legacy@testEmail.com", "legacy", model.UserStatusActive, 1).Exec(); queryErr != nil {
+		t.Fatalf("Failed to insert legacy user: %v", queryErr)
+	}
+	foundModel, err = userMapper.FindByID("legacy@testEmail.com")
+	if err != nil {
+		t.Errorf("Failed to find legacy user by id: %v", err)
+	} else if "legacy" != foundModel.Name {
+		t.Errorf("want %v for name, got %v", "legacy", foundModel.Name)
 	}
 	cleanupUserTable(t)
 }
@@ -367,14 +408,16 @@ func TestFindAllAndPage(t *testing.T) {
 	//initiate the model objects to insert
 	for i := 1; i <= 5; i++ {
 		userModelSlice = append(userModelSlice, model.User{
-			"user" + strconv.Itoa(i) + "@testEmail.com",
-			"dummyPasswordHash",
-			strconv.Itoa(i),
-			model.UserStatusActive,
-			nowTime,
-			"dummyAuthToken" + strconv.Itoa(i),
-			"dummyGoogleToken" + strconv.Itoa(i),
-			"dummyFacebookToken" + strconv.Itoa(i)})
+			Email:        "user" + strconv.Itoa(i) + "@testemail.com",
+			Password:     "dummyPasswordHash",
+			Name:         strconv.Itoa(i),
+			Status:       model.UserStatusActive,
+			LastActivity: nowTime,
+			AuthToken:    "dummyAuthToken" + strconv.Itoa(i),
+			Identities: map[string]model.Identity{
+				model.ProviderGoogle:   {Provider: model.ProviderGoogle, Subject: "dummyGoogleSubject" + strconv.Itoa(i)},
+				model.ProviderFacebook: {Provider: model.ProviderFacebook, Subject: "dummyFacebookSubject" + strconv.Itoa(i)},
+			}})
 	}
 
 	//insert the models
@@ -385,50 +428,33 @@ func TestFindAllAndPage(t *testing.T) {
 		}
 	}
 	//find all models
-	var foundModelSlice, allModelSlice []*model.User
+	var allModelSlice []*model.User
+	var page *datamapper.Page[*model.User]
 	var err *errors.Error
-	var isLast bool
 	var pageSize = 2
 
 	userMapper.SetPageSize(pageSize)
-	foundModelSlice, err = userMapper.FindAll()
-	//append foundModel to allModelSlice
-	for _, foundModel := range foundModelSlice {
-		allModelSlice = append(allModelSlice, foundModel)
+	page, err = userMapper.FindAll()
+	if err != nil {
+		t.Fatalf("findAll call failed: %v", err)
 	}
-	for true {
-		//reset slice
-		foundModelSlice = foundModelSlice[:0]
-		foundModelSlice, err, isLast = userMapper.NextPage()
+	//append found models to allModelSlice
+	allModelSlice = append(allModelSlice, page.Items...)
+	for page.NextCursor != "" {
+		page, err = userMapper.FindPage(page.NextCursor)
 
 		if err != nil {
-			t.Errorf("nextPage call failed: %v", err)
+			t.Errorf("findPage call failed: %v", err)
 			break
 		}
 
-		if len(foundModelSlice) > pageSize {
-			t.Errorf("Expected returned slice length %v is more than page size %v", len(foundModelSlice), pageSize)
+		if len(page.Items) > pageSize {
+			t.Errorf("Expected returned slice length %v is more than page size %v", len(page.Items), pageSize)
 			break
 		}
 
-		//append foundModel to allModelSlice
-		for _, foundModel := range foundModelSlice {
-			allModelSlice = append(allModelSlice, foundModel)
-		}
-
-		if isLast {
-			//done iterating resultset
-			break
-		}
-	}
-
-	//try calling nextPage again
-	_, err, isLast = userMapper.NextPage()
-	if err == nil {
-		t.Errorf("error expected but got none")
-	}
-	if isLast == false {
-		t.Errorf("want %v for isLast but got %v", true, isLast)
+		//append found models to allModelSlice
+		allModelSlice = append(allModelSlice, page.Items...)
 	}
 
 	//check all appended model from result set so far
@@ -439,8 +465,8 @@ func TestFindAllAndPage(t *testing.T) {
 	//confirm the found models
 	for _, eachModel := range allModelSlice {
 		counter := eachModel.Name
-		if "user"+counter+"@testEmail.com" != eachModel.Email {
-			t.Errorf("counter:%v, want %v for userEmail, got %v", counter, "user"+counter+"@testEmail.com", eachModel.Email)
+		if "user"+counter+"@testemail.com" != eachModel.Email {
+			t.Errorf("counter:%v, want %v for userEmail, got %v", counter, "user"+counter+"@testemail.com", eachModel.Email)
 		}
 		if "dummyPasswordHash" != eachModel.Password {
 			t.Errorf("counter:%v, want %v for password, got %v", counter, "dummyPasswordHash", eachModel.Password)
@@ -460,11 +486,11 @@ func TestFindAllAndPage(t *testing.T) {
 		if "dummyAuthToken"+counter != eachModel.AuthToken {
 			t.Errorf("counter:%v, want %v for authToken, got %v", counter, "dummyAuthToken"+counter, eachModel.AuthToken)
 		}
-		if "dummyGoogleToken"+counter != eachModel.GoogleToken {
-			t.Errorf("counter:%v, want %v for googleToken, got %v", counter, "dummyGoogleToken"+counter, eachModel.GoogleToken)
+		if "dummyGoogleSubject"+counter != eachModel.Identities[model.ProviderGoogle].Subject {
+			t.Errorf("counter:%v, want %v for google subject, got %v", counter, "dummyGoogleSubject"+counter, eachModel.Identities[model.ProviderGoogle].Subject)
 		}
-		if "dummyFacebookToken"+counter != eachModel.FacebookToken {
-			t.Errorf("counter:%v, want %v for facebookToken, got %v", counter, "dummyFacebookToken"+counter, eachModel.FacebookToken)
+		if "dummyFacebookSubject"+counter != eachModel.Identities[model.ProviderFacebook].Subject {
+			t.Errorf("counter:%v, want %v for facebook subject, got %v", counter, "dummyFacebookSubject"+counter, eachModel.Identities[model.ProviderFacebook].Subject)
 		}
 	}
 	cleanupUserTable(t)
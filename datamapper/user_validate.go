@@ -0,0 +1,47 @@
+//Package datamapper provides the definitions of datamapper
+package datamapper
+
+import (
+	"testtrx/model"
+
+	"github.com/go-errors/errors"
+)
+
+//Note: users are validated (see model.User.Validate) before being written, and their email is normalized (see model.NormalizeEmail)
+//when it becomes a partition key (Insert, Upsert and ChangeEmail) so that the stored keys are canonical
+//Emails used for finding users by id are normalized the same way, falling back to the id as is for the users stored before emails were
+//normalized (whose keys may not be canonical), other operations address the stored user by its stored key
+
+//validateUser is a function for validating user before writing it and, previous being its stored looked up values (nil if none or unknown),
+//that its status can change from the stored status (see model.UserStatusTransitions)
+//It returns an ErrInvalidInput error wrapping the model.FieldErrors or the status transition error otherwise
+func validateUser(user *model.User, previous *model.User) *errors.Error {
+	if err := user.Validate(); err != nil {
+		return newError(ErrInvalidInput, err)
+	}
+	if previous == nil {
+		return nil
+	}
+	if err := model.CheckTransition(previous.Status, user.Status); err != nil {
+		return newError(ErrInvalidInput, err)
+	}
+	return nil
+}
+
+//normalizeEmail is a function for returning the canonical form of email, an ErrInvalidInput error if it is malformed
+func normalizeEmail(email string) (string, *errors.Error) {
+	normalized, err := model.NormalizeEmail(email)
+	if err != nil {
+		return "", newError(ErrInvalidInput, err)
+	}
+	return normalized, nil
+}
+
+//findEmail is a function for returning the email to find a user by id with, its canonical form if it is well formed,
+//id as is otherwise (e.g. the email of a user stored before emails were normalized)
+func findEmail(id string) string {
+	if email, err := model.NormalizeEmail(id); err == nil {
+		return email
+	}
+	return id
+}
@@ -0,0 +1,35 @@
+//user_validate_test provides unit tests for the normalization of emails of user datamapper
+package datamapper
+
+import (
+	"errors"
+	"testing"
+	"testtrx/model"
+)
+
+func TestMemoryFindByIDLegacyEmail(t *testing.T) {
+	m := NewMemoryUser()
+	//users stored before emails were normalized have a mixed case domain in their key
+	m.put(&model.User{Email: "legacy@testEmail.com", Name: "legacy", Status: model.UserStatusActive, Version: 1})
+	m.put(&model.User{Email: "moved@testemail.com", Name: "moved", Status: model.UserStatusActive, Version: 2})
+	m.redirects["moved@testEmail.com"] = "moved@testemail.com"
+
+	for id, want := range map[string]string{
+		"legacy@testEmail.com": "legacy@testEmail.com",
+		"moved@testEmail.com":  "moved@testemail.com",
+		//a normalized id finds a user stored with the normalized email only
+		"moved@TESTEMAIL.com": "moved@testemail.com",
+	} {
+		found, err := m.FindByID(id)
+		if err != nil {
+			t.Errorf("Failed to find by id %v: %v", id, err)
+			continue
+		}
+		if want != found.Email {
+			t.Errorf("want %v for email of id %v, got %v", want, id, found.Email)
+		}
+	}
+	if _, err := m.FindByID("legacy@TESTEMAIL.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want not found error for another case of a legacy email, got %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+//Package migration provides the versioned schema migrations of the cassandra keyspace
+package migration
+
+import (
+	stderrors "errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//ErrIrreversible is the error returned when reverting a migration that has no down statements
+var ErrIrreversible = stderrors.New("migration can't be reverted")
+
+//ErrUnknownVersion is the error returned when a migration version isn't known (e.g. reverting a migration applied by a newer release)
+var ErrUnknownVersion = stderrors.New("unknown migration version")
+
+//ErrInvalidMigrations is the error returned when the migrations aren't in strictly ascending order of (positive) version
+var ErrInvalidMigrations = stderrors.New("invalid migrations")
+
+//Migration is a struct of a versioned schema migration
+//Statements of a migration are not applied atomically, so they should be idempotent (e.g. 'IF NOT EXISTS') or a migration should
+//hold a single non idempotent statement, for a failed migration to be safely applied again
+//The same goes for UpFunc, which runs after the up statements and is run again as well (e.g. a backfill should skip the rows
+//already backfilled, and the column it backfills should be added by UpFunc itself)
+type Migration struct {
+	Version     int                                //version of the migration, migrations are applied in ascending order of version
+	Description string                             //short description of the migration
+	Up          []string                           //CQL statements applying the migration
+	UpFunc      func(session *gocql.Session) error //optional data migration run after the up statements
+	Down        []string                           //CQL statements reverting the migration
+	DownFunc    func(session *gocql.Session) error //optional data migration run before the down statements
+}
+
+//Reversible is a function for checking whether the migration can be reverted
+func (m *Migration) Reversible() bool {
+	return len(m.Down) != 0 || m.DownFunc != nil
+}
+
+//Status is a struct of the status of a migration
+type Status struct {
+	Migration           //the migration (only Version is set for applied migrations unknown to this release)
+	Applied   bool      //whether the migration has been applied
+	AppliedAt time.Time //time the migration has been applied at (zero if not applied)
+	Known     bool      //whether the migration is known to this release
+}
+
+//Migrator is a struct for applying and reverting migrations on the keyspace of a session
+//Applied migrations are tracked in the 'schema_migrations' table of the keyspace, which is created on first use
+//Note: migrations must not be run by several processes at the same time (e.g. run them from a single deploy step)
+type Migrator struct {
+	dbSession  *gocql.Session //database connection session object, bound to the migrated keyspace
+	migrations []Migration    //known migrations in ascending order of version
+	dryRun     bool           //whether migrations are only listed instead of being applied/reverted
+}
+
+//NewMigrator is a function for initializing a new migrator of migrations (e.g. Migrations) on the keyspace of session
+func NewMigrator(session *gocql.Session, migrations []Migration) (*Migrator, *errors.Error) {
+	if err := validate(migrations); err != nil {
+		return nil, err
+	}
+	return &Migrator{session, migrations, false}, nil
+}
+
+//SetDryRun is a function for setting dry run mode, in which Up, UpTo, Down and DownTo return the migrations they would apply/revert
+//without changing the keyspace
+func (m *Migrator) SetDryRun(dryRun bool) {
+	m.dryRun = dryRun
+}
+
+//Status is a function for listing the status of all known migrations and of applied migrations unknown to this release,
+//in ascending order of version
+func (m *Migrator) Status() ([]Status, *errors.Error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []Status
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: appliedAt, Known: true})
+		delete(applied, migration.Version)
+	}
+	for version, appliedAt := range applied {
+		statuses = append(statuses, Status{Migration: Migration{Version: version}, Applied: true, AppliedAt: appliedAt})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+//Up is a function for applying all pending migrations, returning the applied migrations
+func (m *Migrator) Up() ([]Migration, *errors.Error) {
+	return m.UpTo(m.migrations[len(m.migrations)-1].Version)
+}
+
+//UpTo is a function for applying the pending migrations up to (and including) version, returning the applied migrations
+//Applying is idempotent: already applied migrations are skipped
+func (m *Migrator) UpTo(version int) ([]Migration, *errors.Error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	pending := pendingUpTo(m.migrations, applied, version)
+	if m.dryRun {
+		return pending, nil
+	}
+	for i, migration := range pending {
+		if err := m.apply(migration); err != nil {
+			return pending[:i], err
+		}
+	}
+	return pending, nil
+}
+
+//Down is a function for reverting the last applied migration, returning the reverted migration (none if no migration is applied)
+func (m *Migrator) Down() ([]Migration, *errors.Error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	last := 0
+	for version := range applied {
+		if version > last {
+			last = version
+		}
+	}
+	if last == 0 {
+		return nil, nil
+	}
+	return m.DownTo(last - 1)
+}
+
+//DownTo is a function for reverting the applied migrations above version (0 reverts all migrations), in descending order of version,
+//returning the reverted migrations
+//It returns an ErrIrreversible or ErrUnknownVersion error without reverting anything if a migration to revert can't be reverted
+func (m *Migrator) DownTo(version int) ([]Migration, *errors.Error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	reverted, err := revertedDownTo(m.migrations, applied, version)
+	if err != nil || m.dryRun {
+		return reverted, err
+	}
+	for i, migration := range reverted {
+		if err := m.revert(migration); err != nil {
+			return reverted[:i], err
+		}
+	}
+	return reverted, nil
+}
+
+//apply is a function for applying a migration and recording it as applied
+func (m *Migrator) apply(migration Migration) *errors.Error {
+	for _, statement := range migration.Up {
+		if err := m.dbSession.Query(statement).Exec(); err != nil {
+			return errors.WrapPrefix(err, fmt.Sprintf("migration %v", migration.Version), 0)
+		}
+	}
+	if migration.UpFunc != nil {
+		if err := migration.UpFunc(m.dbSession); err != nil {
+			return errors.WrapPrefix(err, fmt.Sprintf("migration %v", migration.Version), 0)
+		}
+	}
+	err := m.dbSession.Query(`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`,
+		migration.Version, migration.Description, time.Now()).Exec()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
+}
+
+//revert is a function for reverting a migration and removing its record
+func (m *Migrator) revert(migration Migration) *errors.Error {
+	if migration.DownFunc != nil {
+		if err := migration.DownFunc(m.dbSession); err != nil {
+			return errors.WrapPrefix(err, fmt.Sprintf("migration %v", migration.Version), 0)
+		}
+	}
+	for _, statement := range migration.Down {
+		if err := m.dbSession.Query(statement).Exec(); err != nil {
+			return errors.WrapPrefix(err, fmt.Sprintf("migration %v", migration.Version), 0)
+		}
+	}
+	if err := m.dbSession.Query(`DELETE FROM schema_migrations WHERE version = ?`, migration.Version).Exec(); err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
+}
+
+//applied is a function for reading the applied migration versions with the time they have been applied at,
+//creating the tracking table if it doesn't exist yet
+func (m *Migrator) applied() (map[int]time.Time, *errors.Error) {
+	err := m.dbSession.Query(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version int,
+		description varchar,
+		applied_at timestamp,
+	PRIMARY KEY (version)
+	)`).Exec()
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	applied := map[int]time.Time{}
+	var version int
+	var appliedAt time.Time
+	iter := m.dbSession.Query(`SELECT version, applied_at FROM schema_migrations`).Iter()
+	for iter.Scan(&version, &appliedAt) {
+		applied[version] = appliedAt
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	return applied, nil
+}
+
+//validate is a function for checking that migrations are in strictly ascending order of positive version
+func validate(migrations []Migration) *errors.Error {
+	if len(migrations) == 0 {
+		return errors.WrapPrefix(ErrInvalidMigrations, "no migrations", 0)
+	}
+	previous := 0
+	for _, migration := range migrations {
+		if migration.Version <= previous {
+			return errors.WrapPrefix(ErrInvalidMigrations, fmt.Sprintf("version %v after version %v", migration.Version, previous), 0)
+		}
+		previous = migration.Version
+	}
+	return nil
+}
+
+//pendingUpTo is a function for listing the migrations up to (and including) version that are not applied, in ascending order of version
+//Note: a migration older than applied ones (e.g. merged from another branch) is still pending
+func pendingUpTo(migrations []Migration, applied map[int]time.Time, version int) []Migration {
+	var pending []Migration
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+//revertedDownTo is a function for listing the applied migrations above version in descending order of version,
+//returning an error if any of them is unknown or irreversible
+func revertedDownTo(migrations []Migration, applied map[int]time.Time, version int) ([]Migration, *errors.Error) {
+	known := map[int]Migration{}
+	for _, migration := range migrations {
+		known[migration.Version] = migration
+	}
+	var versions []int
+	for appliedVersion := range applied {
+		if appliedVersion > version {
+			versions = append(versions, appliedVersion)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	var reverted []Migration
+	for _, appliedVersion := range versions {
+		migration, ok := known[appliedVersion]
+		if !ok {
+			return nil, errors.WrapPrefix(ErrUnknownVersion, fmt.Sprintf("migration %v", appliedVersion), 0)
+		}
+		if !migration.Reversible() {
+			return nil, errors.WrapPrefix(ErrIrreversible, fmt.Sprintf("migration %v", appliedVersion), 0)
+		}
+		reverted = append(reverted, migration)
+	}
+	return reverted, nil
+}
@@ -0,0 +1,96 @@
+//migration_test provides unit tests for migration planning
+package migration
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+//testMigrations is a list of migrations for planning tests, migration 3 being irreversible
+var testMigrations = []Migration{
+	{Version: 1, Up: []string{"up 1"}, Down: []string{"down 1"}},
+	{Version: 2, Up: []string{"up 2"}, Down: []string{"down 2"}},
+	{Version: 3, Up: []string{"up 3"}},
+	{Version: 4, Up: []string{"up 4"}, Down: []string{"down 4"}},
+}
+
+func versions(migrations []Migration) []int {
+	var result []int
+	for _, migration := range migrations {
+		result = append(result, migration.Version)
+	}
+	return result
+}
+
+func appliedVersions(versions ...int) map[int]time.Time {
+	applied := map[int]time.Time{}
+	for _, version := range versions {
+		applied[version] = time.Now()
+	}
+	return applied
+}
+
+func assertVersions(t *testing.T, want []int, got []Migration) {
+	t.Helper()
+	if len(want) != len(got) {
+		t.Fatalf("want versions %v, got %v", want, versions(got))
+	}
+	for i := range want {
+		if want[i] != got[i].Version {
+			t.Fatalf("want versions %v, got %v", want, versions(got))
+		}
+	}
+}
+
+func TestMigrationsAreValid(t *testing.T) {
+	if err := validate(Migrations); err != nil {
+		t.Errorf("Invalid migrations: %v", err)
+	}
+}
+
+func TestValidateRejectsUnorderedMigrations(t *testing.T) {
+	for _, migrations := range [][]Migration{
+		nil,
+		{{Version: 0}},
+		{{Version: 1}, {Version: 1}},
+		{{Version: 2}, {Version: 1}},
+	} {
+		if err := validate(migrations); !errors.Is(err, ErrInvalidMigrations) {
+			t.Errorf("want %v error for versions %v, got %v", ErrInvalidMigrations, versions(migrations), err)
+		}
+	}
+}
+
+func TestPendingUpTo(t *testing.T) {
+	assertVersions(t, []int{1, 2, 3, 4}, pendingUpTo(testMigrations, appliedVersions(), 4))
+	assertVersions(t, []int{1, 2}, pendingUpTo(testMigrations, appliedVersions(), 2))
+	assertVersions(t, []int{3, 4}, pendingUpTo(testMigrations, appliedVersions(1, 2), 4))
+	//applying is idempotent
+	assertVersions(t, nil, pendingUpTo(testMigrations, appliedVersions(1, 2, 3, 4), 4))
+	//a migration older than applied ones is still pending
+	assertVersions(t, []int{2}, pendingUpTo(testMigrations, appliedVersions(1, 3, 4), 4))
+}
+
+func TestRevertedDownTo(t *testing.T) {
+	reverted, err := revertedDownTo(testMigrations, appliedVersions(1, 2), 0)
+	if err != nil {
+		t.Fatalf("Failed to plan revert: %v", err)
+	}
+	assertVersions(t, []int{2, 1}, reverted)
+
+	reverted, err = revertedDownTo(testMigrations, appliedVersions(1, 2, 3, 4), 3)
+	if err != nil {
+		t.Fatalf("Failed to plan revert: %v", err)
+	}
+	assertVersions(t, []int{4}, reverted)
+
+	_, err = revertedDownTo(testMigrations, appliedVersions(1, 2, 3, 4), 2)
+	if !errors.Is(err, ErrIrreversible) {
+		t.Errorf("want %v error, got %v", ErrIrreversible, err)
+	}
+	_, err = revertedDownTo(testMigrations, appliedVersions(1, 2, 5), 1)
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("want %v error, got %v", ErrUnknownVersion, err)
+	}
+}
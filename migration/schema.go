@@ -0,0 +1,387 @@
+//Package migration provides the versioned schema migrations of the cassandra keyspace
+package migration
+
+import (
+	"errors"
+	"hash/fnv"
+
+	"github.com/gocql/gocql"
+)
+
+//Migrations is the list of migrations of the keyspace schema in ascending order of version
+//Note: never change a released migration, add a new one instead
+//Columns backfilled by a data migration are added by its function (see addColumn) rather than by an up statement,
+//so that a migration whose backfill failed can be applied again
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create user table",
+		Up: []string{`CREATE TABLE IF NOT EXISTS user (
+			user_email varchar,
+			password varchar,
+			name varchar,
+			status varchar,
+			last_activity timestamp,
+			auth_token varchar,
+			google_token varchar,
+			facebook_token varchar,
+		PRIMARY KEY ((user_email), name)
+		) WITH CLUSTERING ORDER BY (name asc)`},
+		Down: []string{`DROP TABLE IF EXISTS user`},
+	},
+	{
+		Version:     2,
+		Description: "add user version for optimistic concurrency control",
+		UpFunc:      backfillUserVersion,
+		Down:        []string{`ALTER TABLE user DROP version`},
+	},
+	{
+		Version:     3,
+		Description: "create user_email_redirect table",
+		Up: []string{`CREATE TABLE IF NOT EXISTS user_email_redirect (
+			old_email varchar,
+			new_email varchar,
+			changed_at timestamp,
+		PRIMARY KEY (old_email)
+		)`},
+		Down: []string{`DROP TABLE IF EXISTS user_email_redirect`},
+	},
+	{
+		Version:     4,
+		Description: "create user_by_auth_token lookup table",
+		Up: []string{`CREATE TABLE IF NOT EXISTS user_by_auth_token (
+			auth_token varchar,
+			user_email varchar,
+			name varchar,
+		PRIMARY KEY (auth_token)
+		)`},
+		UpFunc: backfillUserByAuthToken,
+		Down:   []string{`DROP TABLE IF EXISTS user_by_auth_token`},
+	},
+	{
+		Version:     5,
+		Description: "create user_by_external_identity lookup table",
+		Up: []string{`CREATE TABLE IF NOT EXISTS user_by_external_identity (
+			provider varchar,
+			subject varchar,
+			user_email varchar,
+			name varchar,
+		PRIMARY KEY ((provider, subject))
+		)`},
+		UpFunc: backfillUserByExternalIdentity,
+		Down:   []string{`DROP TABLE IF EXISTS user_by_external_identity`},
+	},
+	{
+		Version:     6,
+		Description: "add user identities linked at external identity providers",
+		Up: []string{
+			`CREATE TYPE IF NOT EXISTS user_identity (
+				subject varchar,
+				access_token varchar,
+				refresh_token varchar,
+				expires_at timestamp,
+				linked_at timestamp
+			)`,
+		},
+		UpFunc: copyUserTokensToIdentities,
+		Down: []string{
+			`ALTER TABLE user DROP identities`,
+			`DROP TYPE IF EXISTS user_identity`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "drop user google_token and facebook_token replaced by identities",
+		Up:          []string{`ALTER TABLE user DROP (google_token, facebook_token)`},
+		//Note: the columns are added back before copying the identities into them, hence a down function rather than down statements
+		DownFunc: restoreUserTokenColumns,
+	},
+	{
+		Version:     8,
+		Description: "create user_by_status lookup table",
+		Up: []string{`CREATE TABLE IF NOT EXISTS user_by_status (
+			status varchar,
+			bucket int,
+			user_email varchar,
+			name varchar,
+		PRIMARY KEY ((status, bucket), user_email, name)
+		)`},
+		UpFunc: backfillUserByStatus,
+		Down:   []string{`DROP TABLE IF EXISTS user_by_status`},
+	},
+	{
+		Version:     9,
+		Description: "add user deletion time for soft delete",
+		Up:          []string{`ALTER TABLE user ADD deleted_at timestamp`},
+		Down:        []string{`ALTER TABLE user DROP deleted_at`},
+	},
+	{
+		Version:     10,
+		Description: "create user_status_history table",
+		Up: []string{`CREATE TABLE IF NOT EXISTS user_status_history (
+			user_email varchar,
+			name varchar,
+			changed_at timeuuid,
+			from_status varchar,
+			to_status varchar,
+			reason text,
+			actor varchar,
+		PRIMARY KEY ((user_email, name), changed_at)
+		) WITH CLUSTERING ORDER BY (changed_at DESC)`},
+		Down: []string{`DROP TABLE IF EXISTS user_status_history`},
+	},
+	{
+		Version:     11,
+		Description: "create user_session and user_session_by_id tables",
+		//Note: rows are inserted with a TTL, so expired sessions are removed by cassandra
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS user_session (
+				user_email varchar,
+				session_id varchar,
+				created_at timestamp,
+				expires_at timestamp,
+			PRIMARY KEY ((user_email), session_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_session_by_id (
+				session_id varchar,
+				user_email varchar,
+				created_at timestamp,
+				expires_at timestamp,
+			PRIMARY KEY (session_id)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS user_session_by_id`,
+			`DROP TABLE IF EXISTS user_session`,
+		},
+	},
+	{
+		Version:     12,
+		Description: "add user email_owner static column claiming the email of a user",
+		UpFunc:      backfillUserEmailOwner,
+		Down:        []string{`ALTER TABLE user DROP email_owner`},
+	},
+	{
+		Version:     13,
+		Description: "create user_email_redirect_by_new lookup table",
+		Up: []string{`CREATE TABLE IF NOT EXISTS user_email_redirect_by_new (
+			new_email varchar,
+			old_email varchar,
+		PRIMARY KEY ((new_email), old_email)
+		)`},
+		UpFunc: backfillUserEmailRedirectByNew,
+		Down:   []string{`DROP TABLE IF EXISTS user_email_redirect_by_new`},
+	},
+	{
+		Version:     14,
+		Description: "add user created_at column and user_created_at columns of the session tables",
+		//Note: existing users and sessions are left without creation time, which still match each other
+		UpFunc: addUserCreatedAtColumns,
+		Down: []string{
+			`ALTER TABLE user_session_by_id DROP user_created_at`,
+			`ALTER TABLE user_session DROP user_created_at`,
+			`ALTER TABLE user DROP created_at`,
+		},
+	},
+}
+
+//backfillUserVersion is a function for adding the version column and setting version 1 on users stored before versioning,
+//which can't be updated otherwise
+func backfillUserVersion(session *gocql.Session) error {
+	if err := addColumn(session, "user", "version", "bigint"); err != nil {
+		return err
+	}
+	var email, name string
+	var version *int64
+	iter := session.Query(`SELECT user_email, name, version FROM user`).Iter()
+	for iter.Scan(&email, &name, &version) {
+		if version != nil {
+			continue
+		}
+		//Note: 'IF EXISTS' keeps users deleted in the meantime from being recreated by the update
+		_, err := session.Query(`UPDATE user SET version = 1 WHERE user_email = ? AND name = ? IF EXISTS`, email, name).
+			MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+//backfillUserByAuthToken is a function for adding the auth token lookups of the users stored before the lookup table
+func backfillUserByAuthToken(session *gocql.Session) error {
+	var email, name, token string
+	iter := session.Query(`SELECT user_email, name, auth_token FROM user`).Iter()
+	for iter.Scan(&email, &name, &token) {
+		if token == "" {
+			continue
+		}
+		err := session.Query(`INSERT INTO user_by_auth_token (auth_token, user_email, name) VALUES (?, ?, ?)`, token, email, name).Exec()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+//backfillUserByExternalIdentity is a function for adding the external identity lookups of the users stored before the lookup table
+func backfillUserByExternalIdentity(session *gocql.Session) error {
+	var email, name, googleToken, facebookToken string
+	iter := session.Query(`SELECT user_email, name, google_token, facebook_token FROM user`).Iter()
+	for iter.Scan(&email, &name, &googleToken, &facebookToken) {
+		//Note: providers are spelled out (rather than model consts) so that this migration doesn't change with the model
+		for provider, subject := range map[string]string{"google": googleToken, "facebook": facebookToken} {
+			if subject == "" {
+				continue
+			}
+			err := session.Query(`INSERT INTO user_by_external_identity (provider, subject, user_email, name) VALUES (?, ?, ?, ?)`,
+				provider, subject, email, name).Exec()
+			if err != nil {
+				iter.Close()
+				return err
+			}
+		}
+	}
+	return iter.Close()
+}
+
+//copyUserTokensToIdentities is a function for adding the identities column and copying the google_token and facebook_token
+//of the users (holding the user identifier at the provider) into their identities
+func copyUserTokensToIdentities(session *gocql.Session) error {
+	if err := addColumn(session, "user", "identities", "map<varchar, frozen<user_identity>>"); err != nil {
+		return err
+	}
+	var email, name, googleToken, facebookToken string
+	iter := session.Query(`SELECT user_email, name, google_token, facebook_token FROM user`).Iter()
+	for iter.Scan(&email, &name, &googleToken, &facebookToken) {
+		for provider, subject := range map[string]string{"google": googleToken, "facebook": facebookToken} {
+			if subject == "" {
+				continue
+			}
+			//Note: only the subject is known, the other fields of user_identity are left null
+			_, err := session.Query(`UPDATE user SET identities[?] = ? WHERE user_email = ? AND name = ? IF EXISTS`,
+				provider, map[string]interface{}{"subject": subject}, email, name).
+				MapScanCAS(map[string]interface{}{})
+			if err != nil {
+				iter.Close()
+				return err
+			}
+		}
+	}
+	return iter.Close()
+}
+
+//restoreUserTokenColumns is a function for adding back the google_token and facebook_token columns of user,
+//copying the subjects of the users identities at these providers into them
+func restoreUserTokenColumns(session *gocql.Session) error {
+	for _, column := range []string{"google_token", "facebook_token"} {
+		if err := addColumn(session, "user", column, "varchar"); err != nil {
+			return err
+		}
+	}
+	var email, name string
+	var identities map[string]map[string]interface{}
+	iter := session.Query(`SELECT user_email, name, identities FROM user`).Iter()
+	for iter.Scan(&email, &name, &identities) {
+		googleToken, _ := identities["google"]["subject"].(string)
+		facebookToken, _ := identities["facebook"]["subject"].(string)
+		if googleToken == "" && facebookToken == "" {
+			continue
+		}
+		_, err := session.Query(`UPDATE user SET google_token = ?, facebook_token = ? WHERE user_email = ? AND name = ? IF EXISTS`,
+			googleToken, facebookToken, email, name).
+			MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+//backfillUserByStatus is a function for adding the status lookups of the users stored before the lookup table
+func backfillUserByStatus(session *gocql.Session) error {
+	var email, name, status string
+	iter := session.Query(`SELECT user_email, name, status FROM user`).Iter()
+	for iter.Scan(&email, &name, &status) {
+		if status == "" {
+			continue
+		}
+		//Note: the bucket must be computed the same way as by the user datamapper (16 buckets by FNV-1a hash of the email)
+		hash := fnv.New32a()
+		hash.Write([]byte(email))
+		bucket := int(hash.Sum32() % 16)
+		err := session.Query(`INSERT INTO user_by_status (status, bucket, user_email, name) VALUES (?, ?, ?, ?)`,
+			status, bucket, email, name).Exec()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+//backfillUserEmailOwner is a function for adding the email_owner column and claiming the emails of the users stored before it,
+//the email of a partition holding several users being claimed by the first one (ordered by name)
+func backfillUserEmailOwner(session *gocql.Session) error {
+	if err := addColumn(session, "user", "email_owner", "varchar static"); err != nil {
+		return err
+	}
+	var email, name, claimed string
+	iter := session.Query(`SELECT user_email, name FROM user`).Iter()
+	for iter.Scan(&email, &name) {
+		//rows are ordered by partition then name
+		if email == claimed {
+			continue
+		}
+		claimed = email
+		_, err := session.Query(`UPDATE user SET email_owner = ? WHERE user_email = ? IF email_owner = null`, name, email).
+			MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+//backfillUserEmailRedirectByNew is a function for adding the reverse lookups of the email redirects stored before the lookup table
+func backfillUserEmailRedirectByNew(session *gocql.Session) error {
+	var oldEmail, newEmail string
+	iter := session.Query(`SELECT old_email, new_email FROM user_email_redirect`).Iter()
+	for iter.Scan(&oldEmail, &newEmail) {
+		err := session.Query(`INSERT INTO user_email_redirect_by_new (new_email, old_email) VALUES (?, ?)`, newEmail, oldEmail).Exec()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+//addUserCreatedAtColumns is a function for adding the creation time column of users and the one of their sessions,
+//the columns being added one at a time so that a failed attempt can be resumed
+func addUserCreatedAtColumns(session *gocql.Session) error {
+	for _, table := range []string{"user_session", "user_session_by_id"} {
+		if err := addColumn(session, table, "user_created_at", "timestamp"); err != nil {
+			return err
+		}
+	}
+	return addColumn(session, "user", "created_at", "timestamp")
+}
+
+//addColumn is a function for adding column of cqlType to table, unless it already exists (e.g. added by a previous attempt
+//of a migration whose backfill failed)
+func addColumn(session *gocql.Session, table, column, cqlType string) error {
+	//Note: selecting an unknown column is an invalid query, which tells whether the column exists without knowing the keyspace
+	err := session.Query(`SELECT ` + column + ` FROM ` + table + ` LIMIT 1`).Exec()
+	var requestErr gocql.RequestError
+	if err == nil {
+		return nil
+	} else if !errors.As(err, &requestErr) || requestErr.Code() != gocql.ErrCodeInvalid {
+		return err
+	}
+	return session.Query(`ALTER TABLE ` + table + ` ADD ` + column + ` ` + cqlType).Exec()
+}
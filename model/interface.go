@@ -3,5 +3,6 @@ package model
 
 //Model is an interface of a domain model
 type Model interface {
-	getID() string
+	//GetID returns the identifier of the model (the value used by data mappers to address the model)
+	GetID() string
 }
@@ -0,0 +1,21 @@
+//Package model provides the business domain models definitions
+package model
+
+import (
+	"time"
+)
+
+//Session is business domain model definition of an authenticated session of a user, opened by issuing an auth token
+//Note: the auth token itself is not stored, the session is identified by a hash of it
+type Session struct {
+	ID            string    //identifier of the session (hash of its auth token)
+	Email         string    //email of the user owning the session
+	UserCreatedAt time.Time //creation time of the user owning the session (see User.CreatedAt), telling it apart from a later user with the same email
+	CreatedAt     time.Time //time the session has been opened
+	ExpiresAt     time.Time //time the session expires, it is neither found nor valid afterwards
+}
+
+//GetID is a function for returning a session model id
+func (s *Session) GetID() string {
+	return s.ID
+}
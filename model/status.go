@@ -0,0 +1,104 @@
+//Package model provides the business domain models definitions
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//ErrUnknownStatus is the error returned when a user status is not one of UserStatusMap
+var ErrUnknownStatus = errors.New("unknown user status")
+
+//ErrInvalidTransition is the error returned when a user status can't change to another status
+var ErrInvalidTransition = errors.New("invalid user status transition")
+
+//UserStatusTransitions is a map of the allowed transitions of user status, the statuses a status can change to keyed by status
+//Note: a deleted user is restored as inactive, it has to be reactivated afterwards
+var UserStatusTransitions = map[string][]string{
+	UserStatusActive:   {UserStatusInactive, UserStatusDeleted},
+	UserStatusInactive: {UserStatusActive, UserStatusDeleted},
+	UserStatusDeleted:  {UserStatusInactive},
+}
+
+//ValidateStatus is a function for checking that status is a known user status
+func ValidateStatus(status string) error {
+	if _, ok := UserStatusMap[status]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownStatus, status)
+	}
+	return nil
+}
+
+//CheckTransition is a function for checking that a user status can change from status to status, keeping a status being allowed
+func CheckTransition(from, to string) error {
+	if err := ValidateStatus(to); err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	for _, allowed := range UserStatusTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w from %q to %q", ErrInvalidTransition, from, to)
+}
+
+//StatusTransition is business domain model definition of a change of user status, recorded for auditing
+type StatusTransition struct {
+	Email  string    //email of the user
+	Name   string    //name of the user
+	From   string    //status before the transition
+	To     string    //status after the transition
+	Reason string    //reason of the transition
+	Actor  string    //identifier of who made the transition (e.g. the user itself or an administrator)
+	At     time.Time //time of the transition
+}
+
+//StatusGuard is a function for checking whether the transition of user is allowed, in addition to UserStatusTransitions
+//(e.g. only letting administrators delete users), returning an error if it is not
+type StatusGuard func(user *User, transition *StatusTransition) error
+
+//StatusMachine is a struct of the state machine of user status, allowing the transitions of UserStatusTransitions that pass its guards
+type StatusMachine struct {
+	guards []StatusGuard //guards checked on every transition, in order
+}
+
+//NewStatusMachine is a function for initializing a new user status state machine with guards
+func NewStatusMachine(guards ...StatusGuard) *StatusMachine {
+	return &StatusMachine{guards}
+}
+
+//AddGuard is a function for adding a guard checked on every transition
+func (m *StatusMachine) AddGuard(guard StatusGuard) {
+	m.guards = append(m.guards, guard)
+}
+
+//Transition is a function for changing the status of user to status, returning the transition to record
+//It returns an error wrapping ErrUnknownStatus or ErrInvalidTransition if the transition is not allowed (including keeping the status),
+//or the error of the first guard refusing it, in which case user is unchanged
+func (m *StatusMachine) Transition(user *User, status, reason, actor string) (*StatusTransition, error) {
+	if user.Status == status {
+		return nil, fmt.Errorf("%w: user %v already has status %q", ErrInvalidTransition, user.Email, status)
+	}
+	if err := CheckTransition(user.Status, status); err != nil {
+		return nil, err
+	}
+	transition := &StatusTransition{
+		Email:  user.Email,
+		Name:   user.Name,
+		From:   user.Status,
+		To:     status,
+		Reason: reason,
+		Actor:  actor,
+		At:     time.Now(),
+	}
+	for _, guard := range m.guards {
+		if err := guard(user, transition); err != nil {
+			return nil, err
+		}
+	}
+	user.Status = status
+	return transition, nil
+}
@@ -0,0 +1,86 @@
+//status_test provides unit tests for user status state machine
+package model_test
+
+import (
+	"testtrx/model"
+
+	"errors"
+	"testing"
+)
+
+func TestCheckTransition(t *testing.T) {
+	for _, tc := range []struct {
+		from, to string
+		want     error
+	}{
+		{model.UserStatusActive, model.UserStatusInactive, nil},
+		{model.UserStatusActive, model.UserStatusDeleted, nil},
+		{model.UserStatusInactive, model.UserStatusActive, nil},
+		{model.UserStatusInactive, model.UserStatusDeleted, nil},
+		{model.UserStatusDeleted, model.UserStatusInactive, nil},
+		{model.UserStatusActive, model.UserStatusActive, nil},
+		{model.UserStatusDeleted, model.UserStatusActive, model.ErrInvalidTransition},
+		{"", model.UserStatusActive, model.ErrInvalidTransition},
+		{model.UserStatusActive, "X", model.ErrUnknownStatus},
+		{model.UserStatusActive, "", model.ErrUnknownStatus},
+	} {
+		if err := model.CheckTransition(tc.from, tc.to); !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+			t.Errorf("want %v for transition from %q to %q, got %v", tc.want, tc.from, tc.to, err)
+		}
+	}
+}
+
+func TestStatusMachine(t *testing.T) {
+	errRefused := errors.New("refused")
+	//only administrators can delete users
+	machine := model.NewStatusMachine(func(user *model.User, transition *model.StatusTransition) error {
+		if transition.To == model.UserStatusDeleted && transition.Actor != "admin" {
+			return errRefused
+		}
+		return nil
+	})
+	user := &model.User{Email: "user@testemail.com", Name: "user", Status: model.UserStatusActive}
+
+	transition, err := machine.Transition(user, model.UserStatusInactive, "inactivity", "scheduler")
+	if err != nil {
+		t.Fatalf("Failed to transition user: %v", err)
+	}
+	want := model.StatusTransition{Email: user.Email, Name: user.Name, From: model.UserStatusActive, To: model.UserStatusInactive,
+		Reason: "inactivity", Actor: "scheduler", At: transition.At}
+	if want != *transition || transition.At.IsZero() {
+		t.Errorf("want transition %+v, got %+v", want, *transition)
+	}
+	if model.UserStatusInactive != user.Status {
+		t.Errorf("want %v for status, got %v", model.UserStatusInactive, user.Status)
+	}
+
+	//refused transitions leave the user unchanged
+	for _, tc := range []struct {
+		status, actor string
+		want          error
+	}{
+		{model.UserStatusInactive, "admin", model.ErrInvalidTransition},
+		{"X", "admin", model.ErrUnknownStatus},
+		{model.UserStatusDeleted, "user", errRefused},
+	} {
+		if _, err := machine.Transition(user, tc.status, "", tc.actor); !errors.Is(err, tc.want) {
+			t.Errorf("want %v for transition to %q by %v, got %v", tc.want, tc.status, tc.actor, err)
+		}
+		if model.UserStatusInactive != user.Status {
+			t.Errorf("want %v for status, got %v", model.UserStatusInactive, user.Status)
+		}
+	}
+
+	machine.AddGuard(func(user *model.User, transition *model.StatusTransition) error {
+		if transition.Reason == "" {
+			return errRefused
+		}
+		return nil
+	})
+	if _, err := machine.Transition(user, model.UserStatusDeleted, "", "admin"); !errors.Is(err, errRefused) {
+		t.Errorf("want refused error from added guard, got %v", err)
+	}
+	if _, err := machine.Transition(user, model.UserStatusDeleted, "requested", "admin"); err != nil {
+		t.Errorf("Failed to transition user: %v", err)
+	}
+}
@@ -21,19 +21,47 @@ var UserStatusMap = map[string]string{
 	UserStatusDeleted:  "Deleted",
 }
 
+//ProviderGoogle is const for 'Google' external identity provider
+const ProviderGoogle string = "google"
+
+//ProviderFacebook is const for 'Facebook' external identity provider
+const ProviderFacebook string = "facebook"
+
 //User is business domain model definition of user
 type User struct {
-	Email         string
-	Password      string
-	Name          string
-	Status        string
-	LastActivity  time.Time
-	AuthToken     string
-	GoogleToken   string
-	FacebookToken string
+	Email        string
+	Password     string
+	Name         string
+	Status       string
+	LastActivity time.Time
+	AuthToken    string              //single auth token of the user, superseded by sessions allowing several devices (see Session)
+	Identities   map[string]Identity //identities linked to the user at external identity providers (e.g. for social login), keyed by provider
+	CreatedAt    time.Time           //time the user has been created, set by data mapper on insert and kept afterwards (zero for older users)
+	DeletedAt    time.Time           //time the user has been (soft) deleted, zero if it is not deleted
+	Version      int64               //version of the stored user for optimistic concurrency control, incremented by data mapper on every update
+}
+
+//Identity is business domain model definition of a user identity at an external identity provider (linked account)
+type Identity struct {
+	Provider     string    //identity provider, e.g. ProviderGoogle
+	Subject      string    //identifier of the user at the provider
+	AccessToken  string    //access token to the provider API (if any)
+	RefreshToken string    //refresh token of the access token (if any)
+	ExpiresAt    time.Time //expiry time of the access token (zero if unknown)
+	LinkedAt     time.Time //time the identity has been linked to the user
 }
 
 //GetID is a function for returning a user model id
 func (u *User) GetID() string {
 	return u.Email
 }
+
+//ExternalIdentities is a function for returning the subjects of the user identities at external identity providers (e.g. for social login),
+//keyed by provider
+func (u *User) ExternalIdentities() map[string]string {
+	identities := map[string]string{}
+	for provider, identity := range u.Identities {
+		identities[provider] = identity.Subject
+	}
+	return identities
+}
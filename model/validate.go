@@ -0,0 +1,152 @@
+//Package model provides the business domain models definitions
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+//ErrValidation is the error matched (with errors.Is) by the FieldErrors returned by Validate
+var ErrValidation = errors.New("validation failed")
+
+//Codes of FieldError, identifying why a field is invalid
+const (
+	//FieldRequired is the code of a field that must be set
+	FieldRequired string = "required"
+	//FieldMalformed is the code of a field whose value is not well formed (e.g. an email without domain)
+	FieldMalformed string = "malformed"
+	//FieldUnknown is the code of a field whose value is not one of the known values (e.g. an unknown status)
+	FieldUnknown string = "unknown"
+)
+
+//Validator is an interface of a domain model that can validate itself
+type Validator interface {
+	//Validate returns nil if the model is valid, FieldErrors describing its invalid fields otherwise
+	Validate() error
+}
+
+//FieldError is a struct of the validation error of a model field
+type FieldError struct {
+	Field   string //name of the field, e.g. "Email" or "Identities[google].Subject"
+	Code    string //code of the error, e.g. FieldRequired
+	Message string //human readable message
+}
+
+//Error is a function for returning the error message
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+//FieldErrors is a list of field validation errors, returned by Validate
+type FieldErrors []FieldError
+
+//Error is a function for returning the error message, joining the messages of the field errors
+func (e FieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Error()
+	}
+	return ErrValidation.Error() + ": " + strings.Join(messages, "; ")
+}
+
+//Is is a function for matching the error against ErrValidation (used by errors.Is)
+func (e FieldErrors) Is(target error) bool {
+	return target == ErrValidation
+}
+
+//add is a function for adding the error of field with code and message
+func (e *FieldErrors) add(field, code, message string) {
+	*e = append(*e, FieldError{field, code, message})
+}
+
+//err is a function for returning the field errors as an error, nil if there is none
+func (e FieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+//emailDomainProfile is the IDNA profile for converting email domains to their ASCII form, rejecting invalid domain names
+var emailDomainProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true))
+
+//NormalizeEmail is a function for returning the canonical form of email: surrounding spaces trimmed and domain converted
+//to lower case ASCII (internationalized domain names are converted to punycode), the local part being kept as is (it is case sensitive)
+//It returns an error if email is not a well formed address (e.g. "user@example.com", display names are not allowed)
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", fmt.Errorf("malformed email %q: %w", email, err)
+	}
+	if address.Name != "" || address.Address != email {
+		return "", fmt.Errorf("malformed email %q: not a bare address", email)
+	}
+	at := strings.LastIndex(email, "@")
+	domain, err := emailDomainProfile.ToASCII(email[at+1:])
+	if err != nil {
+		return "", fmt.Errorf("malformed email %q: %w", email, err)
+	}
+	if !strings.Contains(domain, ".") {
+		return "", fmt.Errorf("malformed email %q: domain %q is not fully qualified", email, domain)
+	}
+	return email[:at+1] + domain, nil
+}
+
+//make sure User satisfies the Validator interface
+var _ Validator = (*User)(nil)
+
+//Normalize is a function for converting the email of the user to its canonical form (see NormalizeEmail),
+//a malformed email is left as is (Validate reports it)
+func (u *User) Normalize() {
+	if email, err := NormalizeEmail(u.Email); err == nil {
+		u.Email = email
+	}
+}
+
+//Validate is a function for validating the user, returning FieldErrors describing its invalid fields if any
+//Note: the email is only checked to be well formed, use Normalize for converting it to its canonical form
+func (u *User) Validate() error {
+	var fieldErrs FieldErrors
+	if u.Email == "" {
+		fieldErrs.add("Email", FieldRequired, "email is required")
+	} else if _, err := NormalizeEmail(u.Email); err != nil {
+		fieldErrs.add("Email", FieldMalformed, err.Error())
+	}
+	if u.Name == "" {
+		fieldErrs.add("Name", FieldRequired, "name is required")
+	}
+	if u.Status == "" {
+		fieldErrs.add("Status", FieldRequired, "status is required")
+	} else if err := ValidateStatus(u.Status); err != nil {
+		fieldErrs.add("Status", FieldUnknown, err.Error())
+	}
+	if u.LastActivity.IsZero() {
+		fieldErrs.add("LastActivity", FieldRequired, "last activity is required")
+	}
+	providers := make([]string, 0, len(u.Identities))
+	for provider := range u.Identities {
+		providers = append(providers, provider)
+	}
+	//sorted for reporting the field errors in a stable order
+	sort.Strings(providers)
+	for _, provider := range providers {
+		identity := u.Identities[provider]
+		field := "Identities[" + provider + "]"
+		if provider == "" {
+			fieldErrs.add(field, FieldRequired, "identity provider is required")
+		}
+		if identity.Provider != "" && identity.Provider != provider {
+			fieldErrs.add(field+".Provider", FieldMalformed, fmt.Sprintf("identity provider %q differs from its key", identity.Provider))
+		}
+		if identity.Subject == "" {
+			fieldErrs.add(field+".Subject", FieldRequired, "identity subject is required")
+		}
+	}
+	return fieldErrs.err()
+}
@@ -0,0 +1,78 @@
+// validate_test provides unit tests for model validation
+package model_test
+
+import (
+	"testtrx/model"
+
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	for _, tc := range []struct {
+		email, want string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"  User.Name+tag@Example.COM ", "User.Name+tag@example.com"},
+		{"user@Bücher.example", "user@xn--bcher-kva.example"},
+		{"user@xn--bcher-kva.example", "user@xn--bcher-kva.example"},
+	} {
+		got, err := model.NormalizeEmail(tc.email)
+		if err != nil || tc.want != got {
+			t.Errorf("want %q for %q, got %q and %v", tc.want, tc.email, got, err)
+		}
+	}
+	for _, email := range []string{"", "user", "user@", "@example.com", "user@localhost", "user@exa mple.com", "user@-example.com",
+		"user@example..com", "User <user@example.com>", "user@[127.0.0.1]"} {
+		if got, err := model.NormalizeEmail(email); err == nil {
+			t.Errorf("want error for %q, got %q", email, got)
+		}
+	}
+}
+
+func TestUserValidate(t *testing.T) {
+	user := &model.User{
+		Email:        "user@example.com",
+		Name:         "user",
+		Status:       model.UserStatusActive,
+		LastActivity: time.Now(),
+		Identities:   map[string]model.Identity{model.ProviderGoogle: {Provider: model.ProviderGoogle, Subject: "subject"}},
+	}
+	if err := user.Validate(); err != nil {
+		t.Errorf("want valid user, got %v", err)
+	}
+
+	err := (&model.User{
+		Email:  "user@",
+		Status: "X",
+		Identities: map[string]model.Identity{
+			"github":               {Provider: "github"},
+			model.ProviderGoogle:   {Provider: model.ProviderFacebook, Subject: "subject"},
+			model.ProviderFacebook: {Subject: "subject"},
+		},
+	}).Validate()
+	if !errors.Is(err, model.ErrValidation) {
+		t.Fatalf("want validation error, got %v", err)
+	}
+	var fieldErrs model.FieldErrors
+	if !errors.As(err, &fieldErrs) {
+		t.Fatalf("want field errors, got %v", err)
+	}
+	want := []model.FieldError{
+		{Field: "Email", Code: model.FieldMalformed},
+		{Field: "Name", Code: model.FieldRequired},
+		{Field: "Status", Code: model.FieldUnknown},
+		{Field: "LastActivity", Code: model.FieldRequired},
+		{Field: "Identities[github].Subject", Code: model.FieldRequired},
+		{Field: "Identities[google].Provider", Code: model.FieldMalformed},
+	}
+	if len(want) != len(fieldErrs) {
+		t.Fatalf("want %v field errors, got %v", len(want), fieldErrs)
+	}
+	for i := range want {
+		if want[i].Field != fieldErrs[i].Field || want[i].Code != fieldErrs[i].Code || fieldErrs[i].Message == "" {
+			t.Errorf("want %v error for %v, got %+v", want[i].Code, want[i].Field, fieldErrs[i])
+		}
+	}
+}
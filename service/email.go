@@ -0,0 +1,146 @@
+//Package user provides services related to user
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"strings"
+	"testtrx/datamapper"
+	"testtrx/model"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+//ErrInvalidToken is the error returned when a verification or auth token is malformed, forged, expired, revoked or already used
+var ErrInvalidToken = stderrors.New("invalid or expired token")
+
+//DefaultEmailChangeTokenTTL is the default duration an email change verification token is valid for
+const DefaultEmailChangeTokenTTL = 24 * time.Hour
+
+//VerificationSender is an interface for delivering email change verification tokens to the new email address
+//(proving the user owns it), e.g. by sending a mail containing a confirmation link
+type VerificationSender interface {
+	SendEmailChangeVerification(user *model.User, newEmail string, token string) error
+}
+
+//EmailChange is a struct of service for changing the email of users
+//The change is requested first, which sends a verification token to the new email, and only performed once the token is confirmed
+//Tokens are signed with HMAC-SHA256 and carry everything needed to confirm the change, so nothing is stored until confirmation
+type EmailChange struct {
+	userMapper datamapper.UserMapper //user datamapper
+	sender     VerificationSender    //sender of verification tokens
+	secret     []byte                //secret key for signing verification tokens
+	tokenTTL   time.Duration         //duration a verification token is valid for
+}
+
+//emailChangeClaims is a struct of the content of an email change verification token
+type emailChangeClaims struct {
+	Email    string `json:"e"` //current email of the user
+	NewEmail string `json:"n"` //requested new email
+	Expires  int64  `json:"x"` //expiry time of the token (unix nanoseconds)
+	Version  int64  `json:"v"` //version of the user when the change was requested
+}
+
+//NewEmailChange is a function for initializing a new email change service
+func NewEmailChange(userMapper datamapper.UserMapper, sender VerificationSender, secret []byte) *EmailChange {
+	return &EmailChange{userMapper, sender, secret, DefaultEmailChangeTokenTTL}
+}
+
+//SetTokenTTL is a function for setting the duration a verification token is valid for
+func (e *EmailChange) SetTokenTTL(ttl time.Duration) {
+	e.tokenTTL = ttl
+}
+
+//Request is a function for requesting the change of the email of user with email to newEmail,
+//a verification token is sent to newEmail to be confirmed with Confirm
+//It returns a datamapper ErrAlreadyExists error carrying the existing user if another user already has (or had) newEmail,
+//or a datamapper ErrInvalidInput error if newEmail is malformed (the token is sent to its canonical form, see model.NormalizeEmail)
+func (e *EmailChange) Request(email, newEmail string) *errors.Error {
+	newEmail, normalizeErr := model.NormalizeEmail(newEmail)
+	if normalizeErr != nil {
+		return errors.Wrap(&datamapper.Error{Kind: datamapper.ErrInvalidInput, Err: normalizeErr}, 0)
+	}
+	user, err := e.userMapper.FindByID(email)
+	if err != nil {
+		return err
+	}
+	if newEmail == user.Email {
+		return errors.Wrap(&datamapper.Error{Kind: datamapper.ErrInvalidInput, Err: fmt.Errorf("user %v already has email %v", user.Email, newEmail)}, 0)
+	}
+	//Note: FindByID follows redirects, so the new email is also refused if it is the former email of another user
+	//(a user can get back its own former email though)
+	existing, err := e.userMapper.FindByID(newEmail)
+	if err == nil && (existing.Email != user.Email || existing.Name != user.Name) {
+		return errors.Wrap(&datamapper.Error{Kind: datamapper.ErrAlreadyExists, Current: existing}, 0)
+	} else if err != nil && !stderrors.Is(err, datamapper.ErrNotFound) {
+		return err
+	}
+
+	token := e.signToken(emailChangeClaims{user.Email, newEmail, time.Now().Add(e.tokenTTL).UnixNano(), user.Version})
+	if err := e.sender.SendEmailChangeVerification(user, newEmail, token); err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
+}
+
+//Confirm is a function for confirming an email change with the verification token sent by Request, returning the user with its new email
+//It returns an ErrInvalidToken error if the token is malformed, forged, expired or already used
+//Note: a token is bound to the version of the user it was requested for, so it is also rejected once the user has been modified
+//since the request (e.g. its email changed and changed back), the change has to be requested again then
+func (e *EmailChange) Confirm(token string) (*model.User, *errors.Error) {
+	claims, err := e.verifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+	user, err := e.userMapper.FindByID(claims.Email)
+	if err != nil {
+		return nil, err
+	}
+	//the user has been changed since the request (e.g. the token has already been used)
+	if user.Email != claims.Email || user.Version != claims.Version {
+		return nil, errors.Wrap(ErrInvalidToken, 0)
+	}
+	if _, err := e.userMapper.ChangeEmail(user, claims.NewEmail); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+//signToken is a function for encoding claims into a signed verification token
+func (e *EmailChange) signToken(claims emailChangeClaims) string {
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(e.sign(payload))
+}
+
+//verifyToken is a function for decoding the claims of a verification token, checking its signature and expiry
+func (e *EmailChange) verifyToken(token string) (*emailChangeClaims, *errors.Error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidToken, 0)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, 0)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, e.sign(payload)) {
+		return nil, errors.Wrap(ErrInvalidToken, 0)
+	}
+	claims := emailChangeClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil || time.Now().UnixNano() > claims.Expires {
+		return nil, errors.Wrap(ErrInvalidToken, 0)
+	}
+	return &claims, nil
+}
+
+//sign is a function for computing the HMAC-SHA256 signature of a token payload
+func (e *EmailChange) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, e.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
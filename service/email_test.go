@@ -0,0 +1,188 @@
+//email_test provides unit tests for email change service
+package user_test
+
+import (
+	"testtrx/datamapper"
+	"testtrx/datamapper/datamappertest"
+	"testtrx/model"
+	user "testtrx/service"
+
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+//sentVerification is a struct of an email change verification recorded by testSender
+type sentVerification struct {
+	user     *model.User
+	newEmail string
+	token    string
+}
+
+//testSender is a verification sender recording the sent verifications
+type testSender struct {
+	sent []sentVerification
+}
+
+func (s *testSender) SendEmailChangeVerification(user *model.User, newEmail string, token string) error {
+	s.sent = append(s.sent, sentVerification{user, newEmail, token})
+	return nil
+}
+
+func initEmailChangeTest(t *testing.T) (datamapper.UserMapper, *testSender, *user.EmailChange, *model.User) {
+	userMapper := datamapper.NewMemoryUser()
+	userModel := datamappertest.NewTestUser(1)
+	if _, err := userMapper.Insert(userModel); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	sender := &testSender{}
+	return userMapper, sender, user.NewEmailChange(userMapper, sender, []byte("secret")), userModel
+}
+
+func TestEmailChange(t *testing.T) {
+	userMapper, sender, emailChange, userModel := initEmailChangeTest(t)
+	oldEmail := userModel.Email
+
+	if err := emailChange.Request(oldEmail, "changed@test.com"); err != nil {
+		t.Fatalf("Failed to request email change: %v", err)
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("want %v sent verification, got %v", 1, len(sender.sent))
+	}
+	if "changed@test.com" != sender.sent[0].newEmail {
+		t.Errorf("want %v for new email, got %v", "changed@test.com", sender.sent[0].newEmail)
+	}
+
+	//nothing changes until the change is confirmed
+	foundModel, err := userMapper.FindByID(oldEmail)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	if oldEmail != foundModel.Email {
+		t.Errorf("want %v for email, got %v", oldEmail, foundModel.Email)
+	}
+
+	changedModel, err := emailChange.Confirm(sender.sent[0].token)
+	if err != nil {
+		t.Fatalf("Failed to confirm email change: %v", err)
+	}
+	if "changed@test.com" != changedModel.Email {
+		t.Errorf("want %v for email, got %v", "changed@test.com", changedModel.Email)
+	}
+
+	//the old email resolves to the user with its new email
+	foundModel, err = userMapper.FindByID(oldEmail)
+	if err != nil {
+		t.Fatalf("Failed to find by old email: %v", err)
+	}
+	datamappertest.AssertUser(t, changedModel, foundModel)
+
+	//a token can only be used once
+	_, err = emailChange.Confirm(sender.sent[0].token)
+	if !errors.Is(err, user.ErrInvalidToken) {
+		t.Errorf("want %v error for reused token, got %v", user.ErrInvalidToken, err)
+	}
+}
+
+func TestEmailChangeTokenReplay(t *testing.T) {
+	userMapper, sender, emailChange, userModel := initEmailChangeTest(t)
+	oldEmail := userModel.Email
+
+	if err := emailChange.Request(oldEmail, "changed@test.com"); err != nil {
+		t.Fatalf("Failed to request email change: %v", err)
+	}
+	if _, err := emailChange.Confirm(sender.sent[0].token); err != nil {
+		t.Fatalf("Failed to confirm email change: %v", err)
+	}
+	if err := emailChange.Request("changed@test.com", oldEmail); err != nil {
+		t.Fatalf("Failed to request email change: %v", err)
+	}
+	if _, err := emailChange.Confirm(sender.sent[1].token); err != nil {
+		t.Fatalf("Failed to confirm email change: %v", err)
+	}
+
+	//the user has its original email again, the first token can't be used once more
+	if _, err := emailChange.Confirm(sender.sent[0].token); !errors.Is(err, user.ErrInvalidToken) {
+		t.Errorf("want %v error for replayed token, got %v", user.ErrInvalidToken, err)
+	}
+	foundModel, err := userMapper.FindByID(oldEmail)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	if oldEmail != foundModel.Email {
+		t.Errorf("want %v for email, got %v", oldEmail, foundModel.Email)
+	}
+
+	//nor can a token requested before any other change of the user
+	if err := emailChange.Request(oldEmail, "other@test.com"); err != nil {
+		t.Fatalf("Failed to request email change: %v", err)
+	}
+	if _, err := userMapper.Update(foundModel); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	if _, err := emailChange.Confirm(sender.sent[2].token); !errors.Is(err, user.ErrInvalidToken) {
+		t.Errorf("want %v error for token of a modified user, got %v", user.ErrInvalidToken, err)
+	}
+}
+
+func TestEmailChangeRequestRejected(t *testing.T) {
+	userMapper, sender, emailChange, userModel := initEmailChangeTest(t)
+	otherModel := datamappertest.NewTestUser(2)
+	if _, err := userMapper.Insert(otherModel); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+
+	err := emailChange.Request(userModel.Email, otherModel.Email)
+	if !errors.Is(err, datamapper.ErrAlreadyExists) {
+		t.Errorf("want %v error for taken email, got %v", datamapper.ErrAlreadyExists, err)
+	}
+	err = emailChange.Request(userModel.Email, userModel.Email)
+	if !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want %v error for unchanged email, got %v", datamapper.ErrInvalidInput, err)
+	}
+	err = emailChange.Request("missing@test.com", "changed@test.com")
+	if !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want %v error for missing user, got %v", datamapper.ErrNotFound, err)
+	}
+	err = emailChange.Request(userModel.Email, "changed@")
+	if !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want %v error for malformed email, got %v", datamapper.ErrInvalidInput, err)
+	}
+	//emails are compared in their canonical form
+	local, domain, _ := strings.Cut(otherModel.Email, "@")
+	err = emailChange.Request(userModel.Email, " "+local+"@"+strings.ToUpper(domain))
+	if !errors.Is(err, datamapper.ErrAlreadyExists) {
+		t.Errorf("want %v error for taken email, got %v", datamapper.ErrAlreadyExists, err)
+	}
+	if len(sender.sent) != 0 {
+		t.Errorf("want %v sent verifications, got %v", 0, len(sender.sent))
+	}
+}
+
+func TestEmailChangeInvalidToken(t *testing.T) {
+	userMapper, sender, emailChange, userModel := initEmailChangeTest(t)
+
+	//tokens signed with another secret are rejected
+	otherEmailChange := user.NewEmailChange(userMapper, sender, []byte("other secret"))
+	if err := otherEmailChange.Request(userModel.Email, "changed@test.com"); err != nil {
+		t.Fatalf("Failed to request email change: %v", err)
+	}
+	for _, token := range []string{"", "garbage", "garbage.garbage", sender.sent[0].token, sender.sent[0].token + "x"} {
+		_, err := emailChange.Confirm(token)
+		if !errors.Is(err, user.ErrInvalidToken) {
+			t.Errorf("want %v error for token %q, got %v", user.ErrInvalidToken, token, err)
+		}
+	}
+
+	//expired tokens are rejected
+	emailChange.SetTokenTTL(time.Nanosecond)
+	if err := emailChange.Request(userModel.Email, "changed@test.com"); err != nil {
+		t.Fatalf("Failed to request email change: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	_, err := emailChange.Confirm(sender.sent[1].token)
+	if !errors.Is(err, user.ErrInvalidToken) {
+		t.Errorf("want %v error for expired token, got %v", user.ErrInvalidToken, err)
+	}
+}
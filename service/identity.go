@@ -0,0 +1,65 @@
+//Package user provides services related to user
+package user
+
+import (
+	"fmt"
+	"testtrx/datamapper"
+	"testtrx/model"
+
+	"github.com/go-errors/errors"
+)
+
+//DefaultIdentityLinkRetries is the default number of times linking or unlinking an identity is retried when the user is modified concurrently
+const DefaultIdentityLinkRetries = 3
+
+//IdentityLink is a struct of service for linking the identities of users at external identity providers (e.g. for social login)
+type IdentityLink struct {
+	userMapper datamapper.UserMapper //user datamapper
+	retries    int                   //number of retries on concurrent modification of the user
+}
+
+//NewIdentityLink is a function for initializing a new identity link service
+func NewIdentityLink(userMapper datamapper.UserMapper) *IdentityLink {
+	return &IdentityLink{userMapper, DefaultIdentityLinkRetries}
+}
+
+//SetRetries is a function for setting the number of times linking or unlinking is retried when the user is modified concurrently
+func (i *IdentityLink) SetRetries(retries int) {
+	i.retries = retries
+}
+
+//Link is a function for linking identity to the user with email, replacing the identity of the user at the same provider if any,
+//returning the updated user
+//It returns a datamapper ErrAlreadyExists error carrying the user the identity is linked to if it is linked to another user
+func (i *IdentityLink) Link(email string, identity model.Identity) (*model.User, *errors.Error) {
+	return i.retry(email, func(user *model.User) *errors.Error {
+		_, err := i.userMapper.Link(user, identity)
+		return err
+	})
+}
+
+//Unlink is a function for unlinking the identity at provider from the user with email, returning the updated user
+//It returns a datamapper ErrInvalidInput error if the identity is the last way for the user to sign in (the user has no password
+//nor other identity), or a datamapper ErrNotFound error if the user has no identity linked at provider
+func (i *IdentityLink) Unlink(email, provider string) (*model.User, *errors.Error) {
+	return i.retry(email, func(user *model.User) *errors.Error {
+		if _, linked := user.Identities[provider]; linked && user.Password == "" && len(user.Identities) == 1 {
+			return errors.Wrap(&datamapper.Error{
+				Kind: datamapper.ErrInvalidInput,
+				Err:  fmt.Errorf("identity at %v is the last sign-in method of user %v", provider, user.Email),
+			}, 0)
+		}
+		_, err := i.userMapper.Unlink(user, provider)
+		return err
+	})
+}
+
+//retry is a function for applying change to the user with email, applying it again to the latest stored user
+//when it fails because the user has been modified concurrently
+func (i *IdentityLink) retry(email string, change func(user *model.User) *errors.Error) (*model.User, *errors.Error) {
+	user, err := i.userMapper.FindByID(email)
+	if err != nil {
+		return nil, err
+	}
+	return retryOnConflict(i.userMapper, i.retries, user, change)
+}
@@ -0,0 +1,121 @@
+//identity_test provides unit tests for identity link service
+package user_test
+
+import (
+	"testtrx/datamapper"
+	"testtrx/datamapper/datamappertest"
+	"testtrx/model"
+	user "testtrx/service"
+
+	"errors"
+	"testing"
+
+	goerrors "github.com/go-errors/errors"
+)
+
+//concurrentMapper is a user datamapper updating the stored user right before the first link,
+//as if the user had been modified concurrently
+type concurrentMapper struct {
+	datamapper.UserMapper
+	modified bool
+}
+
+func (m *concurrentMapper) Link(userModel *model.User, identity model.Identity) (bool, *goerrors.Error) {
+	if !m.modified {
+		m.modified = true
+		concurrent := *userModel
+		concurrent.Status = model.UserStatusInactive
+		if _, err := m.UserMapper.Update(&concurrent); err != nil {
+			return false, err
+		}
+	}
+	return m.UserMapper.Link(userModel, identity)
+}
+
+func initIdentityLinkTest(t *testing.T, userModel *model.User) (datamapper.UserMapper, *user.IdentityLink) {
+	userMapper := datamapper.NewMemoryUser()
+	if _, err := userMapper.Insert(userModel); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	return userMapper, user.NewIdentityLink(userMapper)
+}
+
+func TestIdentityLink(t *testing.T) {
+	userModel := datamappertest.NewTestUser(1)
+	userMapper, identityLink := initIdentityLinkTest(t, userModel)
+
+	githubIdentity := datamappertest.NewTestIdentity("github", 1)
+	linkedModel, err := identityLink.Link(userModel.Email, githubIdentity)
+	if err != nil {
+		t.Fatalf("Failed to link identity: %v", err)
+	}
+	foundModel, err := userMapper.FindByProvider("github", githubIdentity.Subject)
+	if err != nil {
+		t.Fatalf("Failed to find by linked identity: %v", err)
+	}
+	datamappertest.AssertIdentity(t, githubIdentity, foundModel.Identities["github"])
+	datamappertest.AssertUser(t, linkedModel, foundModel)
+
+	unlinkedModel, err := identityLink.Unlink(userModel.Email, "github")
+	if err != nil {
+		t.Fatalf("Failed to unlink identity: %v", err)
+	}
+	if _, linked := unlinkedModel.Identities["github"]; linked {
+		t.Errorf("want github identity unlinked, got %v", unlinkedModel.Identities)
+	}
+	if _, err := identityLink.Unlink(userModel.Email, "github"); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for unlinked provider, got %v", err)
+	}
+}
+
+func TestIdentityLinkRetriesOnConflict(t *testing.T) {
+	userModel := datamappertest.NewTestUser(1)
+	userMapper, _ := initIdentityLinkTest(t, userModel)
+	identityLink := user.NewIdentityLink(&concurrentMapper{UserMapper: userMapper})
+
+	linkedModel, err := identityLink.Link(userModel.Email, datamappertest.NewTestIdentity("github", 1))
+	if err != nil {
+		t.Fatalf("Failed to link identity: %v", err)
+	}
+	//the concurrent modification is kept
+	if model.UserStatusInactive != linkedModel.Status {
+		t.Errorf("want %v for status, got %v", model.UserStatusInactive, linkedModel.Status)
+	}
+	if 3 != linkedModel.Version {
+		t.Errorf("want %v for version, got %v", 3, linkedModel.Version)
+	}
+
+	//no retry is made when retries are disabled
+	identityLink = user.NewIdentityLink(&concurrentMapper{UserMapper: userMapper})
+	identityLink.SetRetries(0)
+	if _, err := identityLink.Link(userModel.Email, datamappertest.NewTestIdentity("apple", 1)); !errors.Is(err, datamapper.ErrConflict) {
+		t.Errorf("want conflict error, got %v", err)
+	}
+}
+
+func TestIdentityLinkRejected(t *testing.T) {
+	userModel := datamappertest.NewTestUser(1)
+	userModel.Password = ""
+	userModel.Identities = map[string]model.Identity{model.ProviderGoogle: datamappertest.NewTestIdentity(model.ProviderGoogle, 1)}
+	userMapper, identityLink := initIdentityLinkTest(t, userModel)
+	otherModel := datamappertest.NewTestUser(2)
+	if _, err := userMapper.Insert(otherModel); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+
+	//an identity linked to another user can't be linked
+	if _, err := identityLink.Link(userModel.Email, otherModel.Identities[model.ProviderFacebook]); !errors.Is(err, datamapper.ErrAlreadyExists) {
+		t.Errorf("want already exists error, got %v", err)
+	}
+
+	//the last sign-in method of a user without password can't be unlinked
+	if _, err := identityLink.Unlink(userModel.Email, model.ProviderGoogle); !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want invalid input error, got %v", err)
+	}
+	if _, err := identityLink.Link(userModel.Email, datamappertest.NewTestIdentity("github", 1)); err != nil {
+		t.Fatalf("Failed to link identity: %v", err)
+	}
+	if _, err := identityLink.Unlink(userModel.Email, model.ProviderGoogle); err != nil {
+		t.Errorf("Failed to unlink identity: %v", err)
+	}
+}
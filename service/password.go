@@ -0,0 +1,285 @@
+//Package user provides services related to user
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	stderrors "errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//Note: hashes are stored in the PHC string format ($<algorithm>$v=<version>$<param>=<value>,...$<salt>$<hash>, salt and hash
+//being base64 encoded without padding), so that a hash carries everything needed for verifying it and for telling whether it was made
+//with outdated parameters (see PasswordHasher.NeedsRehash)
+
+//ErrUnsupportedHash is the error returned when verifying a password against a hash that is malformed or made by another algorithm
+var ErrUnsupportedHash = stderrors.New("unsupported password hash")
+
+//PasswordHasher is an interface for hashing user passwords (the hash being stored in model.User.Password)
+//and verifying passwords against their hash
+type PasswordHasher interface {
+	//Hash returns the hash of password
+	Hash(password string) (string, error)
+	//Verify returns whether password matches hash, an error wrapping ErrUnsupportedHash if hash can't be verified by the hasher
+	Verify(hash, password string) (bool, error)
+	//NeedsRehash returns whether hash was not made by the hasher with its current parameters (e.g. with a lower cost),
+	//in which case the password should be hashed again once verified
+	NeedsRehash(hash string) bool
+}
+
+//phcEncoding is the base64 encoding of salts and hashes in PHC strings
+var phcEncoding = base64.RawStdEncoding
+
+//phcHash is a struct of a hash in the PHC string format
+type phcHash struct {
+	id      string            //identifier of the algorithm
+	version string            //version of the algorithm, empty if none
+	params  map[string]string //parameters of the algorithm
+	salt    []byte            //salt
+	key     []byte            //hash of the password
+}
+
+//parsePHC is a function for parsing hash in the PHC string format made by algorithm id, with salt and hash
+func parsePHC(hash string, id string) (*phcHash, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) < 5 || fields[0] != "" || fields[1] != id {
+		return nil, fmt.Errorf("%w: not a %v hash", ErrUnsupportedHash, id)
+	}
+	parsed := &phcHash{id: id, params: map[string]string{}}
+	fields = fields[2:]
+	if version, ok := strings.CutPrefix(fields[0], "v="); ok {
+		parsed.version = version
+		fields = fields[1:]
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("%w: malformed %v hash", ErrUnsupportedHash, id)
+	}
+	for _, param := range strings.Split(fields[0], ",") {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: malformed %v hash parameter %q", ErrUnsupportedHash, id, param)
+		}
+		parsed.params[name] = value
+	}
+	var err error
+	if parsed.salt, err = phcEncoding.DecodeString(fields[1]); err != nil {
+		return nil, fmt.Errorf("%w: malformed %v hash salt: %v", ErrUnsupportedHash, id, err)
+	}
+	if parsed.key, err = phcEncoding.DecodeString(fields[2]); err != nil {
+		return nil, fmt.Errorf("%w: malformed %v hash: %v", ErrUnsupportedHash, id, err)
+	}
+	return parsed, nil
+}
+
+//uintParam is a function for returning the parameter name of the hash as an unsigned integer of bitSize bits
+func (h *phcHash) uintParam(name string, bitSize int) (uint64, error) {
+	value, err := strconv.ParseUint(h.params[name], 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("%w: malformed %v hash parameter %v: %v", ErrUnsupportedHash, h.id, name, err)
+	}
+	return value, nil
+}
+
+//BcryptHasher is a struct of password hasher using bcrypt, whose hashes are stored as $bcrypt$r=<cost>$<salt>$<hash>
+//It also verifies hashes in the bcrypt modular crypt format ($2a$<cost>$...), which always need to be rehashed
+type BcryptHasher struct {
+	cost int //bcrypt cost of the hashes (the number of rounds being 2^cost)
+}
+
+//make sure BcryptHasher satisfies the PasswordHasher interface
+var _ PasswordHasher = (*BcryptHasher)(nil)
+
+//bcryptEncoding is the base64 encoding of salts and hashes in the bcrypt modular crypt format
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+//bcryptSaltLength is the length of a bcrypt salt encoded in the bcrypt modular crypt format
+const bcryptSaltLength = 22
+
+//NewBcryptHasher is a function for initializing a new bcrypt password hasher with cost (e.g. bcrypt.DefaultCost)
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{cost}
+}
+
+//Hash is a function for returning the bcrypt hash of password
+//Note: bcrypt only hashes the first 72 bytes of a password, longer passwords are refused
+func (b *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	if err != nil {
+		return "", err
+	}
+	//the modular crypt format is $2a$<cost>$<salt><hash>
+	fields := strings.Split(string(hash), "$")
+	salt, err := bcryptEncoding.DecodeString(fields[3][:bcryptSaltLength])
+	if err != nil {
+		return "", err
+	}
+	key, err := bcryptEncoding.DecodeString(fields[3][bcryptSaltLength:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$bcrypt$r=%d$%s$%s", b.cost, phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+//Verify is a function for returning whether password matches the bcrypt hash (whatever its cost)
+func (b *BcryptHasher) Verify(hash, password string) (bool, error) {
+	cryptHash, err := bcryptCryptHash(hash)
+	if err != nil {
+		return false, err
+	}
+	//Note: bcrypt compares the hashes in constant time
+	err = bcrypt.CompareHashAndPassword([]byte(cryptHash), []byte(password))
+	if stderrors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrUnsupportedHash, err)
+	}
+	return true, nil
+}
+
+//NeedsRehash is a function for returning whether hash is not a bcrypt PHC hash with the hasher cost
+func (b *BcryptHasher) NeedsRehash(hash string) bool {
+	parsed, err := parsePHC(hash, "bcrypt")
+	if err != nil {
+		return true
+	}
+	cost, err := parsed.uintParam("r", 8)
+	return err != nil || int(cost) != b.cost
+}
+
+//bcryptCryptHash is a function for converting a bcrypt hash to the bcrypt modular crypt format, which it may already be in
+func bcryptCryptHash(hash string) (string, error) {
+	if strings.HasPrefix(hash, "$2") {
+		return hash, nil
+	}
+	parsed, err := parsePHC(hash, "bcrypt")
+	if err != nil {
+		return "", err
+	}
+	cost, err := parsed.uintParam("r", 8)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$2a$%02d$%s%s", cost, bcryptEncoding.EncodeToString(parsed.salt), bcryptEncoding.EncodeToString(parsed.key)), nil
+}
+
+//Argon2idParams is a struct of the parameters of argon2id hashes
+type Argon2idParams struct {
+	Memory      uint32 //memory used, in KiB
+	Iterations  uint32 //number of passes over the memory
+	Parallelism uint8  //number of threads
+	SaltLength  uint32 //length of the random salt, in bytes
+	KeyLength   uint32 //length of the hash, in bytes
+}
+
+//DefaultArgon2idParams is the default parameters of argon2id hashes (the second recommended option of RFC 9106)
+var DefaultArgon2idParams = Argon2idParams{Memory: 64 * 1024, Iterations: 3, Parallelism: 4, SaltLength: 16, KeyLength: 32}
+
+//Argon2idHasher is a struct of password hasher using argon2id, whose hashes are stored as $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+type Argon2idHasher struct {
+	params Argon2idParams //parameters of the hashes
+}
+
+//make sure Argon2idHasher satisfies the PasswordHasher interface
+var _ PasswordHasher = (*Argon2idHasher)(nil)
+
+//NewArgon2idHasher is a function for initializing a new argon2id password hasher with params (e.g. DefaultArgon2idParams)
+func NewArgon2idHasher(params Argon2idParams) *Argon2idHasher {
+	return &Argon2idHasher{params}
+}
+
+//Hash is a function for returning the argon2id hash of password with a random salt
+func (a *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.params.Iterations, a.params.Memory, a.params.Parallelism, a.params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.params.Memory, a.params.Iterations, a.params.Parallelism,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+//Verify is a function for returning whether password matches the argon2id hash (whatever its parameters)
+func (a *Argon2idHasher) Verify(hash, password string) (bool, error) {
+	parsed, params, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), parsed.salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1, nil
+}
+
+//NeedsRehash is a function for returning whether hash is not an argon2id hash with the hasher parameters
+func (a *Argon2idHasher) NeedsRehash(hash string) bool {
+	_, params, err := parseArgon2id(hash)
+	return err != nil || params != a.params
+}
+
+//parseArgon2id is a function for parsing an argon2id hash, returning its parameters
+func parseArgon2id(hash string) (*phcHash, Argon2idParams, error) {
+	parsed, err := parsePHC(hash, "argon2id")
+	if err != nil {
+		return nil, Argon2idParams{}, err
+	}
+	if parsed.version != strconv.Itoa(argon2.Version) {
+		return nil, Argon2idParams{}, fmt.Errorf("%w: unsupported argon2id version %q", ErrUnsupportedHash, parsed.version)
+	}
+	memory, err := parsed.uintParam("m", 32)
+	if err != nil {
+		return nil, Argon2idParams{}, err
+	}
+	iterations, err := parsed.uintParam("t", 32)
+	if err != nil {
+		return nil, Argon2idParams{}, err
+	}
+	parallelism, err := parsed.uintParam("p", 8)
+	if err != nil {
+		return nil, Argon2idParams{}, err
+	}
+	if iterations == 0 || parallelism == 0 || len(parsed.key) == 0 {
+		return nil, Argon2idParams{}, fmt.Errorf("%w: malformed argon2id hash", ErrUnsupportedHash)
+	}
+	return parsed, Argon2idParams{uint32(memory), uint32(iterations), uint8(parallelism), uint32(len(parsed.salt)), uint32(len(parsed.key))}, nil
+}
+
+//MigratingHasher is a struct of password hasher hashing passwords with a current hasher while still verifying the hashes
+//of previous hashers, which need to be rehashed (e.g. for moving from bcrypt to argon2id)
+type MigratingHasher struct {
+	current  PasswordHasher   //hasher of new hashes
+	previous []PasswordHasher //hashers of the hashes made before, tried in order
+}
+
+//make sure MigratingHasher satisfies the PasswordHasher interface
+var _ PasswordHasher = (*MigratingHasher)(nil)
+
+//NewMigratingHasher is a function for initializing a new password hasher hashing with current and verifying hashes of current or previous
+func NewMigratingHasher(current PasswordHasher, previous ...PasswordHasher) *MigratingHasher {
+	return &MigratingHasher{current, previous}
+}
+
+//Hash is a function for returning the hash of password by the current hasher
+func (m *MigratingHasher) Hash(password string) (string, error) {
+	return m.current.Hash(password)
+}
+
+//Verify is a function for returning whether password matches hash, verified by the first hasher supporting it
+func (m *MigratingHasher) Verify(hash, password string) (bool, error) {
+	matches, err := m.current.Verify(hash, password)
+	for _, hasher := range m.previous {
+		if !stderrors.Is(err, ErrUnsupportedHash) {
+			break
+		}
+		matches, err = hasher.Verify(hash, password)
+	}
+	return matches, err
+}
+
+//NeedsRehash is a function for returning whether hash was not made by the current hasher with its current parameters
+func (m *MigratingHasher) NeedsRehash(hash string) bool {
+	return m.current.NeedsRehash(hash)
+}
@@ -0,0 +1,133 @@
+//password_test provides unit tests for password hashers
+package user_test
+
+import (
+	user "testtrx/service"
+
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//testArgon2idParams is the parameters of the argon2id hashes of the tests, low for keeping the tests fast
+var testArgon2idParams = user.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestBcryptHasher(t *testing.T) {
+	hasher := user.NewBcryptHasher(bcrypt.MinCost)
+	hash, err := hasher.Hash("dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$bcrypt$r=4$") {
+		t.Errorf("want bcrypt PHC hash, got %v", hash)
+	}
+	assertVerify(t, hasher, hash)
+	if hasher.NeedsRehash(hash) {
+		t.Errorf("want no rehash of %v", hash)
+	}
+	if !user.NewBcryptHasher(bcrypt.MinCost + 1).NeedsRehash(hash) {
+		t.Errorf("want rehash of %v with higher cost", hash)
+	}
+
+	//hashes in the bcrypt modular crypt format are verified and rehashed
+	cryptHash, err := bcrypt.GenerateFromPassword([]byte("dummyPassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	assertVerify(t, hasher, string(cryptHash))
+	if !hasher.NeedsRehash(string(cryptHash)) {
+		t.Errorf("want rehash of %v", string(cryptHash))
+	}
+}
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher := user.NewArgon2idHasher(testArgon2idParams)
+	hash, err := hasher.Hash("dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("want argon2id PHC hash, got %v", hash)
+	}
+	assertVerify(t, hasher, hash)
+	//hashes are salted
+	if otherHash, err := hasher.Hash("dummyPassword"); err != nil || otherHash == hash {
+		t.Errorf("want another hash of the same password, got %v and %v", otherHash, err)
+	}
+	if hasher.NeedsRehash(hash) {
+		t.Errorf("want no rehash of %v", hash)
+	}
+	upgradedParams := testArgon2idParams
+	upgradedParams.Iterations++
+	if !user.NewArgon2idHasher(upgradedParams).NeedsRehash(hash) {
+		t.Errorf("want rehash of %v with more iterations", hash)
+	}
+	//hashes with other parameters are still verified
+	assertVerify(t, user.NewArgon2idHasher(upgradedParams), hash)
+}
+
+func TestUnsupportedHash(t *testing.T) {
+	bcryptHash, err := user.NewBcryptHasher(bcrypt.MinCost).Hash("dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	argon2idHash, err := user.NewArgon2idHasher(testArgon2idParams).Hash("dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	for _, tc := range []struct {
+		hasher user.PasswordHasher
+		hashes []string
+	}{
+		{user.NewBcryptHasher(bcrypt.MinCost), []string{"", "dummyPasswordHash", argon2idHash, "$bcrypt$r=x$c2FsdA$aGFzaA", "$bcrypt$r=4$!$!"}},
+		{user.NewArgon2idHasher(testArgon2idParams), []string{"", "dummyPasswordHash", bcryptHash, "$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+			"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$aGFzaA", "$argon2id$v=19$m=1024$c2FsdA$aGFzaA"}},
+	} {
+		for _, hash := range tc.hashes {
+			if matches, err := tc.hasher.Verify(hash, "dummyPassword"); matches || !errors.Is(err, user.ErrUnsupportedHash) {
+				t.Errorf("want %v error for %q, got %v and %v", user.ErrUnsupportedHash, hash, matches, err)
+			}
+			if !tc.hasher.NeedsRehash(hash) {
+				t.Errorf("want rehash of %q", hash)
+			}
+		}
+	}
+}
+
+func TestMigratingHasher(t *testing.T) {
+	bcryptHasher := user.NewBcryptHasher(bcrypt.MinCost)
+	hasher := user.NewMigratingHasher(user.NewArgon2idHasher(testArgon2idParams), bcryptHasher)
+	hash, err := hasher.Hash("dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$") || hasher.NeedsRehash(hash) {
+		t.Errorf("want up to date argon2id hash, got %v", hash)
+	}
+	assertVerify(t, hasher, hash)
+
+	bcryptHash, err := bcryptHasher.Hash("dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	assertVerify(t, hasher, bcryptHash)
+	if !hasher.NeedsRehash(bcryptHash) {
+		t.Errorf("want rehash of %v", bcryptHash)
+	}
+	if matches, err := hasher.Verify("dummyPasswordHash", "dummyPassword"); matches || !errors.Is(err, user.ErrUnsupportedHash) {
+		t.Errorf("want %v error, got %v and %v", user.ErrUnsupportedHash, matches, err)
+	}
+}
+
+//assertVerify is a function for asserting that hasher verifies hash against the password it was made of, and only against it
+func assertVerify(tb testing.TB, hasher user.PasswordHasher, hash string) {
+	tb.Helper()
+	if matches, err := hasher.Verify(hash, "dummyPassword"); !matches || err != nil {
+		tb.Errorf("want password matching %v, got %v and %v", hash, matches, err)
+	}
+	if matches, err := hasher.Verify(hash, "wrongPassword"); matches || err != nil {
+		tb.Errorf("want wrong password not matching %v, got %v and %v", hash, matches, err)
+	}
+}
@@ -0,0 +1,79 @@
+//Package user provides services related to user
+package user
+
+import (
+	"testtrx/datamapper"
+	"testtrx/model"
+
+	"github.com/go-errors/errors"
+)
+
+//StatusChange is a struct of service for changing the status of users through the user status state machine,
+//recording every transition (with its reason and actor) in the status history for auditing
+type StatusChange struct {
+	userMapper datamapper.UserMapper          //user datamapper
+	history    datamapper.StatusHistoryMapper //status history datamapper
+	machine    *model.StatusMachine           //state machine checking the transitions
+	tokens     *TokenService                  //token service revoking the tokens of deleted users (nil for none, see SetTokenService)
+}
+
+//NewStatusChange is a function for initializing a new status change service, transitions being checked by machine
+//(model.NewStatusMachine() for no guard)
+func NewStatusChange(userMapper datamapper.UserMapper, history datamapper.StatusHistoryMapper, machine *model.StatusMachine) *StatusChange {
+	return &StatusChange{userMapper: userMapper, history: history, machine: machine}
+}
+
+//SetTokenService is a function for setting the token service revoking the tokens of the users when they are deleted
+func (s *StatusChange) SetTokenService(tokens *TokenService) {
+	s.tokens = tokens
+}
+
+//Change is a function for changing the status of the user with email to status, for reason and by actor, returning the updated user
+//Deleting (changing to model.UserStatusDeleted) marks the user as deleted (see datamapper.WithSoftDelete) and restoring
+//(changing from model.UserStatusDeleted) restores it
+//It returns a datamapper ErrInvalidInput error wrapping the state machine error if the transition is not allowed,
+//or a datamapper ErrConflict error if the user is modified concurrently
+//The tokens of a deleted user are revoked once the transition is recorded (see SetTokenService)
+//Note: the transition is recorded once the status is changed, if recording fails the error is returned but the status stays changed
+func (s *StatusChange) Change(email, status, reason, actor string) (*model.User, *errors.Error) {
+	user, err := s.userMapper.With(datamapper.WithIncludeDeleted(true)).FindByID(email)
+	if err != nil {
+		return nil, err
+	}
+	from := user.Status
+	transition, transitionErr := s.machine.Transition(user, status, reason, actor)
+	if transitionErr != nil {
+		return nil, errors.Wrap(&datamapper.Error{Kind: datamapper.ErrInvalidInput, Err: transitionErr}, 0)
+	}
+	switch {
+	case status == model.UserStatusDeleted:
+		_, err = s.userMapper.With(datamapper.WithSoftDelete(true)).Delete(user)
+	case from == model.UserStatusDeleted:
+		_, err = s.userMapper.Restore(user)
+	default:
+		_, err = s.userMapper.Update(user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.history.Add(transition); err != nil {
+		return nil, err
+	}
+	if status == model.UserStatusDeleted && s.tokens != nil {
+		if _, err := s.tokens.RevokeAll(user.Email); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+//History is a function for finding the status transitions of the user with email, latest first
+//Transitions made before the user changed email or name are included, since the user datamapper moves them along with the user
+//(provided history shares its storage, see datamapper.MemoryUser.StatusHistory)
+func (s *StatusChange) History(email string) ([]*model.StatusTransition, *errors.Error) {
+	user, err := s.userMapper.With(datamapper.WithIncludeDeleted(true)).FindByID(email)
+	if err != nil {
+		return nil, err
+	}
+	return s.history.FindByUser(user.Email, user.Name)
+}
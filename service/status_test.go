@@ -0,0 +1,141 @@
+//status_test provides unit tests for status change service
+package user_test
+
+import (
+	"testtrx/datamapper"
+	"testtrx/datamapper/datamappertest"
+	"testtrx/model"
+	user "testtrx/service"
+
+	"errors"
+	"testing"
+)
+
+func initStatusChangeTest(t *testing.T, guards ...model.StatusGuard) (datamapper.UserMapper, *user.StatusChange, *model.User) {
+	userMapper := datamapper.NewMemoryUser()
+	userModel := datamappertest.NewTestUser(1)
+	if _, err := userMapper.Insert(userModel); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	return userMapper, user.NewStatusChange(userMapper, userMapper.StatusHistory(), model.NewStatusMachine(guards...)), userModel
+}
+
+func TestStatusChange(t *testing.T) {
+	userMapper, statusChange, userModel := initStatusChangeTest(t)
+
+	for _, tc := range []struct {
+		status, reason string
+	}{
+		{model.UserStatusInactive, "inactivity"},
+		{model.UserStatusDeleted, "requested by user"},
+		{model.UserStatusInactive, "deleted by mistake"},
+		{model.UserStatusActive, "reactivated"},
+	} {
+		changedModel, err := statusChange.Change(userModel.Email, tc.status, tc.reason, "admin")
+		if err != nil {
+			t.Fatalf("Failed to change status to %v: %v", tc.status, err)
+		}
+		if tc.status != changedModel.Status {
+			t.Errorf("want %v for status, got %v", tc.status, changedModel.Status)
+		}
+		foundModel, err := userMapper.With(datamapper.WithIncludeDeleted(true)).FindByID(userModel.Email)
+		if err != nil {
+			t.Fatalf("Failed to find by id: %v", err)
+		}
+		if tc.status != foundModel.Status || changedModel.Version != foundModel.Version {
+			t.Errorf("want %v status and version %v stored, got %v and %v", tc.status, changedModel.Version, foundModel.Status, foundModel.Version)
+		}
+	}
+
+	history, err := statusChange.History(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find history: %v", err)
+	}
+	want := []struct{ from, to, reason string }{
+		{model.UserStatusInactive, model.UserStatusActive, "reactivated"},
+		{model.UserStatusDeleted, model.UserStatusInactive, "deleted by mistake"},
+		{model.UserStatusInactive, model.UserStatusDeleted, "requested by user"},
+		{model.UserStatusActive, model.UserStatusInactive, "inactivity"},
+	}
+	if len(want) != len(history) {
+		t.Fatalf("want %v transitions, got %v", len(want), len(history))
+	}
+	for i, transition := range history {
+		if want[i].from != transition.From || want[i].to != transition.To || want[i].reason != transition.Reason || "admin" != transition.Actor {
+			t.Errorf("want transition from %v to %v for %v by admin, got %+v", want[i].from, want[i].to, want[i].reason, *transition)
+		}
+	}
+}
+
+func TestStatusChangeRejected(t *testing.T) {
+	errRefused := errors.New("refused")
+	userMapper, statusChange, userModel := initStatusChangeTest(t, func(user *model.User, transition *model.StatusTransition) error {
+		if transition.To == model.UserStatusDeleted && transition.Actor != "admin" {
+			return errRefused
+		}
+		return nil
+	})
+
+	for _, tc := range []struct {
+		status, actor string
+		want          error
+	}{
+		{model.UserStatusActive, "admin", model.ErrInvalidTransition},
+		{"X", "admin", model.ErrUnknownStatus},
+		{model.UserStatusDeleted, "user", errRefused},
+	} {
+		_, err := statusChange.Change(userModel.Email, tc.status, "", tc.actor)
+		if !errors.Is(err, datamapper.ErrInvalidInput) || !errors.Is(err, tc.want) {
+			t.Errorf("want invalid input error wrapping %v for change to %q by %v, got %v", tc.want, tc.status, tc.actor, err)
+		}
+	}
+	if _, err := statusChange.Change(userModel.Email, model.UserStatusDeleted, "", "admin"); err != nil {
+		t.Fatalf("Failed to change status: %v", err)
+	}
+	//a deleted user has to be restored as inactive first
+	if _, err := statusChange.Change(userModel.Email, model.UserStatusActive, "", "admin"); !errors.Is(err, model.ErrInvalidTransition) {
+		t.Errorf("want invalid transition error, got %v", err)
+	}
+	if _, err := statusChange.Change(datamappertest.NewTestUser(2).Email, model.UserStatusInactive, "", "admin"); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want not found error for missing user, got %v", err)
+	}
+
+	//only the applied transition is recorded
+	if history, err := statusChange.History(userModel.Email); err != nil || len(history) != 1 {
+		t.Errorf("want %v transition, got %v and %v", 1, history, err)
+	}
+	if foundModel, err := userMapper.With(datamapper.WithIncludeDeleted(true)).FindByID(userModel.Email); err != nil || model.UserStatusDeleted != foundModel.Status {
+		t.Errorf("want %v for status, got %v and %v", model.UserStatusDeleted, foundModel, err)
+	}
+}
+
+func TestStatusChangeRevokesTokens(t *testing.T) {
+	userMapper, statusChange, userModel := initStatusChangeTest(t)
+	tokenService := user.NewTokenService(userMapper, datamapper.NewMemoryUserSession())
+	statusChange.SetTokenService(tokenService)
+	token, _, err := tokenService.Issue(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	//the tokens are kept by other changes
+	if _, err := statusChange.Change(userModel.Email, model.UserStatusInactive, "", "admin"); err != nil {
+		t.Fatalf("Failed to change status: %v", err)
+	}
+	if sessions, err := tokenService.Sessions(userModel.Email); err != nil || len(sessions) != 1 {
+		t.Errorf("want %v session kept, got %v and %v", 1, sessions, err)
+	}
+	if _, err := statusChange.Change(userModel.Email, model.UserStatusDeleted, "", "admin"); err != nil {
+		t.Fatalf("Failed to change status: %v", err)
+	}
+	if sessions, err := tokenService.Sessions(userModel.Email); err != nil || len(sessions) != 0 {
+		t.Errorf("want no session left after deletion, got %v and %v", sessions, err)
+	}
+	//restoring the user doesn't make the token valid again
+	for _, status := range []string{model.UserStatusInactive, model.UserStatusActive} {
+		if _, err := statusChange.Change(userModel.Email, status, "", "admin"); err != nil {
+			t.Fatalf("Failed to change status: %v", err)
+		}
+	}
+	assertInvalidToken(t, tokenService, token)
+}
@@ -0,0 +1,183 @@
+//Package user provides services related to user
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	stderrors "errors"
+	"sort"
+	"testtrx/datamapper"
+	"testtrx/model"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+//DefaultAuthTokenTTL is the default duration an auth token (and its session) is valid for
+const DefaultAuthTokenTTL = 30 * 24 * time.Hour
+
+//authTokenLength is the length of the random auth tokens, in bytes
+const authTokenLength = 32
+
+//TokenService is a struct of service for issuing auth tokens to users, validating and revoking them
+//Every issued token opens a session of its own, so a user can be signed in on several devices at once
+//Tokens are random, only their SHA-256 hash is stored (as the session id) so that stored sessions can't be used as tokens
+type TokenService struct {
+	userMapper datamapper.UserMapper    //user datamapper
+	sessions   datamapper.SessionMapper //session datamapper
+	ttl        time.Duration            //duration an auth token is valid for
+}
+
+//NewTokenService is a function for initializing a new auth token service
+func NewTokenService(userMapper datamapper.UserMapper, sessions datamapper.SessionMapper) *TokenService {
+	return &TokenService{userMapper, sessions, DefaultAuthTokenTTL}
+}
+
+//SetTTL is a function for setting the duration an auth token is valid for
+func (t *TokenService) SetTTL(ttl time.Duration) {
+	t.ttl = ttl
+}
+
+//Issue is a function for issuing an auth token to the active user with email (e.g. once authenticated, see Service.Authenticate),
+//returning the token and the session it opened
+//It returns an ErrUserNotActive error if the user is not active, or a datamapper ErrNotFound error if it doesn't exist
+func (t *TokenService) Issue(email string) (string, *model.Session, *errors.Error) {
+	user, err := t.userMapper.FindByID(email)
+	if err != nil {
+		return "", nil, err
+	}
+	if user.Status != model.UserStatusActive {
+		return "", nil, errors.Wrap(ErrUserNotActive, 0)
+	}
+	random := make([]byte, authTokenLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", nil, errors.Wrap(err, 0)
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	now := time.Now()
+	session := &model.Session{
+		ID:            sessionID(token),
+		Email:         user.Email,
+		UserCreatedAt: user.CreatedAt,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(t.ttl),
+	}
+	if _, err := t.sessions.Add(session); err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+//Validate is a function for validating token, returning the user owning it
+//It returns an ErrInvalidToken error if the token is unknown, expired or revoked (or its user doesn't exist anymore, including when
+//another user has been created with its email since, see model.Session.UserCreatedAt), or an ErrUserNotActive error if its user
+//is not active anymore
+func (t *TokenService) Validate(token string) (*model.User, *errors.Error) {
+	session, err := t.findSession(token)
+	if err != nil {
+		return nil, err
+	}
+	//FindByID follows redirects, so the tokens stay valid when the user changes email
+	user, err := t.userMapper.FindByID(session.Email)
+	if err != nil {
+		if stderrors.Is(err, datamapper.ErrNotFound) {
+			return nil, errors.Wrap(ErrInvalidToken, 0)
+		}
+		return nil, err
+	}
+	if !user.CreatedAt.Equal(session.UserCreatedAt) {
+		return nil, errors.Wrap(ErrInvalidToken, 0)
+	}
+	if user.Status != model.UserStatusActive {
+		return nil, errors.Wrap(ErrUserNotActive, 0)
+	}
+	return user, nil
+}
+
+//Revoke is a function for revoking token (e.g. on sign out), closing its session
+//Revoking an unknown, expired or already revoked token is not an error
+func (t *TokenService) Revoke(token string) *errors.Error {
+	session, err := t.findSession(token)
+	if err != nil {
+		if stderrors.Is(err, ErrInvalidToken) {
+			return nil
+		}
+		return err
+	}
+	_, err = t.sessions.Delete(session)
+	return err
+}
+
+//RevokeAll is a function for revoking all the tokens of the user with email (e.g. on password change), returning the number
+//of sessions closed
+//The tokens issued before the user changed email are revoked as well, the sessions being kept by the email they were opened with
+func (t *TokenService) RevokeAll(email string) (int, *errors.Error) {
+	emails, err := t.userEmails(email)
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, userEmail := range emails {
+		count, err := t.sessions.DeleteByUser(userEmail)
+		if err != nil {
+			return revoked, err
+		}
+		revoked += count
+	}
+	return revoked, nil
+}
+
+//Sessions is a function for finding the unexpired sessions of the user with email (e.g. for listing the signed in devices), ordered by id
+//The sessions opened before the user changed email are found as well
+func (t *TokenService) Sessions(email string) ([]*model.Session, *errors.Error) {
+	emails, err := t.userEmails(email)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*model.Session
+	for _, userEmail := range emails {
+		found, err := t.sessions.FindByUser(userEmail)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, found...)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions, nil
+}
+
+//userEmails is a function for finding the emails the sessions of the user with email may be kept by,
+//its current email followed by its former ones (see datamapper.UserMapper.FindFormerEmails)
+func (t *TokenService) userEmails(email string) ([]string, *errors.Error) {
+	user, err := t.userMapper.With(datamapper.WithIncludeDeleted(true)).FindByID(email)
+	if err != nil {
+		return nil, err
+	}
+	formerEmails, err := t.userMapper.FindFormerEmails(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{user.Email}, formerEmails...), nil
+}
+
+//findSession is a function for finding the session of token, returning an ErrInvalidToken error if there is none
+func (t *TokenService) findSession(token string) (*model.Session, *errors.Error) {
+	if token == "" {
+		return nil, errors.Wrap(ErrInvalidToken, 0)
+	}
+	session, err := t.sessions.FindByID(sessionID(token))
+	if err != nil {
+		if stderrors.Is(err, datamapper.ErrNotFound) {
+			return nil, errors.Wrap(ErrInvalidToken, 0)
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+//sessionID is a function for returning the id of the session opened by token, the SHA-256 hash of the token
+func sessionID(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,212 @@
+//token_test provides unit tests for auth token service
+package user_test
+
+import (
+	"testtrx/datamapper"
+	"testtrx/datamapper/datamappertest"
+	"testtrx/model"
+	user "testtrx/service"
+
+	"errors"
+	"testing"
+	"time"
+)
+
+func initTokenServiceTest(t *testing.T) (datamapper.UserMapper, *model.User, *user.TokenService) {
+	userMapper := datamapper.NewMemoryUser()
+	userModel := datamappertest.NewTestUser(1)
+	if _, err := userMapper.Insert(userModel); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	return userMapper, userModel, user.NewTokenService(userMapper, datamapper.NewMemoryUserSession())
+}
+
+//assertInvalidToken is a function for asserting that token is not valid anymore
+func assertInvalidToken(tb testing.TB, tokenService *user.TokenService, token string) {
+	tb.Helper()
+	if foundModel, err := tokenService.Validate(token); !errors.Is(err, user.ErrInvalidToken) {
+		tb.Errorf("want %v error, got %v and %v", user.ErrInvalidToken, foundModel, err)
+	}
+}
+
+func TestTokenServiceIssueAndValidate(t *testing.T) {
+	_, userModel, tokenService := initTokenServiceTest(t)
+
+	//every token opens a session of its own
+	token, session, err := tokenService.Issue(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	otherToken, otherSession, err := tokenService.Issue(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if token == "" || token == otherToken || session.ID == otherSession.ID {
+		t.Errorf("want distinct tokens and sessions, got %v and %v", token, otherToken)
+	}
+	//the token itself is not stored
+	if token == session.ID {
+		t.Errorf("want session id different from the token")
+	}
+	if userModel.Email != session.Email || !session.ExpiresAt.Equal(session.CreatedAt.Add(user.DefaultAuthTokenTTL)) {
+		t.Errorf("want session of %v expiring after %v, got %+v", userModel.Email, user.DefaultAuthTokenTTL, session)
+	}
+
+	for _, token := range []string{token, otherToken} {
+		foundModel, err := tokenService.Validate(token)
+		if err != nil {
+			t.Fatalf("Failed to validate token: %v", err)
+		}
+		datamappertest.AssertUser(t, userModel, foundModel)
+	}
+	sessions, err := tokenService.Sessions(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find sessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Errorf("want 2 sessions, got %v", len(sessions))
+	}
+
+	for _, token := range []string{"", "unknownToken", session.ID} {
+		assertInvalidToken(t, tokenService, token)
+	}
+	if _, _, err := tokenService.Issue("unknown@testemail.com"); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want %v error, got %v", datamapper.ErrNotFound, err)
+	}
+}
+
+func TestTokenServiceRevoke(t *testing.T) {
+	_, userModel, tokenService := initTokenServiceTest(t)
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		token, _, err := tokenService.Issue(userModel.Email)
+		if err != nil {
+			t.Fatalf("Failed to issue token: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := tokenService.Revoke(tokens[0]); err != nil {
+		t.Fatalf("Failed to revoke token: %v", err)
+	}
+	assertInvalidToken(t, tokenService, tokens[0])
+	if _, err := tokenService.Validate(tokens[1]); err != nil {
+		t.Errorf("want other tokens still valid, got %v", err)
+	}
+	//revoking again is not an error
+	if err := tokenService.Revoke(tokens[0]); err != nil {
+		t.Errorf("want revoked token revoked again, got %v", err)
+	}
+
+	count, err := tokenService.RevokeAll(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to revoke tokens: %v", err)
+	}
+	if 2 != count {
+		t.Errorf("want 2 sessions closed, got %v", count)
+	}
+	for _, token := range tokens {
+		assertInvalidToken(t, tokenService, token)
+	}
+}
+
+func TestTokenServiceRevokeAllAfterEmailChange(t *testing.T) {
+	userMapper, userModel, tokenService := initTokenServiceTest(t)
+	oldToken, _, err := tokenService.Issue(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if ok, err := userMapper.ChangeEmail(userModel, "changed@testemail.com"); err != nil || !ok {
+		t.Fatalf("Failed to change email: %v, %v", ok, err)
+	}
+	newToken, _, err := tokenService.Issue(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	//the tokens issued before the change are still valid, and listed and revoked along with the new ones
+	if _, err := tokenService.Validate(oldToken); err != nil {
+		t.Errorf("want token issued before the email change still valid, got %v", err)
+	}
+	if sessions, err := tokenService.Sessions(userModel.Email); err != nil || len(sessions) != 2 {
+		t.Errorf("want 2 sessions, got %v and %v", sessions, err)
+	}
+	count, err := tokenService.RevokeAll(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to revoke tokens: %v", err)
+	}
+	if 2 != count {
+		t.Errorf("want 2 sessions closed, got %v", count)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		assertInvalidToken(t, tokenService, token)
+	}
+}
+
+func TestTokenServiceUserRecreated(t *testing.T) {
+	userMapper, userModel, tokenService := initTokenServiceTest(t)
+	token, _, err := tokenService.Issue(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if ok, err := userMapper.Delete(userModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+
+	//the creation times are stored with millisecond precision, the users being created at least a millisecond apart
+	time.Sleep(2 * time.Millisecond)
+	for _, newModel := range []*model.User{datamappertest.NewTestUser(2), datamappertest.NewTestUser(1)} {
+		newModel.Email = userModel.Email
+		if _, err := userMapper.Insert(newModel); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+		//the token of the former user with the email is not valid for the new one, whatever its name
+		assertInvalidToken(t, tokenService, token)
+		if _, err := userMapper.Delete(newModel); err != nil {
+			t.Fatalf("Failed to delete user: %v", err)
+		}
+	}
+}
+
+func TestTokenServiceExpiry(t *testing.T) {
+	_, userModel, tokenService := initTokenServiceTest(t)
+	tokenService.SetTTL(50 * time.Millisecond)
+	token, session, err := tokenService.Issue(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if _, err := tokenService.Validate(token); err != nil {
+		t.Fatalf("Failed to validate token: %v", err)
+	}
+
+	time.Sleep(time.Until(session.ExpiresAt))
+	assertInvalidToken(t, tokenService, token)
+	if sessions, err := tokenService.Sessions(userModel.Email); err != nil || len(sessions) != 0 {
+		t.Errorf("want no session left, got %v and %v", sessions, err)
+	}
+}
+
+func TestTokenServiceUserNotActive(t *testing.T) {
+	userMapper, userModel, tokenService := initTokenServiceTest(t)
+	token, _, err := tokenService.Issue(userModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	userModel.Status = model.UserStatusInactive
+	if _, err := userMapper.Update(userModel); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	if _, err := tokenService.Validate(token); !errors.Is(err, user.ErrUserNotActive) {
+		t.Errorf("want %v error, got %v", user.ErrUserNotActive, err)
+	}
+	if _, _, err := tokenService.Issue(userModel.Email); !errors.Is(err, user.ErrUserNotActive) {
+		t.Errorf("want %v error, got %v", user.ErrUserNotActive, err)
+	}
+
+	//the tokens of a user that doesn't exist anymore are not valid
+	if _, err := userMapper.Delete(userModel); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	assertInvalidToken(t, tokenService, token)
+}
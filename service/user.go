@@ -1,2 +1,310 @@
 //Package user provides services related to user
 package user
+
+import (
+	stderrors "errors"
+	"fmt"
+	"sync"
+	"testtrx/datamapper"
+	"testtrx/model"
+	"time"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//ErrInvalidCredentials is the error returned when authenticating with an unknown email or a wrong password
+var ErrInvalidCredentials = stderrors.New("invalid credentials")
+
+//ErrUserNotActive is the error returned when authenticating a user whose status is not active
+var ErrUserNotActive = stderrors.New("user is not active")
+
+//DefaultMinPasswordLength is the default minimum length (in characters) of the passwords of users
+const DefaultMinPasswordLength = 8
+
+//DefaultServiceRetries is the default number of times updating a user is retried when the user is modified concurrently
+const DefaultServiceRetries = 3
+
+//Service is a struct of service for registering and authenticating users with a password, and for managing their password and status
+//Deactivating and reactivating a user goes through StatusChange, so the transitions are checked by the status machine
+//and recorded in the status history
+type Service struct {
+	userMapper        datamapper.UserMapper //user datamapper
+	statusChange      *StatusChange         //status change service
+	hasher            PasswordHasher        //hasher of passwords
+	minPasswordLength int                   //minimum length of passwords
+	retries           int                   //number of retries on concurrent modification of the user
+	tokens            *TokenService         //token service revoking the tokens of the users (nil for none, see SetTokenService)
+	dummyHashOnce     sync.Once             //guards dummyHash
+	dummyHash         string                //hash verified when authenticating an unknown user, so that it takes as long as a known one
+}
+
+//NewService is a function for initializing a new user service, transitions of the user status being recorded in history
+//Passwords are hashed with argon2id by default (see SetPasswordHasher), bcrypt hashes being still verified and rehashed on login
+func NewService(userMapper datamapper.UserMapper, history datamapper.StatusHistoryMapper) *Service {
+	return &Service{
+		userMapper:        userMapper,
+		statusChange:      NewStatusChange(userMapper, history, model.NewStatusMachine()),
+		hasher:            NewMigratingHasher(NewArgon2idHasher(DefaultArgon2idParams), NewBcryptHasher(bcrypt.DefaultCost)),
+		minPasswordLength: DefaultMinPasswordLength,
+		retries:           DefaultServiceRetries,
+	}
+}
+
+//SetPasswordHasher is a function for setting the hasher of passwords
+//Note: passwords hashed by the previous hasher can't be verified anymore unless hasher can verify them too (see NewMigratingHasher)
+func (s *Service) SetPasswordHasher(hasher PasswordHasher) {
+	s.hasher = hasher
+}
+
+//SetStatusMachine is a function for setting the state machine checking the status transitions (e.g. with guards)
+func (s *Service) SetStatusMachine(machine *model.StatusMachine) {
+	s.statusChange.machine = machine
+}
+
+//SetTokenService is a function for setting the token service revoking the tokens of the users when they change password,
+//are deleted (see StatusChange.SetTokenService) or purged
+func (s *Service) SetTokenService(tokens *TokenService) {
+	s.tokens = tokens
+	s.statusChange.SetTokenService(tokens)
+}
+
+//SetMinPasswordLength is a function for setting the minimum length (in characters) of passwords
+func (s *Service) SetMinPasswordLength(length int) {
+	s.minPasswordLength = length
+}
+
+//SetRetries is a function for setting the number of times updating a user is retried when the user is modified concurrently
+func (s *Service) SetRetries(retries int) {
+	s.retries = retries
+}
+
+//Register is a function for registering a new active user with email, name and password, returning the stored user
+//It returns a datamapper ErrAlreadyExists error carrying the existing user if a user already has (or had) email,
+//or a datamapper ErrInvalidInput error if the password is too short or the user is not valid (see model.User.Validate)
+//Note: the email is claimed atomically by the insert, so of two users registering the same email concurrently only one is stored
+func (s *Service) Register(email, name, password string) (*model.User, *errors.Error) {
+	if err := s.checkPassword(password); err != nil {
+		return nil, err
+	}
+	//FindByID follows redirects, so the former email of another user can't be registered either
+	existing, err := s.userMapper.With(datamapper.WithIncludeDeleted(true)).FindByID(email)
+	if err == nil {
+		return nil, errors.Wrap(&datamapper.Error{Kind: datamapper.ErrAlreadyExists, Current: existing}, 0)
+	} else if !stderrors.Is(err, datamapper.ErrNotFound) {
+		return nil, err
+	}
+	hash, hashErr := s.hasher.Hash(password)
+	if hashErr != nil {
+		return nil, errors.Wrap(&datamapper.Error{Kind: datamapper.ErrInvalidInput, Err: hashErr}, 0)
+	}
+	user := &model.User{
+		Email:        email,
+		Password:     hash,
+		Name:         name,
+		Status:       model.UserStatusActive,
+		LastActivity: time.Now(),
+	}
+	if _, err := s.userMapper.Insert(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+//Authenticate is a function for authenticating the user with email with password, returning the user with its last activity updated
+//If the password hash was made with outdated parameters or algorithm (see PasswordHasher.NeedsRehash), the password is hashed again
+//and stored along with the last activity
+//It returns an ErrInvalidCredentials error if no user has email (or it is deleted) or if password doesn't match,
+//or an ErrUserNotActive error if the password matches but the user is not active (including when they are changed concurrently)
+func (s *Service) Authenticate(email, password string) (*model.User, *errors.Error) {
+	user, err := s.verify(email, password)
+	if err != nil {
+		return nil, err
+	}
+	if user.Status != model.UserStatusActive {
+		return nil, errors.Wrap(ErrUserNotActive, 0)
+	}
+	verifiedHash, rehash := user.Password, ""
+	if s.hasher.NeedsRehash(verifiedHash) {
+		//Note: failing to rehash doesn't fail the authentication, the password is rehashed on a later login
+		rehash, _ = s.hasher.Hash(password)
+	}
+	return retryOnConflict(s.userMapper, s.retries, user, func(user *model.User) *errors.Error {
+		//password has only been verified against the hash it was read with, same as ChangePassword
+		if user.Password != verifiedHash {
+			return errors.Wrap(ErrInvalidCredentials, 0)
+		}
+		if user.Status != model.UserStatusActive {
+			return errors.Wrap(ErrUserNotActive, 0)
+		}
+		user.LastActivity = time.Now()
+		if rehash != "" {
+			user.Password = rehash
+		}
+		_, err := s.userMapper.Update(user)
+		return err
+	})
+}
+
+//ChangePassword is a function for changing the password of the active user with email from password to newPassword,
+//returning the updated user
+//It returns the same errors as Authenticate if password is not the current one (including when the password is changed concurrently),
+//or a datamapper ErrInvalidInput error if newPassword is too short
+//The tokens of the user are revoked once the password is changed (see SetTokenService), if revoking fails the error is returned
+//but the password stays changed
+func (s *Service) ChangePassword(email, password, newPassword string) (*model.User, *errors.Error) {
+	if err := s.checkPassword(newPassword); err != nil {
+		return nil, err
+	}
+	user, err := s.verify(email, password)
+	if err != nil {
+		return nil, err
+	}
+	if user.Status != model.UserStatusActive {
+		return nil, errors.Wrap(ErrUserNotActive, 0)
+	}
+	hash, hashErr := s.hasher.Hash(newPassword)
+	if hashErr != nil {
+		return nil, errors.Wrap(&datamapper.Error{Kind: datamapper.ErrInvalidInput, Err: hashErr}, 0)
+	}
+	verifiedHash := user.Password
+	user, err = retryOnConflict(s.userMapper, s.retries, user, func(user *model.User) *errors.Error {
+		//password has only been verified against the hash it was read with, a concurrently changed one is not overwritten
+		if user.Password != verifiedHash {
+			return errors.Wrap(ErrInvalidCredentials, 0)
+		}
+		if user.Status != model.UserStatusActive {
+			return errors.Wrap(ErrUserNotActive, 0)
+		}
+		user.Password = hash
+		_, err := s.userMapper.Update(user)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.tokens != nil {
+		if _, err := s.tokens.RevokeAll(user.Email); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+//Purge is a function for removing the users deleted for longer than retention (see datamapper.UserMapper.Purge),
+//returning the number of removed users
+//The tokens of the users to remove are revoked beforehand (see SetTokenService), in case some were issued before revoking on deletion
+func (s *Service) Purge(retention time.Duration) (int, *errors.Error) {
+	if s.tokens != nil {
+		deletedBefore := time.Now().Add(-retention)
+		for cursor, first := "", true; first || cursor != ""; first = false {
+			page, err := s.userMapper.FindByStatus(model.UserStatusDeleted, cursor)
+			if err != nil {
+				return 0, err
+			}
+			for _, deleted := range page.Items {
+				//same users as removed by the datamapper
+				if deleted.DeletedAt.IsZero() || deleted.DeletedAt.After(deletedBefore) {
+					continue
+				}
+				if _, err := s.tokens.RevokeAll(deleted.Email); err != nil {
+					return 0, err
+				}
+			}
+			cursor = page.NextCursor
+		}
+	}
+	return s.userMapper.Purge(retention)
+}
+
+//Deactivate is a function for deactivating the active user with email, for reason and by actor, returning the updated user
+//It returns a datamapper ErrInvalidInput error if the user is not active, or a datamapper ErrNotFound error if it doesn't exist
+func (s *Service) Deactivate(email, reason, actor string) (*model.User, *errors.Error) {
+	return s.changeStatus(email, model.UserStatusActive, model.UserStatusInactive, reason, actor)
+}
+
+//Reactivate is a function for reactivating the inactive user with email, for reason and by actor, returning the updated user
+//It returns a datamapper ErrInvalidInput error if the user is not inactive, or a datamapper ErrNotFound error if it doesn't exist
+//Note: a deleted user has to be restored (changed to model.UserStatusInactive with StatusChange) before being reactivated
+func (s *Service) Reactivate(email, reason, actor string) (*model.User, *errors.Error) {
+	return s.changeStatus(email, model.UserStatusInactive, model.UserStatusActive, reason, actor)
+}
+
+//changeStatus is a function for changing the status of the user with email from status from to status to
+func (s *Service) changeStatus(email, from, to, reason, actor string) (*model.User, *errors.Error) {
+	user, err := s.userMapper.FindByID(email)
+	if err != nil {
+		return nil, err
+	}
+	if user.Status != from {
+		return nil, errors.Wrap(&datamapper.Error{
+			Kind: datamapper.ErrInvalidInput,
+			Err:  fmt.Errorf("user %v is %v, not %v", user.Email, model.UserStatusMap[user.Status], model.UserStatusMap[from]),
+		}, 0)
+	}
+	return s.statusChange.Change(user.Email, to, reason, actor)
+}
+
+//verify is a function for finding the user with email and verifying that password matches its password
+//It returns an ErrInvalidCredentials error if no user has email or if password doesn't match (or its hash can't be verified)
+func (s *Service) verify(email, password string) (*model.User, *errors.Error) {
+	user, err := s.userMapper.FindByID(email)
+	if err != nil {
+		if !stderrors.Is(err, datamapper.ErrNotFound) {
+			return nil, err
+		}
+		//a hash is verified anyway, so that unknown emails can't be told apart by the response time
+		s.hasher.Verify(s.unknownUserHash(), password)
+		return nil, errors.Wrap(ErrInvalidCredentials, 0)
+	}
+	//Note: users without password (e.g. only signing in with a linked identity) can't authenticate with a password
+	if user.Password == "" {
+		s.hasher.Verify(s.unknownUserHash(), password)
+		return nil, errors.Wrap(ErrInvalidCredentials, 0)
+	}
+	//a hash that can't be verified (e.g. malformed, see ErrUnsupportedHash) is reported the same way as a wrong password
+	if matches, verifyErr := s.hasher.Verify(user.Password, password); verifyErr != nil || !matches {
+		return nil, errors.Wrap(ErrInvalidCredentials, 0)
+	}
+	return user, nil
+}
+
+//unknownUserHash is a function for returning the hash verified when authenticating an unknown user
+func (s *Service) unknownUserHash() string {
+	s.dummyHashOnce.Do(func() {
+		s.dummyHash, _ = s.hasher.Hash("unknown user password")
+	})
+	return s.dummyHash
+}
+
+//checkPassword is a function for checking that password complies with the password policy,
+//returning a datamapper ErrInvalidInput error otherwise
+func (s *Service) checkPassword(password string) *errors.Error {
+	if len([]rune(password)) < s.minPasswordLength {
+		return errors.Wrap(&datamapper.Error{
+			Kind: datamapper.ErrInvalidInput,
+			Err:  fmt.Errorf("password must be at least %v characters long", s.minPasswordLength),
+		}, 0)
+	}
+	return nil
+}
+
+//retryOnConflict is a function for applying change to user, applying it again (up to retries times) to the latest stored user
+//when it fails because the user has been modified concurrently, returning the changed user
+func retryOnConflict(userMapper datamapper.UserMapper, retries int, user *model.User, change func(user *model.User) *errors.Error) (*model.User, *errors.Error) {
+	for attempt := 0; ; attempt++ {
+		err := change(user)
+		if err == nil {
+			return user, nil
+		}
+		var mapperErr *datamapper.Error
+		if attempt == retries || !stderrors.Is(err, datamapper.ErrConflict) || !stderrors.As(err, &mapperErr) {
+			return nil, err
+		}
+		current, isUser := mapperErr.Current.(*model.User)
+		if !isUser {
+			return nil, err
+		}
+		user = current
+	}
+}
@@ -0,0 +1,362 @@
+//user_test provides unit tests for user service
+package user_test
+
+import (
+	"testtrx/datamapper"
+	"testtrx/datamapper/datamappertest"
+	"testtrx/model"
+	user "testtrx/service"
+
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func initServiceTest(t *testing.T) (datamapper.UserMapper, datamapper.StatusHistoryMapper, *user.Service) {
+	userMapper := datamapper.NewMemoryUser()
+	history := userMapper.StatusHistory()
+	service := user.NewService(userMapper, history)
+	//the minimum cost keeps the tests fast
+	service.SetPasswordHasher(user.NewBcryptHasher(bcrypt.MinCost))
+	return userMapper, history, service
+}
+
+func TestServiceRegisterAndAuthenticate(t *testing.T) {
+	userMapper, _, service := initServiceTest(t)
+
+	registeredModel, err := service.Register(" User1@TestEmail.com", "user1", "dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+	if "User1@testemail.com" != registeredModel.Email || model.UserStatusActive != registeredModel.Status {
+		t.Errorf("want %v email and %v status, got %v and %v", "User1@testemail.com", model.UserStatusActive, registeredModel.Email, registeredModel.Status)
+	}
+	//the password is only stored hashed
+	foundModel, err := userMapper.FindByID(registeredModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	if matches, err := user.NewBcryptHasher(bcrypt.MinCost).Verify(foundModel.Password, "dummyPassword"); !matches || err != nil ||
+		!strings.HasPrefix(foundModel.Password, "$bcrypt$r=4$") {
+		t.Errorf("want bcrypt hash of the password stored, got %v (%v)", foundModel.Password, err)
+	}
+
+	authenticatedModel, err := service.Authenticate("User1@TESTEMAIL.com", "dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to authenticate user: %v", err)
+	}
+	if 2 != authenticatedModel.Version || !authenticatedModel.LastActivity.After(registeredModel.LastActivity) {
+		t.Errorf("want last activity updated, got %v (version %v)", authenticatedModel.LastActivity, authenticatedModel.Version)
+	}
+
+	for _, tc := range []struct{ email, password string }{
+		{registeredModel.Email, "wrongPassword"},
+		{registeredModel.Email, ""},
+		{"unknown@testemail.com", "dummyPassword"},
+	} {
+		if _, err := service.Authenticate(tc.email, tc.password); !errors.Is(err, user.ErrInvalidCredentials) {
+			t.Errorf("want %v error for %v with %q, got %v", user.ErrInvalidCredentials, tc.email, tc.password, err)
+		}
+	}
+}
+
+func TestServiceAuthenticateUnsupportedHash(t *testing.T) {
+	userMapper, _, service := initServiceTest(t)
+	userModel := datamappertest.NewTestUser(1)
+	userModel.Password = "dummyPasswordHash"
+	if _, err := userMapper.Insert(userModel); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+
+	//the hasher error is not exposed
+	_, err := service.Authenticate(userModel.Email, "dummyPassword")
+	if !errors.Is(err, user.ErrInvalidCredentials) || errors.Is(err, user.ErrUnsupportedHash) {
+		t.Errorf("want %v error for unsupported hash, got %v", user.ErrInvalidCredentials, err)
+	}
+	if _, err := service.ChangePassword(userModel.Email, "dummyPassword", "newDummyPassword"); !errors.Is(err, user.ErrInvalidCredentials) {
+		t.Errorf("want %v error for unsupported hash, got %v", user.ErrInvalidCredentials, err)
+	}
+}
+
+func TestServiceRegisterRejected(t *testing.T) {
+	_, _, service := initServiceTest(t)
+	if _, err := service.Register("user1@testemail.com", "user1", "dummyPassword"); err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	for _, tc := range []struct {
+		email, name, password string
+		want                  error
+	}{
+		{"user1@testemail.com", "otherName", "dummyPassword", datamapper.ErrAlreadyExists},
+		{"user2@testemail.com", "user2", "short", datamapper.ErrInvalidInput},
+		{"user2@", "user2", "dummyPassword", model.ErrValidation},
+		{"user2@testemail.com", "", "dummyPassword", model.ErrValidation},
+	} {
+		if _, err := service.Register(tc.email, tc.name, tc.password); !errors.Is(err, tc.want) {
+			t.Errorf("want %v error for %v, %v and %q, got %v", tc.want, tc.email, tc.name, tc.password, err)
+		}
+	}
+}
+
+func TestServiceChangePassword(t *testing.T) {
+	_, _, service := initServiceTest(t)
+	registeredModel, err := service.Register("user1@testemail.com", "user1", "dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	if _, err := service.ChangePassword(registeredModel.Email, "wrongPassword", "newDummyPassword"); !errors.Is(err, user.ErrInvalidCredentials) {
+		t.Errorf("want %v error for wrong password, got %v", user.ErrInvalidCredentials, err)
+	}
+	if _, err := service.ChangePassword(registeredModel.Email, "dummyPassword", "short"); !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want %v error for short password, got %v", datamapper.ErrInvalidInput, err)
+	}
+	if _, err := service.ChangePassword(registeredModel.Email, "dummyPassword", "newDummyPassword"); err != nil {
+		t.Fatalf("Failed to change password: %v", err)
+	}
+	if _, err := service.Authenticate(registeredModel.Email, "dummyPassword"); !errors.Is(err, user.ErrInvalidCredentials) {
+		t.Errorf("want %v error for old password, got %v", user.ErrInvalidCredentials, err)
+	}
+	if _, err := service.Authenticate(registeredModel.Email, "newDummyPassword"); err != nil {
+		t.Errorf("Failed to authenticate with new password: %v", err)
+	}
+}
+
+//hookHasher is a PasswordHasher calling onHash before hashing, for changing the stored user in between a verification and its update
+type hookHasher struct {
+	user.PasswordHasher
+	onVerify func()
+}
+
+func (h hookHasher) Verify(hash, password string) (bool, error) {
+	h.onVerify()
+	return h.PasswordHasher.Verify(hash, password)
+}
+
+func TestServiceChangePasswordConcurrently(t *testing.T) {
+	userMapper, _, service := initServiceTest(t)
+	registeredModel, err := service.Register("user1@testemail.com", "user1", "dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+	hasher := user.NewBcryptHasher(bcrypt.MinCost)
+	concurrentUpdate := func(change func(user *model.User)) func() {
+		return func() {
+			foundModel, err := userMapper.FindByID(registeredModel.Email)
+			if err != nil {
+				t.Fatalf("Failed to find by id: %v", err)
+			}
+			change(foundModel)
+			if ok, err := userMapper.Update(foundModel); err != nil || !ok {
+				t.Fatalf("Failed to update user: %v, %v", ok, err)
+			}
+		}
+	}
+
+	//a concurrent change of another field is retried
+	service.SetPasswordHasher(hookHasher{hasher, concurrentUpdate(func(user *model.User) { user.LastActivity = time.Now() })})
+	if _, err := service.ChangePassword(registeredModel.Email, "dummyPassword", "newDummyPassword"); err != nil {
+		t.Fatalf("Failed to change password: %v", err)
+	}
+
+	//a concurrently changed password is kept, the old password no longer being valid
+	otherHash, hashErr := hasher.Hash("otherDummyPassword")
+	if hashErr != nil {
+		t.Fatalf("Failed to hash password: %v", hashErr)
+	}
+	service.SetPasswordHasher(hookHasher{hasher, concurrentUpdate(func(user *model.User) { user.Password = otherHash })})
+	if _, err := service.ChangePassword(registeredModel.Email, "newDummyPassword", "thirdDummyPassword"); !errors.Is(err, user.ErrInvalidCredentials) {
+		t.Errorf("want %v error for concurrently changed password, got %v", user.ErrInvalidCredentials, err)
+	}
+	service.SetPasswordHasher(hasher)
+	if _, err := service.Authenticate(registeredModel.Email, "otherDummyPassword"); err != nil {
+		t.Errorf("Failed to authenticate with concurrently changed password: %v", err)
+	}
+}
+
+func TestServiceAuthenticateConcurrently(t *testing.T) {
+	userMapper, _, service := initServiceTest(t)
+	registeredModel, err := service.Register("user1@testemail.com", "user1", "dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+	hasher := user.NewBcryptHasher(bcrypt.MinCost)
+	concurrentUpdate := func(change func(user *model.User)) func() {
+		return func() {
+			foundModel, err := userMapper.FindByID(registeredModel.Email)
+			if err != nil {
+				t.Fatalf("Failed to find by id: %v", err)
+			}
+			change(foundModel)
+			if ok, err := userMapper.Update(foundModel); err != nil || !ok {
+				t.Fatalf("Failed to update user: %v, %v", ok, err)
+			}
+		}
+	}
+
+	//a concurrent change of another field is retried
+	service.SetPasswordHasher(hookHasher{hasher, concurrentUpdate(func(user *model.User) { user.LastActivity = time.Now() })})
+	if _, err := service.Authenticate(registeredModel.Email, "dummyPassword"); err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	//a concurrently changed password is not authenticated
+	otherHash, hashErr := hasher.Hash("otherDummyPassword")
+	if hashErr != nil {
+		t.Fatalf("Failed to hash password: %v", hashErr)
+	}
+	service.SetPasswordHasher(hookHasher{hasher, concurrentUpdate(func(user *model.User) { user.Password = otherHash })})
+	if _, err := service.Authenticate(registeredModel.Email, "dummyPassword"); !errors.Is(err, user.ErrInvalidCredentials) {
+		t.Errorf("want %v error for concurrently changed password, got %v", user.ErrInvalidCredentials, err)
+	}
+
+	//a concurrently deactivated user is not authenticated
+	service.SetPasswordHasher(hookHasher{hasher, concurrentUpdate(func(user *model.User) { user.Status = model.UserStatusInactive })})
+	if _, err := service.Authenticate(registeredModel.Email, "otherDummyPassword"); !errors.Is(err, user.ErrUserNotActive) {
+		t.Errorf("want %v error for concurrently deactivated user, got %v", user.ErrUserNotActive, err)
+	}
+	foundModel, err := userMapper.FindByID(registeredModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	if otherHash != foundModel.Password {
+		t.Errorf("want concurrently changed password kept, got %v", foundModel.Password)
+	}
+}
+
+func TestServiceRevokesTokens(t *testing.T) {
+	userMapper, _, service := initServiceTest(t)
+	sessionMapper := datamapper.NewMemoryUserSession()
+	tokenService := user.NewTokenService(userMapper, sessionMapper)
+	service.SetTokenService(tokenService)
+	registeredModel, err := service.Register("user1@testemail.com", "user1", "dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	//changing password revokes the tokens issued with the previous one
+	token, _, err := tokenService.Issue(registeredModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if _, err := service.ChangePassword(registeredModel.Email, "dummyPassword", "newDummyPassword"); err != nil {
+		t.Fatalf("Failed to change password: %v", err)
+	}
+	assertInvalidToken(t, tokenService, token)
+
+	//purging revokes the tokens left, e.g. issued before revoking on deletion
+	if _, _, err := tokenService.Issue(registeredModel.Email); err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if ok, err := userMapper.With(datamapper.WithSoftDelete(true)).Delete(registeredModel); err != nil || !ok {
+		t.Fatalf("Failed to delete user: %v, %v", ok, err)
+	}
+	if count, err := service.Purge(0); err != nil || 1 != count {
+		t.Fatalf("Failed to purge users: %v, %v", count, err)
+	}
+	if sessions, err := sessionMapper.FindByUser(registeredModel.Email); err != nil || len(sessions) != 0 {
+		t.Errorf("want no session left after purge, got %v and %v", sessions, err)
+	}
+}
+
+func TestServiceDeactivateAndReactivate(t *testing.T) {
+	_, history, service := initServiceTest(t)
+	registeredModel, err := service.Register("user1@testemail.com", "user1", "dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	if _, err := service.Reactivate(registeredModel.Email, "", "admin"); !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want %v error for reactivating an active user, got %v", datamapper.ErrInvalidInput, err)
+	}
+	deactivatedModel, err := service.Deactivate(registeredModel.Email, "inactivity", "admin")
+	if err != nil {
+		t.Fatalf("Failed to deactivate user: %v", err)
+	}
+	if model.UserStatusInactive != deactivatedModel.Status {
+		t.Errorf("want %v for status, got %v", model.UserStatusInactive, deactivatedModel.Status)
+	}
+	if _, err := service.Deactivate(registeredModel.Email, "", "admin"); !errors.Is(err, datamapper.ErrInvalidInput) {
+		t.Errorf("want %v error for deactivating an inactive user, got %v", datamapper.ErrInvalidInput, err)
+	}
+	//an inactive user can't authenticate (nor change its password), even with the right password
+	if _, err := service.Authenticate(registeredModel.Email, "dummyPassword"); !errors.Is(err, user.ErrUserNotActive) {
+		t.Errorf("want %v error for inactive user, got %v", user.ErrUserNotActive, err)
+	}
+	if _, err := service.ChangePassword(registeredModel.Email, "dummyPassword", "newDummyPassword"); !errors.Is(err, user.ErrUserNotActive) {
+		t.Errorf("want %v error for inactive user, got %v", user.ErrUserNotActive, err)
+	}
+
+	if _, err := service.Reactivate(registeredModel.Email, "appeal", "admin"); err != nil {
+		t.Fatalf("Failed to reactivate user: %v", err)
+	}
+	if _, err := service.Authenticate(registeredModel.Email, "dummyPassword"); err != nil {
+		t.Errorf("Failed to authenticate reactivated user: %v", err)
+	}
+	//the transitions are recorded
+	transitions, err := history.FindByUser(registeredModel.Email, registeredModel.Name)
+	if err != nil || len(transitions) != 2 {
+		t.Fatalf("want %v transitions, got %v and %v", 2, transitions, err)
+	}
+	if "appeal" != transitions[0].Reason || "inactivity" != transitions[1].Reason {
+		t.Errorf("want %v and %v reasons, got %v and %v", "appeal", "inactivity", transitions[0].Reason, transitions[1].Reason)
+	}
+
+	if _, err := service.Deactivate("unknown@testemail.com", "", "admin"); !errors.Is(err, datamapper.ErrNotFound) {
+		t.Errorf("want %v error for unknown user, got %v", datamapper.ErrNotFound, err)
+	}
+}
+
+func TestServiceRehashOnLogin(t *testing.T) {
+	userMapper, _, service := initServiceTest(t)
+	registeredModel, err := service.Register("user1@testemail.com", "user1", "dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+	bcryptHash := registeredModel.Password
+
+	//moving to argon2id, bcrypt hashes are still verified and rehashed on login
+	service.SetPasswordHasher(user.NewMigratingHasher(user.NewArgon2idHasher(testArgon2idParams), user.NewBcryptHasher(bcrypt.MinCost)))
+	authenticatedModel, err := service.Authenticate(registeredModel.Email, "dummyPassword")
+	if err != nil {
+		t.Fatalf("Failed to authenticate user: %v", err)
+	}
+	foundModel, err := userMapper.FindByID(registeredModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	if !strings.HasPrefix(foundModel.Password, "$argon2id$v=19$m=1024,t=1,p=1$") || authenticatedModel.Password != foundModel.Password {
+		t.Errorf("want argon2id hash stored, got %v", foundModel.Password)
+	}
+	if 2 != foundModel.Version {
+		t.Errorf("want %v for version, got %v", 2, foundModel.Version)
+	}
+
+	//up to date hashes are kept
+	if _, err := service.Authenticate(registeredModel.Email, "dummyPassword"); err != nil {
+		t.Fatalf("Failed to authenticate user: %v", err)
+	}
+	reauthenticatedModel, err := userMapper.FindByID(registeredModel.Email)
+	if err != nil {
+		t.Fatalf("Failed to find by id: %v", err)
+	}
+	if foundModel.Password != reauthenticatedModel.Password {
+		t.Errorf("want %v for password, got %v", foundModel.Password, reauthenticatedModel.Password)
+	}
+
+	//a failed login doesn't rehash
+	service.SetPasswordHasher(user.NewMigratingHasher(user.NewBcryptHasher(bcrypt.MinCost), user.NewArgon2idHasher(testArgon2idParams)))
+	if _, err := service.Authenticate(registeredModel.Email, "wrongPassword"); !errors.Is(err, user.ErrInvalidCredentials) {
+		t.Errorf("want %v error, got %v", user.ErrInvalidCredentials, err)
+	}
+	if unchangedModel, err := userMapper.FindByID(registeredModel.Email); err != nil || foundModel.Password != unchangedModel.Password {
+		t.Errorf("want %v for password, got %v and %v", foundModel.Password, unchangedModel, err)
+	}
+	if bcryptHash == foundModel.Password {
+		t.Errorf("want password rehashed")
+	}
+}
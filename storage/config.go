@@ -0,0 +1,313 @@
+//Package storage provides the creation of cassandra sessions from configuration
+package storage
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//ErrInvalidConfig is the error returned when a configuration can't be loaded or is not valid, its message details the invalid settings
+var ErrInvalidConfig = stderrors.New("invalid storage config")
+
+//Host selection policies of Config.HostSelection
+const (
+	HostSelectionTokenAware = "token-aware" //route queries to a replica of their partition, falling back to dc-aware or round-robin
+	HostSelectionRoundRobin = "round-robin" //route queries to all hosts in turn
+	HostSelectionDCAware    = "dc-aware"    //route queries to the hosts of the local data center first
+)
+
+//Config is a struct of cassandra cluster configuration, zero values fall back to the gocql defaults
+//It is loaded from a JSON file (see LoadFile) and/or environment variables (see LoadEnv)
+type Config struct {
+	Hosts             []string        `json:"hosts"`              //addresses of the cluster hosts to connect to (required)
+	Port              int             `json:"port"`               //port of the hosts (default 9042)
+	Keyspace          string          `json:"keyspace"`           //keyspace of the session (none if empty)
+	Username          string          `json:"username"`           //username of password authentication (none if empty)
+	Password          string          `json:"password"`           //password of password authentication
+	TLS               TLSConfig       `json:"tls"`                //TLS configuration
+	Consistency       string          `json:"consistency"`        //default consistency of queries, e.g. LOCAL_QUORUM (default QUORUM)
+	SerialConsistency string          `json:"serial_consistency"` //default serial consistency of lightweight transactions (default SERIAL)
+	Timeout           Duration        `json:"timeout"`            //timeout of queries (default 11s)
+	ConnectTimeout    Duration        `json:"connect_timeout"`    //timeout of connecting to a host (default 11s)
+	NumConns          int             `json:"num_conns"`          //number of connections per host (default 2)
+	ProtoVersion      int             `json:"proto_version"`      //native protocol version (discovered if 0)
+	Reconnect         ReconnectConfig `json:"reconnect"`          //reconnection configuration
+	HostSelection     string          `json:"host_selection"`     //host selection policy, one of the HostSelection consts (default token-aware)
+	LocalDC           string          `json:"local_dc"`           //local data center (required by dc-aware, used by token-aware if set)
+}
+
+//TLSConfig is a struct of TLS configuration of the connections to the cluster
+//Host certificates are verified against the CA certificates and host names by default
+type TLSConfig struct {
+	Enabled            bool   `json:"enabled"`              //whether connections use TLS
+	CAFile             string `json:"ca_file"`              //PEM file of the CA certificates of the hosts (system ones if empty)
+	CertFile           string `json:"cert_file"`            //PEM file of the client certificate (no client certificate if empty)
+	KeyFile            string `json:"key_file"`             //PEM file of the client certificate key (required with CertFile)
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` //whether host certificates and names are NOT verified (for testing only)
+}
+
+//ReconnectConfig is a struct of configuration of reconnection to hosts
+type ReconnectConfig struct {
+	Interval        Duration `json:"interval"`         //interval of reconnection attempts to down hosts (default 60s)
+	MaxRetries      int      `json:"max_retries"`      //max retries of a failed connection to a host (default 3)
+	InitialInterval Duration `json:"initial_interval"` //delay before the first retry (default 1s)
+	MaxInterval     Duration `json:"max_interval"`     //when set, retry delays grow exponentially up to it, otherwise they are constant
+}
+
+//Duration is a time.Duration loaded from a duration string such as "5s" or "1m30s"
+type Duration time.Duration
+
+//UnmarshalJSON is a function for loading a duration from a JSON duration string (used by encoding/json)
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %v", err)
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+//MarshalJSON is a function for encoding a duration as JSON duration string (used by encoding/json)
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+//LoadFile is a function for loading a configuration from a JSON file, unknown settings are rejected
+func LoadFile(path string) (*Config, *errors.Error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(fmt.Errorf("%w: %v", ErrInvalidConfig, err), 0)
+	}
+	defer file.Close()
+
+	config := Config{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, errors.Wrap(fmt.Errorf("%w: %v: %v", ErrInvalidConfig, path, err), 0)
+	}
+	return &config, nil
+}
+
+//Load is a function for loading a configuration from the JSON file at path (skipped if empty) overridden by the environment variables
+//with envPrefix (see LoadEnv), returning it once validated
+func Load(path string, envPrefix string) (*Config, *errors.Error) {
+	config := &Config{}
+	if path != "" {
+		var err *errors.Error
+		if config, err = LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.LoadEnv(envPrefix); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+//envVar is a struct of an environment variable overriding a setting
+type envVar struct {
+	name string                                   //name of the variable (without prefix)
+	set  func(config *Config, value string) error //function for setting the setting from the variable value
+}
+
+//envVars is the list of environment variables overriding settings (see LoadEnv)
+var envVars = []envVar{
+	{"HOSTS", func(c *Config, v string) error { c.Hosts = splitList(v); return nil }},
+	{"PORT", func(c *Config, v string) error { return parseInt(v, &c.Port) }},
+	{"KEYSPACE", func(c *Config, v string) error { c.Keyspace = v; return nil }},
+	{"USERNAME", func(c *Config, v string) error { c.Username = v; return nil }},
+	{"PASSWORD", func(c *Config, v string) error { c.Password = v; return nil }},
+	{"TLS_ENABLED", func(c *Config, v string) error { return parseBool(v, &c.TLS.Enabled) }},
+	{"TLS_CA_FILE", func(c *Config, v string) error { c.TLS.CAFile = v; return nil }},
+	{"TLS_CERT_FILE", func(c *Config, v string) error { c.TLS.CertFile = v; return nil }},
+	{"TLS_KEY_FILE", func(c *Config, v string) error { c.TLS.KeyFile = v; return nil }},
+	{"TLS_INSECURE_SKIP_VERIFY", func(c *Config, v string) error { return parseBool(v, &c.TLS.InsecureSkipVerify) }},
+	{"CONSISTENCY", func(c *Config, v string) error { c.Consistency = v; return nil }},
+	{"SERIAL_CONSISTENCY", func(c *Config, v string) error { c.SerialConsistency = v; return nil }},
+	{"TIMEOUT", func(c *Config, v string) error { return parseDuration(v, &c.Timeout) }},
+	{"CONNECT_TIMEOUT", func(c *Config, v string) error { return parseDuration(v, &c.ConnectTimeout) }},
+	{"NUM_CONNS", func(c *Config, v string) error { return parseInt(v, &c.NumConns) }},
+	{"PROTO_VERSION", func(c *Config, v string) error { return parseInt(v, &c.ProtoVersion) }},
+	{"RECONNECT_INTERVAL", func(c *Config, v string) error { return parseDuration(v, &c.Reconnect.Interval) }},
+	{"RECONNECT_MAX_RETRIES", func(c *Config, v string) error { return parseInt(v, &c.Reconnect.MaxRetries) }},
+	{"RECONNECT_INITIAL_INTERVAL", func(c *Config, v string) error { return parseDuration(v, &c.Reconnect.InitialInterval) }},
+	{"RECONNECT_MAX_INTERVAL", func(c *Config, v string) error { return parseDuration(v, &c.Reconnect.MaxInterval) }},
+	{"HOST_SELECTION", func(c *Config, v string) error { c.HostSelection = v; return nil }},
+	{"LOCAL_DC", func(c *Config, v string) error { c.LocalDC = v; return nil }},
+}
+
+//LoadEnv is a function for overriding settings with the environment variables that are set, named prefix followed by the setting name:
+//HOSTS (comma separated), PORT, KEYSPACE, USERNAME, PASSWORD, TLS_ENABLED, TLS_CA_FILE, TLS_CERT_FILE, TLS_KEY_FILE, TLS_INSECURE_SKIP_VERIFY,
+//CONSISTENCY, SERIAL_CONSISTENCY, TIMEOUT, CONNECT_TIMEOUT, NUM_CONNS, PROTO_VERSION, RECONNECT_INTERVAL, RECONNECT_MAX_RETRIES,
+//RECONNECT_INITIAL_INTERVAL, RECONNECT_MAX_INTERVAL, HOST_SELECTION and LOCAL_DC (e.g. CASSANDRA_HOSTS with prefix "CASSANDRA_")
+func (c *Config) LoadEnv(prefix string) *errors.Error {
+	var problems []string
+	for _, variable := range envVars {
+		value, ok := os.LookupEnv(prefix + variable.name)
+		if !ok {
+			continue
+		}
+		if err := variable.set(c, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%v%v: %v", prefix, variable.name, err))
+		}
+	}
+	return invalidConfigError(problems)
+}
+
+//Validate is a function for checking the configuration, the returned ErrInvalidConfig error lists all invalid settings
+func (c *Config) Validate() *errors.Error {
+	var problems []string
+	if len(c.Hosts) == 0 {
+		problems = append(problems, "hosts: at least one host is required")
+	}
+	for _, host := range c.Hosts {
+		if strings.TrimSpace(host) == "" {
+			problems = append(problems, "hosts: empty host")
+		}
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port: %v is not between 1 and 65535", c.Port))
+	}
+	if c.Username == "" && c.Password != "" {
+		problems = append(problems, "username: required with password")
+	}
+	if c.TLS.Enabled {
+		if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+			problems = append(problems, "tls: cert_file and key_file must be set together")
+		}
+		if c.TLS.InsecureSkipVerify && c.TLS.CAFile != "" {
+			problems = append(problems, "tls: ca_file is set but host certificates are not verified (insecure_skip_verify)")
+		}
+		for _, file := range []string{c.TLS.CAFile, c.TLS.CertFile, c.TLS.KeyFile} {
+			if _, err := os.Stat(file); file != "" && err != nil {
+				problems = append(problems, fmt.Sprintf("tls: %v", err))
+			}
+		}
+	} else if c.TLS.CAFile != "" || c.TLS.CertFile != "" || c.TLS.KeyFile != "" || c.TLS.InsecureSkipVerify {
+		problems = append(problems, "tls: certificate settings are set but TLS is not enabled")
+	}
+	if _, err := c.consistency(); err != nil {
+		problems = append(problems, fmt.Sprintf("consistency: %v", err))
+	}
+	if _, err := c.serialConsistency(); err != nil {
+		problems = append(problems, fmt.Sprintf("serial_consistency: %v", err))
+	}
+	for _, setting := range []struct {
+		name  string
+		value Duration
+	}{
+		{"timeout", c.Timeout},
+		{"connect_timeout", c.ConnectTimeout},
+		{"reconnect.interval", c.Reconnect.Interval},
+		{"reconnect.initial_interval", c.Reconnect.InitialInterval},
+		{"reconnect.max_interval", c.Reconnect.MaxInterval},
+	} {
+		if setting.value < 0 {
+			problems = append(problems, fmt.Sprintf("%v: %v is negative", setting.name, time.Duration(setting.value)))
+		}
+	}
+	if c.NumConns < 0 {
+		problems = append(problems, fmt.Sprintf("num_conns: %v is negative", c.NumConns))
+	}
+	if c.ProtoVersion != 0 && (c.ProtoVersion < 1 || c.ProtoVersion > 5) {
+		problems = append(problems, fmt.Sprintf("proto_version: %v is not between 1 and 5", c.ProtoVersion))
+	}
+	if c.Reconnect.MaxRetries < 0 {
+		problems = append(problems, fmt.Sprintf("reconnect.max_retries: %v is negative", c.Reconnect.MaxRetries))
+	}
+	if c.Reconnect.MaxInterval != 0 && c.Reconnect.MaxInterval < c.Reconnect.InitialInterval {
+		problems = append(problems, "reconnect.max_interval: less than initial_interval")
+	}
+	switch c.HostSelection {
+	case "", HostSelectionTokenAware, HostSelectionRoundRobin:
+	case HostSelectionDCAware:
+		if c.LocalDC == "" {
+			problems = append(problems, "local_dc: required by dc-aware host selection")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("host_selection: unknown policy %q (want %v, %v or %v)",
+			c.HostSelection, HostSelectionTokenAware, HostSelectionRoundRobin, HostSelectionDCAware))
+	}
+	return invalidConfigError(problems)
+}
+
+//consistency is a function for parsing the configured consistency
+func (c *Config) consistency() (gocql.Consistency, error) {
+	if c.Consistency == "" {
+		return gocql.Quorum, nil
+	}
+	return gocql.ParseConsistencyWrapper(c.Consistency)
+}
+
+//serialConsistency is a function for parsing the configured serial consistency
+func (c *Config) serialConsistency() (gocql.SerialConsistency, error) {
+	if c.SerialConsistency == "" {
+		return gocql.Serial, nil
+	}
+	var serialConsistency gocql.SerialConsistency
+	err := serialConsistency.UnmarshalText([]byte(strings.ToUpper(c.SerialConsistency)))
+	return serialConsistency, err
+}
+
+//invalidConfigError is a function for creating the ErrInvalidConfig error listing problems, nil if there are none
+func invalidConfigError(problems []string) *errors.Error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.Wrap(fmt.Errorf("%w: %v", ErrInvalidConfig, strings.Join(problems, "; ")), 1)
+}
+
+//splitList is a function for splitting a comma separated list, trimming spaces around items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		items = append(items, strings.TrimSpace(item))
+	}
+	return items
+}
+
+//parseInt is a function for parsing an integer setting into dest
+func parseInt(value string, dest *int) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", value)
+	}
+	*dest = parsed
+	return nil
+}
+
+//parseBool is a function for parsing a boolean setting into dest
+func parseBool(value string, dest *bool) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a boolean", value)
+	}
+	*dest = parsed
+	return nil
+}
+
+//parseDuration is a function for parsing a duration setting into dest
+func parseDuration(value string, dest *Duration) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration", value)
+	}
+	*dest = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,175 @@
+//config_test provides unit tests for storage configuration
+package storage_test
+
+import (
+	"testtrx/storage"
+
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"hosts": ["10.0.0.1", "10.0.0.2"],
+		"port": 9142,
+		"keyspace": "user",
+		"username": "app",
+		"password": "secret",
+		"consistency": "local_quorum",
+		"serial_consistency": "LOCAL_SERIAL",
+		"timeout": "5s",
+		"reconnect": {"max_retries": 5, "initial_interval": "500ms", "max_interval": "10s"},
+		"host_selection": "token-aware",
+		"local_dc": "dc1"
+	}`)
+
+	config, err := storage.Load(path, "STORAGE_TEST_UNSET_")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	cluster, err := config.ClusterConfig()
+	if err != nil {
+		t.Fatalf("Failed to build cluster config: %v", err)
+	}
+	if strings.Join(cluster.Hosts, ",") != "10.0.0.1,10.0.0.2" {
+		t.Errorf("want hosts %v, got %v", "10.0.0.1,10.0.0.2", cluster.Hosts)
+	}
+	if 9142 != cluster.Port {
+		t.Errorf("want port %v, got %v", 9142, cluster.Port)
+	}
+	if "user" != cluster.Keyspace {
+		t.Errorf("want keyspace %v, got %v", "user", cluster.Keyspace)
+	}
+	if gocql.LocalQuorum != cluster.Consistency {
+		t.Errorf("want consistency %v, got %v", gocql.LocalQuorum, cluster.Consistency)
+	}
+	if gocql.LocalSerial != cluster.SerialConsistency {
+		t.Errorf("want serial consistency %v, got %v", gocql.LocalSerial, cluster.SerialConsistency)
+	}
+	if 5*time.Second != cluster.Timeout {
+		t.Errorf("want timeout %v, got %v", 5*time.Second, cluster.Timeout)
+	}
+	authenticator, ok := cluster.Authenticator.(gocql.PasswordAuthenticator)
+	if !ok || "app" != authenticator.Username || "secret" != authenticator.Password {
+		t.Errorf("want password authenticator of %v, got %v", "app", cluster.Authenticator)
+	}
+	policy, ok := cluster.ReconnectionPolicy.(*gocql.ExponentialReconnectionPolicy)
+	if !ok || 5 != policy.MaxRetries || 500*time.Millisecond != policy.InitialInterval || 10*time.Second != policy.MaxInterval {
+		t.Errorf("want exponential reconnection policy, got %#v", cluster.ReconnectionPolicy)
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, `{"hosts": ["10.0.0.1"], "keyspace": "user", "consistency": "ONE"}`)
+	t.Setenv("STORAGE_TEST_HOSTS", "10.0.0.3, 10.0.0.4")
+	t.Setenv("STORAGE_TEST_CONSISTENCY", "QUORUM")
+	t.Setenv("STORAGE_TEST_CONNECT_TIMEOUT", "2s")
+
+	config, err := storage.Load(path, "STORAGE_TEST_")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if strings.Join(config.Hosts, ",") != "10.0.0.3,10.0.0.4" {
+		t.Errorf("want hosts %v, got %v", "10.0.0.3,10.0.0.4", config.Hosts)
+	}
+	if "QUORUM" != config.Consistency {
+		t.Errorf("want consistency %v, got %v", "QUORUM", config.Consistency)
+	}
+	if storage.Duration(2*time.Second) != config.ConnectTimeout {
+		t.Errorf("want connect timeout %v, got %v", 2*time.Second, time.Duration(config.ConnectTimeout))
+	}
+	//settings not overridden are kept
+	if "user" != config.Keyspace {
+		t.Errorf("want keyspace %v, got %v", "user", config.Keyspace)
+	}
+}
+
+func TestTLSVerifiesHostsByDefault(t *testing.T) {
+	caFile := writeConfigFile(t, "")
+	for _, tc := range []struct {
+		name   string
+		tls    storage.TLSConfig
+		verify bool
+	}{
+		{"Default", storage.TLSConfig{Enabled: true}, true},
+		{"CAFile", storage.TLSConfig{Enabled: true, CAFile: caFile}, true},
+		{"InsecureSkipVerify", storage.TLSConfig{Enabled: true, InsecureSkipVerify: true}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := storage.Config{Hosts: []string{"h"}, TLS: tc.tls}
+			cluster, err := config.ClusterConfig()
+			if err != nil {
+				t.Fatalf("Failed to build cluster config: %v", err)
+			}
+			if cluster.SslOpts == nil || tc.verify != cluster.SslOpts.EnableHostVerification {
+				t.Errorf("want host verification %v, got %#v", tc.verify, cluster.SslOpts)
+			}
+		})
+	}
+
+	//a CA file is pointless without verification
+	config := storage.Config{Hosts: []string{"h"}, TLS: storage.TLSConfig{Enabled: true, CAFile: caFile, InsecureSkipVerify: true}}
+	if err := config.Validate(); !errors.Is(err, storage.ErrInvalidConfig) || !strings.Contains(err.Error(), "insecure_skip_verify") {
+		t.Errorf("want %v error mentioning insecure_skip_verify, got %v", storage.ErrInvalidConfig, err)
+	}
+}
+
+func TestLoadRejectsInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		env     map[string]string
+		want    []string
+	}{
+		{"Malformed", `{"hosts": [`, nil, []string{"unexpected EOF"}},
+		{"UnknownSetting", `{"hosts": ["h"], "hostz": []}`, nil, []string{"hostz"}},
+		{"BadDuration", `{"hosts": ["h"], "timeout": 5}`, nil, []string{"duration"}},
+		{"Settings", `{
+			"port": 70000,
+			"password": "secret",
+			"consistency": "MOST",
+			"tls": {"cert_file": "cert.pem"},
+			"host_selection": "dc-aware"
+		}`, nil, []string{"hosts", "port", "username", "consistency", "tls", "local_dc"}},
+		{"Env", `{"hosts": ["h"]}`, map[string]string{"STORAGE_TEST_PORT": "many", "STORAGE_TEST_TIMEOUT": "soon"},
+			[]string{"STORAGE_TEST_PORT", "STORAGE_TEST_TIMEOUT"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			_, err := storage.Load(writeConfigFile(t, tc.content), "STORAGE_TEST_")
+			if !errors.Is(err, storage.ErrInvalidConfig) {
+				t.Fatalf("want %v error, got %v", storage.ErrInvalidConfig, err)
+			}
+			//all invalid settings are reported
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("want error mentioning %v, got %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFileNotFound(t *testing.T) {
+	_, err := storage.LoadFile(filepath.Join(t.TempDir(), "missing.json"))
+	if !errors.Is(err, storage.ErrInvalidConfig) {
+		t.Errorf("want %v error, got %v", storage.ErrInvalidConfig, err)
+	}
+}
@@ -0,0 +1,99 @@
+//Package storage provides the creation of cassandra sessions from configuration
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
+)
+
+//ClusterConfig is a function for building the gocql cluster configuration of the configuration, once validated
+func (c *Config) ClusterConfig() (*gocql.ClusterConfig, *errors.Error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	cluster := gocql.NewCluster(c.Hosts...)
+	if c.Port != 0 {
+		cluster.Port = c.Port
+	}
+	cluster.Keyspace = c.Keyspace
+	if c.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: c.Username, Password: c.Password}
+	}
+	if c.TLS.Enabled {
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 c.TLS.CAFile,
+			CertPath:               c.TLS.CertFile,
+			KeyPath:                c.TLS.KeyFile,
+			EnableHostVerification: !c.TLS.InsecureSkipVerify,
+		}
+	}
+	//Note: consistencies are valid since the configuration has been validated
+	cluster.Consistency, _ = c.consistency()
+	cluster.SerialConsistency, _ = c.serialConsistency()
+	if c.Timeout != 0 {
+		cluster.Timeout = time.Duration(c.Timeout)
+	}
+	if c.ConnectTimeout != 0 {
+		cluster.ConnectTimeout = time.Duration(c.ConnectTimeout)
+	}
+	if c.NumConns != 0 {
+		cluster.NumConns = c.NumConns
+	}
+	cluster.ProtoVersion = c.ProtoVersion
+	if c.Reconnect.Interval != 0 {
+		cluster.ReconnectInterval = time.Duration(c.Reconnect.Interval)
+	}
+	cluster.ReconnectionPolicy = c.reconnectionPolicy()
+	cluster.PoolConfig.HostSelectionPolicy = c.hostSelectionPolicy()
+	return cluster, nil
+}
+
+//reconnectionPolicy is a function for creating the reconnection policy of the configuration
+func (c *Config) reconnectionPolicy() gocql.ReconnectionPolicy {
+	maxRetries, initialInterval := 3, time.Second
+	if c.Reconnect.MaxRetries != 0 {
+		maxRetries = c.Reconnect.MaxRetries
+	}
+	if c.Reconnect.InitialInterval != 0 {
+		initialInterval = time.Duration(c.Reconnect.InitialInterval)
+	}
+	if c.Reconnect.MaxInterval != 0 {
+		return &gocql.ExponentialReconnectionPolicy{
+			MaxRetries:      maxRetries,
+			InitialInterval: initialInterval,
+			MaxInterval:     time.Duration(c.Reconnect.MaxInterval),
+		}
+	}
+	return &gocql.ConstantReconnectionPolicy{MaxRetries: maxRetries, Interval: initialInterval}
+}
+
+//hostSelectionPolicy is a function for creating the host selection policy of the configuration
+func (c *Config) hostSelectionPolicy() gocql.HostSelectionPolicy {
+	var localPolicy gocql.HostSelectionPolicy = gocql.RoundRobinHostPolicy()
+	if c.LocalDC != "" {
+		localPolicy = gocql.DCAwareRoundRobinPolicy(c.LocalDC)
+	}
+	switch c.HostSelection {
+	case HostSelectionRoundRobin:
+		return gocql.RoundRobinHostPolicy()
+	case HostSelectionDCAware:
+		return localPolicy
+	}
+	return gocql.TokenAwareHostPolicy(localPolicy)
+}
+
+//NewSession is a function for creating a session connected to the cluster of config
+func NewSession(config *Config) (*gocql.Session, *errors.Error) {
+	cluster, err := config.ClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	session, sessionErr := cluster.CreateSession()
+	if sessionErr != nil {
+		return nil, errors.Wrap(fmt.Errorf("could not connect to cluster %v: %w", config.Hosts, sessionErr), 0)
+	}
+	return session, nil
+}